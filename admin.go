@@ -0,0 +1,135 @@
+package mess
+
+import (
+	"errors"
+	"io"
+
+	"github.com/emersion/go-imap"
+	"github.com/emersion/go-imap/backend"
+)
+
+var ErrSessionClosed = errors.New("Session closed by the server")
+
+// CloseSessions terminates all sessions that have the mailbox selected.
+//
+// Affected handles are marked as closed: they no longer receive updates
+// and ResolveSeq returns ErrSessionClosed. Each session is sent an untagged
+// BYE response with the specified reason text and its connection is closed
+// if backend.Conn implements io.Closer. This happens on the next Sync or
+// EndCommand call from the session itself (e.g. at the end of the command or
+// in IDLE) since backend.Conn should not be used outside of the connection
+// goroutine.
+//
+// If key is a MailboxKey with empty MailboxID, sessions for all mailboxes of
+// the account are terminated.
+//
+// The request is propagated to other nodes via SetExternalSink.
+func (m *Manager) CloseSessions(key interface{}, reason string) error {
+	if m.isClosed() {
+		return ErrManagerClosed
+	}
+
+	upd := Update{
+		Type:   UpdCloseSessions,
+		Key:    key,
+		Reason: reason,
+	}
+	m.traceUpdate(&upd, false)
+	m.emit(upd)
+
+	m.closeSessions(key, reason)
+	return nil
+}
+
+// CloseAccountSessions terminates all sessions of the specified account.
+//
+// See CloseSessions for details.
+func (m *Manager) CloseAccountSessions(account, reason string) error {
+	return m.CloseSessions(MailboxKey{Account: account}, reason)
+}
+
+func (m *Manager) closeSessions(key interface{}, reason string) {
+	var keys []interface{}
+	if mkey, ok := key.(MailboxKey); ok && mkey.MailboxID == "" {
+		m.forEachShared(mkey.Account, func(key interface{}, _ *sharedHandle) {
+			keys = append(keys, key)
+		})
+	} else {
+		keys = []interface{}{key}
+	}
+
+	var handles []*MailboxHandle
+	for _, key := range keys {
+		shard := m.shard(key)
+		shard.lock.Lock()
+		shared := shard.handles[key]
+		if shared == nil {
+			shard.lock.Unlock()
+			continue
+		}
+
+		shared.handlesLock.Lock()
+		for hndl := range shared.handles {
+			handles = append(handles, hndl)
+		}
+		shared.clearHandles()
+		shared.handlesLock.Unlock()
+
+		delete(shard.handles, key)
+		m.unsubscribe(key)
+		shard.lock.Unlock()
+	}
+
+	for _, hndl := range handles {
+		hndl.lock.Lock()
+		hndl.markClosed(reason)
+		hndl.idleUpdate()
+		hndl.lock.Unlock()
+	}
+}
+
+// markClosed marks the handle as terminated. BYE with the specified reason
+// text is sent on the next Sync or EndCommand call.
+//
+// handle.lock should be held.
+func (handle *MailboxHandle) markClosed(reason string) {
+	handle.closed = true
+	handle.byePending = true
+	handle.byeReason = reason
+}
+
+// flushBye sends BYE queued by CloseSessions or Shutdown, if any. In the
+// latter case, pending updates are sent first, expunge has the same meaning
+// as for Sync.
+//
+// handle.lock should be held, it is released before BYE is sent.
+func (handle *MailboxHandle) flushBye(expunge bool) {
+	bye, reason := handle.byePending, handle.byeReason
+	handle.byePending = false
+	if bye && handle.byeFlush {
+		handle.syncUnlocked(expunge)
+	}
+	sent := handle.byeSent
+	handle.byeSent = nil
+	handle.lock.Unlock()
+
+	if bye {
+		handle.sendBye(reason)
+	}
+	if sent != nil {
+		close(sent)
+	}
+}
+
+// sendBye terminates the connection closed by CloseSessions.
+func (handle *MailboxHandle) sendBye(reason string) {
+	handle.send(&backend.StatusUpdate{
+		StatusResp: &imap.StatusResp{
+			Type: imap.StatusRespBye,
+			Info: reason,
+		},
+	})
+	if closer, ok := handle.conn.(io.Closer); ok {
+		closer.Close()
+	}
+}
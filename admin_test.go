@@ -0,0 +1,139 @@
+package mess
+
+import (
+	"testing"
+	"time"
+
+	"github.com/emersion/go-imap"
+	"github.com/emersion/go-imap/backend"
+)
+
+func TestCloseSessions(t *testing.T) {
+	m := NewManager()
+	upds := make(chan Update, 10)
+	m.SetExternalSink(upds)
+
+	inbox := MailboxKey{Account: "foxcpp", MailboxID: "INBOX"}
+	sent := MailboxKey{Account: "foxcpp", MailboxID: "Sent"}
+	other := MailboxKey{Account: "emersion", MailboxID: "INBOX"}
+
+	inboxHndl, inboxConn := openTestHandle(m, inbox, 1)
+	sentHndl, sentConn := openTestHandle(m, sent, 1)
+	otherHndl, otherConn := openTestHandle(m, other, 1)
+
+	m.CloseAccountSessions("foxcpp", "Account suspended")
+
+	if upd := <-upds; upd.Type != UpdCloseSessions || upd.Reason != "Account suspended" {
+		t.Fatal("Unexpected update sent to sink:", upd)
+	}
+
+	// BYE is sent from the session goroutine.
+	if upds := inboxConn.take(); len(upds) != 0 {
+		t.Fatal("Updates sent outside of the session:", upds)
+	}
+	inboxHndl.Sync(false)
+	sentHndl.Sync(true)
+
+	for _, conn := range []*testConn{inboxConn, sentConn} {
+		upds := conn.take()
+		if len(upds) != 1 {
+			t.Fatal("Expected BYE, got", upds)
+		}
+		status, ok := upds[0].(*backend.StatusUpdate)
+		if !ok || status.Type != imap.StatusRespBye || status.Info != "Account suspended" {
+			t.Fatal("Expected BYE, got", upds[0])
+		}
+	}
+	if upds := otherConn.take(); len(upds) != 0 {
+		t.Fatal("Unexpected updates for other account:", upds)
+	}
+
+	inboxHndl.Sync(true)
+	if upds := inboxConn.take(); len(upds) != 0 {
+		t.Fatal("BYE sent twice:", upds)
+	}
+
+	if !inboxHndl.Closed() || !sentHndl.Closed() || otherHndl.Closed() {
+		t.Fatal("Wrong handles marked as closed")
+	}
+	if _, err := inboxHndl.ResolveSeq(false, new(imap.SeqSet)); err != ErrSessionClosed {
+		t.Fatal("Expected ErrSessionClosed, got", err)
+	}
+
+	// Closing the handle after it was terminated should not affect
+	// new sessions.
+	newHndl, newConn := openTestHandle(m, inbox, 1)
+	if err := inboxHndl.Close(); err != nil {
+		t.Fatal(err)
+	}
+	m.NewMessage(inbox, 2)
+	newHndl.Sync(true)
+	if upds := newConn.take(); len(upds) != 2 {
+		t.Fatal("Expected EXISTS and RECENT, got", upds)
+	}
+}
+
+func TestCloseSessionsIdle(t *testing.T) {
+	m := NewManager()
+	hndl, conn := openTestHandle(m, "INBOX", 1)
+	defer hndl.Close()
+
+	done := make(chan struct{})
+	idleDone := make(chan struct{})
+	go func() {
+		hndl.Idle(done)
+		close(idleDone)
+	}()
+	for hndl.Command() != CmdIdle {
+		time.Sleep(time.Millisecond)
+	}
+
+	m.CloseSessions("INBOX", "Bye")
+	for {
+		conn.lock.Lock()
+		n := len(conn.updates)
+		conn.lock.Unlock()
+		if n != 0 {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+	close(done)
+	<-idleDone
+
+	upds := conn.take()
+	if len(upds) != 1 {
+		t.Fatal("Expected BYE, got", upds)
+	}
+	if status, ok := upds[0].(*backend.StatusUpdate); !ok || status.Type != imap.StatusRespBye {
+		t.Fatal("Expected BYE, got", upds[0])
+	}
+}
+
+func TestCloseSessionsCommand(t *testing.T) {
+	m := NewManager()
+	hndl, conn := openTestHandle(m, "INBOX", 1)
+	defer hndl.Close()
+
+	m.CloseSessions("INBOX", "Bye")
+
+	hndl.BeginCommand(CmdUid)
+	if _, err := hndl.ResolveSeq(true, &imap.SeqSet{Set: []imap.Seq{{Start: 1, Stop: 1}}}); err != ErrSessionClosed {
+		t.Fatal("Expected ErrSessionClosed, got", err)
+	}
+	hndl.EndCommand()
+
+	upds := conn.take()
+	if len(upds) != 1 {
+		t.Fatal("Expected BYE, got", upds)
+	}
+	if status, ok := upds[0].(*backend.StatusUpdate); !ok || status.Type != imap.StatusRespBye || status.Info != "Bye" {
+		t.Fatal("Expected BYE, got", upds[0])
+	}
+
+	hndl.BeginCommand(CmdUid)
+	hndl.EndCommand()
+	if upds := conn.take(); len(upds) != 0 {
+		t.Fatal("BYE sent twice:", upds)
+	}
+}
@@ -1,11 +1,16 @@
 package mess_test
 
 import (
+	"bytes"
 	"math/rand"
 	"testing"
+	"time"
 
+	"github.com/emersion/go-imap"
+	"github.com/emersion/go-imap/backend"
 	backendtests "github.com/foxcpp/go-imap-backend-tests"
 	"github.com/foxcpp/go-imap-mess/memory"
+	"github.com/foxcpp/go-imap-mess/messtest"
 )
 
 func initBackend() backendtests.Backend {
@@ -16,3 +21,47 @@ func TestBackend(t *testing.T) {
 	rand.Seed(1)
 	backendtests.RunTests(t, initBackend, func(_ backendtests.Backend) {})
 }
+
+func TestMemoryKeywords(t *testing.T) {
+	be := memory.New()
+	be.Keywords = true
+
+	u, err := be.Login(nil, "username", "password")
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn := &messtest.FakeConn{}
+	_, mbox, err := u.GetMailbox("INBOX", false, conn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer mbox.Close()
+
+	expectFlags := func(flag string) {
+		t.Helper()
+		mbox.Poll(true)
+		for _, upd := range conn.Take() {
+			if upd, ok := upd.(*backend.MailboxUpdate); ok && upd.Flags != nil {
+				for _, f := range upd.Flags {
+					if f == flag {
+						return
+					}
+				}
+				t.Fatalf("%v is not in FLAGS: %v", flag, upd.Flags)
+			}
+		}
+		t.Fatal("Expected FLAGS with", flag)
+	}
+
+	err = u.CreateMessage("INBOX", []string{"$Appended"}, time.Time{}, bytes.NewReader(nil), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expectFlags("$Appended")
+
+	err = mbox.UpdateMessagesFlags(true, &imap.SeqSet{Set: []imap.Seq{{Start: 6, Stop: 6}}}, imap.AddFlags, false, []string{"$Stored"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	expectFlags("$Stored")
+}
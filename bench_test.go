@@ -0,0 +1,315 @@
+package mess
+
+import (
+	"bytes"
+	"io"
+	"strconv"
+	"sync/atomic"
+	"testing"
+
+	"github.com/emersion/go-imap"
+)
+
+// benchmarkSharding runs bench with the sharded handles map and with all
+// keys in a single shard, which is equivalent to the single map.
+func benchmarkSharding(b *testing.B, bench func(b *testing.B, m *Manager)) {
+	b.Run("sharded", func(b *testing.B) {
+		bench(b, NewManager())
+	})
+	b.Run("unsharded", func(b *testing.B) {
+		m := NewManager()
+		m.shardMask = 0
+		bench(b, m)
+	})
+}
+
+// BenchmarkManagerContention measures the throughput of operations on
+// unrelated mailboxes performed concurrently.
+func BenchmarkManagerContention(b *testing.B) {
+	benchmarkSharding(b, func(b *testing.B, m *Manager) {
+		var workerID int32
+		b.ReportAllocs()
+		b.RunParallel(func(pb *testing.PB) {
+			key := "mbox" + strconv.Itoa(int(atomic.AddInt32(&workerID, 1)))
+			conn := &testConn{}
+
+			uid := uint32(1)
+			for pb.Next() {
+				hndl, err := m.Mailbox(key, testMailbox{conn: conn}, []uint32{}, &imap.SeqSet{})
+				if err != nil {
+					b.Fatal(err)
+				}
+				m.NewMessage(key, uid)
+				hndl.FlagsChanged(uid, []string{imap.SeenFlag}, false)
+				hndl.Sync(true)
+				hndl.Close()
+				conn.take()
+				uid++
+			}
+		})
+	})
+}
+
+// BenchmarkManagerContentionShared measures the throughput of NewMessage
+// calls for unrelated mailboxes while other connections keep
+// opening and closing mailboxes.
+func BenchmarkManagerContentionShared(b *testing.B) {
+	benchmarkSharding(b, func(b *testing.B, m *Manager) {
+		for i := 0; i < 1000; i++ {
+			openTestHandle(m, "idle"+strconv.Itoa(i))
+		}
+
+		var workerID int32
+		b.ReportAllocs()
+		b.ResetTimer()
+		b.RunParallel(func(pb *testing.PB) {
+			id := atomic.AddInt32(&workerID, 1)
+			key := "mbox" + strconv.Itoa(int(id))
+			hndl, conn := openTestHandle(m, key)
+			defer hndl.Close()
+
+			uid := uint32(1)
+			for pb.Next() {
+				if id%2 == 0 {
+					other, _ := openTestHandle(m, key+"-churn")
+					other.Close()
+				} else {
+					m.NewMessage(key, uid)
+					uid++
+					if uid%64 == 0 {
+						hndl.Sync(true)
+						conn.take()
+					}
+				}
+			}
+		})
+	})
+}
+
+// BenchmarkShard measures the cost of picking the shard for a key.
+func BenchmarkShard(b *testing.B) {
+	m := NewManager()
+	keys := map[string]interface{}{
+		"string":     "user@example.org/INBOX",
+		"MailboxKey": MailboxKey{Account: "user@example.org", MailboxID: "INBOX"},
+		"int":        12345,
+	}
+	for name, key := range keys {
+		key := key
+		b.Run(name, func(b *testing.B) {
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				m.shard(key)
+			}
+		})
+	}
+}
+
+func benchmarkDecode(b *testing.B, newEnc func(io.Writer) Encoder, newDec func(io.Reader) Decoder) {
+	var buf bytes.Buffer
+	enc := newEnc(&buf)
+	upd := Update{Type: UpdRemoved, Key: MailboxKey{Account: "u", MailboxID: "1"}, SeqSet: "1:100,200,300:400"}
+	for i := 0; i < b.N; i++ {
+		if err := enc.Encode(upd); err != nil {
+			b.Fatal(err)
+		}
+	}
+
+	m := NewManager()
+	dec := newDec(&buf)
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		var upd Update
+		if err := dec.Decode(&upd); err != nil {
+			b.Fatal(err)
+		}
+		if err := m.ExternalUpdate(upd); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkDecodeBinary(b *testing.B) {
+	benchmarkDecode(b, NewEncoder, NewDecoder)
+}
+
+func BenchmarkDecodeJSON(b *testing.B) {
+	benchmarkDecode(b, NewJSONEncoder, NewJSONDecoder)
+}
+
+func seqUids(n int) []uint32 {
+	uids := make([]uint32, n)
+	for i := range uids {
+		uids[i] = uint32(i + 1)
+	}
+	return uids
+}
+
+// BenchmarkNewMessageFanOut measures the cost of NewMessage for the mailbox
+// selected by the specified number of sessions.
+func BenchmarkNewMessageFanOut(b *testing.B) {
+	for _, n := range []int{1, 100, 10000} {
+		b.Run(strconv.Itoa(n), func(b *testing.B) {
+			m := NewManager()
+			handles := make([]*MailboxHandle, 0, n)
+			for i := 0; i < n; i++ {
+				hndl, _ := openTestHandle(m, "INBOX")
+				handles = append(handles, hndl)
+			}
+
+			b.ReportAllocs()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				m.NewMessage("INBOX", uint32(i+1))
+
+				// Do not let pending queues grow indefinitely.
+				if i%1024 == 1023 {
+					b.StopTimer()
+					for _, hndl := range handles {
+						hndl.Sync(false)
+						hndl.conn.(*testConn).take()
+					}
+					b.StartTimer()
+				}
+			}
+		})
+	}
+}
+
+// BenchmarkFlagsChangedBurst measures FlagsChanged calls for different
+// messages in a mailbox selected by 10 sessions.
+func BenchmarkFlagsChangedBurst(b *testing.B) {
+	const messages = 1000
+
+	m := NewManager()
+	hndl, conn := openTestHandle(m, "INBOX", seqUids(messages)...)
+	var others []*MailboxHandle
+	for i := 0; i < 9; i++ {
+		other, _ := openTestHandle(m, "INBOX", seqUids(messages)...)
+		others = append(others, other)
+	}
+	flags := [][]string{{imap.SeenFlag}, {imap.SeenFlag, imap.FlaggedFlag}}
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		hndl.FlagsChanged(uint32(i%messages+1), flags[i/messages%2], false)
+
+		if i%messages == messages-1 {
+			b.StopTimer()
+			hndl.Sync(false)
+			conn.take()
+			for _, other := range others {
+				other.Sync(false)
+				other.conn.(*testConn).take()
+			}
+			b.StartTimer()
+		}
+	}
+}
+
+// BenchmarkSyncExpunge measures Sync that sends EXPUNGE for a half of the
+// mailbox.
+func BenchmarkSyncExpunge(b *testing.B) {
+	for _, n := range []int{1000, 100000} {
+		b.Run(strconv.Itoa(n), func(b *testing.B) {
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				b.StopTimer()
+				m := NewManager()
+				hndl, conn := openTestHandle(m, "INBOX", seqUids(n)...)
+				other, _ := openTestHandle(m, "INBOX", seqUids(n)...)
+				// Every second message so EXPUNGE responses are not trivially
+				// sequential.
+				var removed imap.SeqSet
+				for uid := uint32(1); uid <= uint32(n); uid += 2 {
+					removed.AddNum(uid)
+				}
+				other.RemovedSet(removed)
+				b.StartTimer()
+
+				hndl.Sync(true)
+
+				b.StopTimer()
+				if upds := conn.take(); len(upds) != n/2 {
+					b.Fatal("Unexpected number of updates:", len(upds))
+				}
+				other.Close()
+				hndl.Close()
+				b.StartTimer()
+			}
+		})
+	}
+}
+
+// BenchmarkResolveSeq measures ResolveSeq on a mailbox with 1M messages.
+func BenchmarkResolveSeq(b *testing.B) {
+	const messages = 1000000
+
+	uids := make([]uint32, messages)
+	for i := range uids {
+		// Leave gaps so UIDs are not equal to sequence numbers.
+		uids[i] = uint32(i*2 + 1)
+	}
+	m := NewManager()
+	hndl, _ := openTestHandle(m, "INBOX", uids...)
+	defer hndl.Close()
+
+	cases := []struct {
+		name string
+		uid  bool
+		set  string
+	}{
+		{"Seq", false, "500000:500100,999999"},
+		{"SeqAll", false, "1:*"},
+		{"Uid", true, "1000001:1000201,1999999"},
+		{"UidAll", true, "1:*"},
+	}
+	for _, c := range cases {
+		set, err := imap.ParseSeqSet(c.set)
+		if err != nil {
+			b.Fatal(err)
+		}
+		b.Run(c.name, func(b *testing.B) {
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				// ResolveSeq modifies UID sets in place.
+				set := &imap.SeqSet{Set: append([]imap.Seq(nil), set.Set...)}
+				if _, err := hndl.ResolveSeq(c.uid, set); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+// BenchmarkMailboxChurn measures concurrent Mailbox and Close calls for a
+// mailbox that is also selected by 100 long-living sessions.
+func BenchmarkMailboxChurn(b *testing.B) {
+	m := NewManager()
+	uids := seqUids(1000)
+	for i := 0; i < 100; i++ {
+		openTestHandle(m, "INBOX", uids...)
+	}
+
+	// The handle never modifies the UID list in place and the capacity is
+	// limited so appends allocate a new array, so sharing it is safe and
+	// the copy is not measured.
+	uids = uids[:len(uids):len(uids)]
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		conn := &testConn{}
+		for pb.Next() {
+			hndl, err := m.Mailbox("INBOX", testMailbox{conn: conn}, uids, &imap.SeqSet{})
+			if err != nil {
+				b.Fatal(err)
+			}
+			if err := hndl.Close(); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+}
@@ -0,0 +1,371 @@
+package mess
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+
+	"github.com/emersion/go-imap"
+)
+
+// codecVersion is the schema version written in each binary frame. It is
+// incremented only on incompatible changes, new fields get new tags instead.
+const codecVersion = 1
+
+// maxFrameSize limits the memory allocated for a single binary frame.
+const maxFrameSize = 16 * 1024 * 1024
+
+// Field tags of the binary encoding. Decoder skips unknown tags so
+// new fields can be added without breaking older nodes.
+const (
+	tagType = iota + 1
+	tagKeyString
+	tagKeyMailbox
+	tagSeqSet
+	tagFlag
+	tagReason
+	tagTraceID
+)
+
+var (
+	ErrKeyType         = errors.New("Only string and MailboxKey keys can be serialized")
+	ErrCodecVersion    = errors.New("Unsupported update encoding version")
+	ErrFrameTooLarge   = errors.New("Update frame is too large")
+	ErrMalformedUpdate = errors.New("Malformed update frame")
+)
+
+// Encoder serializes updates, e.g. ones received from the channel set using
+// SetExternalSink.
+type Encoder interface {
+	Encode(upd Update) error
+}
+
+// Decoder deserializes updates written by the corresponding Encoder so they
+// can be passed to ExternalUpdate. io.EOF is returned when there are no more
+// updates.
+type Decoder interface {
+	Decode(upd *Update) error
+}
+
+// frameWriter writes length-prefixed frames.
+type frameWriter struct {
+	w   io.Writer
+	buf []byte
+}
+
+// begin returns the buffer for the next frame with space reserved for the
+// length prefix.
+func (fw *frameWriter) begin() []byte {
+	return append(fw.buf[:0], make([]byte, binary.MaxVarintLen32)...)
+}
+
+func (fw *frameWriter) write(frame []byte) error {
+	size := len(frame) - binary.MaxVarintLen32
+	if size > maxFrameSize {
+		return ErrFrameTooLarge
+	}
+	var sizeBuf [binary.MaxVarintLen32]byte
+	n := binary.PutUvarint(sizeBuf[:], uint64(size))
+	start := binary.MaxVarintLen32 - n
+	copy(frame[start:], sizeBuf[:n])
+
+	fw.buf = frame
+	_, err := fw.w.Write(frame[start:])
+	return err
+}
+
+// frameReader reads frames written by frameWriter.
+type frameReader struct {
+	r   *bufio.Reader
+	buf []byte
+}
+
+// read returns the next frame. It is valid only until the next call.
+func (fr *frameReader) read() ([]byte, error) {
+	size, err := binary.ReadUvarint(fr.r)
+	if err != nil {
+		return nil, err
+	}
+	if size > maxFrameSize {
+		return nil, ErrFrameTooLarge
+	}
+
+	if uint64(cap(fr.buf)) < size {
+		fr.buf = make([]byte, size)
+	}
+	frame := fr.buf[:size]
+	if _, err := io.ReadFull(fr.r, frame); err != nil {
+		if err == io.EOF {
+			return nil, io.ErrUnexpectedEOF
+		}
+		return nil, err
+	}
+	return frame, nil
+}
+
+type binaryEncoder struct {
+	fw frameWriter
+}
+
+// NewEncoder returns the Encoder that writes updates in the compact binary
+// format.
+//
+// Each update is written as a length-prefixed frame starting with the schema
+// version followed by tagged fields. Sequence sets are written as varint
+// ranges so ExternalUpdate does not need to parse decoded updates.
+func NewEncoder(w io.Writer) Encoder {
+	return &binaryEncoder{fw: frameWriter{w: w}}
+}
+
+func appendUvarint(buf []byte, val uint64) []byte {
+	var data [binary.MaxVarintLen64]byte
+	n := binary.PutUvarint(data[:], val)
+	return append(buf, data[:n]...)
+}
+
+func appendField(buf []byte, tag uint64, data []byte) []byte {
+	buf = appendUvarint(buf, tag)
+	buf = appendUvarint(buf, uint64(len(data)))
+	return append(buf, data...)
+}
+
+func appendUvarintField(buf []byte, tag, val uint64) []byte {
+	return appendField(buf, tag, appendUvarint(nil, val))
+}
+
+// appendFrame appends the binary encoding of the update to buf.
+func appendFrame(buf []byte, upd Update) ([]byte, error) {
+	var seq *imap.SeqSet
+	if upd.SeqSet != "" {
+		var err error
+		seq, err = imap.ParseSeqSet(upd.SeqSet)
+		if err != nil {
+			return buf, &UpdateError{Update: upd, Err: err}
+		}
+	}
+
+	buf = append(buf, codecVersion)
+	buf = appendUvarintField(buf, tagType, uint64(upd.Type))
+
+	switch key := upd.Key.(type) {
+	case string:
+		buf = appendField(buf, tagKeyString, []byte(key))
+	case MailboxKey:
+		data := appendUvarint(nil, uint64(len(key.Account)))
+		data = append(data, key.Account...)
+		data = append(data, key.MailboxID...)
+		buf = appendField(buf, tagKeyMailbox, data)
+	default:
+		return buf, &UpdateError{Update: upd, Err: ErrKeyType}
+	}
+
+	if seq != nil {
+		var data []byte
+		for _, r := range seq.Set {
+			data = appendUvarint(data, uint64(r.Start))
+			data = appendUvarint(data, uint64(r.Stop))
+		}
+		buf = appendField(buf, tagSeqSet, data)
+	}
+	for _, f := range upd.NewFlags {
+		buf = appendField(buf, tagFlag, []byte(f))
+	}
+	if upd.Reason != "" {
+		buf = appendField(buf, tagReason, []byte(upd.Reason))
+	}
+	if upd.TraceID != 0 {
+		buf = appendUvarintField(buf, tagTraceID, upd.TraceID)
+	}
+	return buf, nil
+}
+
+func (e *binaryEncoder) Encode(upd Update) error {
+	frame, err := appendFrame(e.fw.begin(), upd)
+	if err != nil {
+		return err
+	}
+	return e.fw.write(frame)
+}
+
+type binaryDecoder struct {
+	fr frameReader
+}
+
+// NewDecoder returns the Decoder for updates written by NewEncoder.
+//
+// Frames with newer schema version are rejected with ErrCodecVersion, unknown
+// fields are ignored.
+func NewDecoder(r io.Reader) Decoder {
+	return &binaryDecoder{fr: frameReader{r: bufio.NewReader(r)}}
+}
+
+func (d *binaryDecoder) Decode(upd *Update) error {
+	frame, err := d.fr.read()
+	if err != nil {
+		return err
+	}
+	return decodeFrame(frame, upd)
+}
+
+func readUvarint(data []byte) (uint64, []byte, error) {
+	val, n := binary.Uvarint(data)
+	if n <= 0 {
+		return 0, nil, ErrMalformedUpdate
+	}
+	return val, data[n:], nil
+}
+
+func decodeFrame(frame []byte, upd *Update) error {
+	if len(frame) == 0 {
+		return ErrMalformedUpdate
+	}
+	if frame[0] != codecVersion {
+		return fmt.Errorf("%w: %d", ErrCodecVersion, frame[0])
+	}
+	frame = frame[1:]
+
+	*upd = Update{}
+	for len(frame) != 0 {
+		var (
+			tag, size uint64
+			err       error
+		)
+		tag, frame, err = readUvarint(frame)
+		if err != nil {
+			return err
+		}
+		size, frame, err = readUvarint(frame)
+		if err != nil {
+			return err
+		}
+		if size > uint64(len(frame)) {
+			return ErrMalformedUpdate
+		}
+		data := frame[:size]
+		frame = frame[size:]
+
+		switch tag {
+		case tagType:
+			typ, _, err := readUvarint(data)
+			if err != nil {
+				return err
+			}
+			upd.Type = UpdateType(typ)
+		case tagKeyString:
+			upd.Key = string(data)
+		case tagKeyMailbox:
+			accSize, rest, err := readUvarint(data)
+			if err != nil {
+				return err
+			}
+			if accSize > uint64(len(rest)) {
+				return ErrMalformedUpdate
+			}
+			upd.Key = MailboxKey{
+				Account:   string(rest[:accSize]),
+				MailboxID: string(rest[accSize:]),
+			}
+		case tagSeqSet:
+			seq := imap.SeqSet{}
+			for len(data) != 0 {
+				var start, stop uint64
+				start, data, err = readUvarint(data)
+				if err != nil {
+					return err
+				}
+				stop, data, err = readUvarint(data)
+				if err != nil {
+					return err
+				}
+				if start > math.MaxUint32 || stop > math.MaxUint32 {
+					return ErrMalformedUpdate
+				}
+				seq.Set = append(seq.Set, imap.Seq{Start: uint32(start), Stop: uint32(stop)})
+			}
+			upd.SeqSet = seq.String()
+			upd.decoded = &decodedSeqSet{str: upd.SeqSet, set: seq}
+		case tagFlag:
+			upd.NewFlags = append(upd.NewFlags, string(data))
+		case tagReason:
+			upd.Reason = string(data)
+		case tagTraceID:
+			upd.TraceID, _, err = readUvarint(data)
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+// jsonUpdate is the Update with the key in the form that can be restored
+// after deserialization.
+type jsonUpdate struct {
+	Update
+	Key json.RawMessage
+}
+
+func encodeJSONKey(key interface{}) (json.RawMessage, error) {
+	switch key.(type) {
+	case string, MailboxKey:
+		return json.Marshal(key)
+	}
+	return nil, ErrKeyType
+}
+
+func decodeJSONKey(raw json.RawMessage) (interface{}, error) {
+	if len(raw) != 0 && raw[0] == '{' {
+		var key MailboxKey
+		err := json.Unmarshal(raw, &key)
+		return key, err
+	}
+	var key string
+	err := json.Unmarshal(raw, &key)
+	return key, err
+}
+
+type jsonEncoder struct {
+	enc *json.Encoder
+}
+
+// NewJSONEncoder returns the Encoder that writes updates as JSON objects, one
+// per line.
+func NewJSONEncoder(w io.Writer) Encoder {
+	return jsonEncoder{enc: json.NewEncoder(w)}
+}
+
+func (e jsonEncoder) Encode(upd Update) error {
+	key, err := encodeJSONKey(upd.Key)
+	if err != nil {
+		return &UpdateError{Update: upd, Err: err}
+	}
+	return e.enc.Encode(jsonUpdate{Update: upd, Key: key})
+}
+
+type jsonDecoder struct {
+	dec *json.Decoder
+}
+
+// NewJSONDecoder returns the Decoder for updates written by NewJSONEncoder.
+func NewJSONDecoder(r io.Reader) Decoder {
+	return jsonDecoder{dec: json.NewDecoder(r)}
+}
+
+func (d jsonDecoder) Decode(upd *Update) error {
+	var jsonUpd jsonUpdate
+	if err := d.dec.Decode(&jsonUpd); err != nil {
+		return err
+	}
+	key, err := decodeJSONKey(jsonUpd.Key)
+	if err != nil {
+		return err
+	}
+	*upd = jsonUpd.Update
+	upd.Key = key
+	return nil
+}
@@ -0,0 +1,154 @@
+package mess
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"io/ioutil"
+	"reflect"
+	"testing"
+
+	"github.com/emersion/go-imap"
+	"github.com/emersion/go-imap/backend"
+)
+
+var codecTestUpdates = []Update{
+	{Type: UpdNewMessage, Key: "INBOX", SeqSet: "1:5,7"},
+	{Type: UpdFlags, Key: MailboxKey{Account: "u", MailboxID: "1"}, SeqSet: "42", NewFlags: []string{imap.SeenFlag, "$Label"}},
+	{Type: UpdRemoved, Key: MailboxKey{Account: "u", MailboxID: "1"}, SeqSet: "3:*", TraceID: 7},
+	{Type: UpdMboxDestroyed, Key: "Archive"},
+	{Type: UpdCloseSessions, Key: MailboxKey{Account: "u"}, Reason: "Account deleted"},
+	{Type: UpdKeywords, Key: "INBOX", NewFlags: []string{"$Label", "$Junk"}},
+}
+
+func testCodecRoundtrip(t *testing.T, enc Encoder, dec Decoder) {
+	for _, upd := range codecTestUpdates {
+		if err := enc.Encode(upd); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for _, expected := range codecTestUpdates {
+		var upd Update
+		if err := dec.Decode(&upd); err != nil {
+			t.Fatal(err)
+		}
+		if upd.decoded != nil {
+			if upd.decoded.set.String() != upd.SeqSet {
+				t.Errorf("Decoded set %v does not match SeqSet %v", &upd.decoded.set, upd.SeqSet)
+			}
+			upd.decoded = nil
+		}
+		if !reflect.DeepEqual(upd, expected) {
+			t.Errorf("Expected %+v, got %+v", expected, upd)
+		}
+	}
+
+	var upd Update
+	if err := dec.Decode(&upd); err != io.EOF {
+		t.Error("Expected io.EOF, got", err)
+	}
+}
+
+func TestCodecBinary(t *testing.T) {
+	var buf bytes.Buffer
+	testCodecRoundtrip(t, NewEncoder(&buf), NewDecoder(&buf))
+}
+
+func TestCodecJSON(t *testing.T) {
+	var buf bytes.Buffer
+	testCodecRoundtrip(t, NewJSONEncoder(&buf), NewJSONDecoder(&buf))
+}
+
+func TestCodecDecodedSeqSet(t *testing.T) {
+	var buf bytes.Buffer
+	NewEncoder(&buf).Encode(Update{Type: UpdRemoved, Key: "INBOX", SeqSet: "2"})
+	var upd Update
+	if err := NewDecoder(&buf).Decode(&upd); err != nil {
+		t.Fatal(err)
+	}
+
+	m := NewManager()
+	hndl, conn := openTestHandle(m, "INBOX", 1, 2, 3)
+	defer hndl.Close()
+
+	// Changed SeqSet takes precedence over the decoded one.
+	upd.SeqSet = "3"
+	if err := m.ExternalUpdate(upd); err != nil {
+		t.Fatal(err)
+	}
+	hndl.Sync(true)
+	upds := conn.take()
+	if len(upds) != 1 || upds[0].(*backend.ExpungeUpdate).SeqNum != 3 {
+		t.Fatal("Expected 3 EXPUNGE, got", upds)
+	}
+}
+
+func TestCodecUnsupportedKey(t *testing.T) {
+	for _, enc := range []Encoder{NewEncoder(ioutil.Discard), NewJSONEncoder(ioutil.Discard)} {
+		err := enc.Encode(Update{Type: UpdMboxDestroyed, Key: 42})
+		if !errors.Is(err, ErrKeyType) {
+			t.Error("Expected ErrKeyType, got", err)
+		}
+	}
+}
+
+func TestCodecCompat(t *testing.T) {
+	frame := []byte{codecVersion}
+	frame = appendUvarintField(frame, tagType, uint64(UpdRemoved))
+	frame = appendField(frame, 100, []byte("from the future"))
+	frame = appendField(frame, tagKeyString, []byte("INBOX"))
+	frame = appendField(frame, tagSeqSet, []byte{1, 1})
+
+	var upd Update
+	if err := decodeFrame(frame, &upd); err != nil {
+		t.Fatal(err)
+	}
+	if upd.Type != UpdRemoved || upd.Key != "INBOX" || upd.SeqSet != "1" {
+		t.Errorf("Wrong update: %+v", upd)
+	}
+
+	frame[0] = codecVersion + 1
+	if err := decodeFrame(frame, &upd); !errors.Is(err, ErrCodecVersion) {
+		t.Error("Expected ErrCodecVersion, got", err)
+	}
+
+	var buf bytes.Buffer
+	NewEncoder(&buf).Encode(codecTestUpdates[0])
+	truncated := buf.Bytes()[:buf.Len()-1]
+	if err := NewDecoder(bytes.NewReader(truncated)).Decode(&upd); err != io.ErrUnexpectedEOF {
+		t.Error("Expected io.ErrUnexpectedEOF, got", err)
+	}
+	if err := decodeFrame(truncated[1:], &upd); err != ErrMalformedUpdate {
+		t.Error("Expected ErrMalformedUpdate, got", err)
+	}
+}
+
+func TestCodecExternalUpdate(t *testing.T) {
+	var buf bytes.Buffer
+	enc := NewEncoder(&buf)
+	enc.Encode(Update{Type: UpdFlags, Key: "INBOX", SeqSet: "2", NewFlags: []string{imap.SeenFlag}})
+	enc.Encode(Update{Type: UpdRemoved, Key: "INBOX", SeqSet: "1"})
+
+	m := NewManager()
+	hndl, conn := openTestHandle(m, "INBOX", 1, 2)
+
+	dec := NewDecoder(&buf)
+	for i := 0; i < 2; i++ {
+		var upd Update
+		if err := dec.Decode(&upd); err != nil {
+			t.Fatal(err)
+		}
+		if err := m.ExternalUpdate(upd); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	hndl.Sync(true)
+	if upds := conn.take(); len(upds) != 2 {
+		t.Fatal("Expected FETCH and EXPUNGE, got", upds)
+	}
+	if hndl.MsgsCount() != 1 {
+		t.Error("Message is not expunged")
+	}
+}
@@ -0,0 +1,92 @@
+package mess
+
+import (
+	"errors"
+	"fmt"
+)
+
+var ErrUnsafeExpunge = errors.New("EXPUNGE responses are not allowed during a command using sequence numbers")
+
+// CommandKind is the type of the command executed by the connection. It
+// determines whether EXPUNGE responses can be sent (RFC 3501, Section 7.4.1).
+type CommandKind int
+
+const (
+	// CmdNone means no command is tracked. Sync sends EXPUNGE responses
+	// only if requested.
+	CmdNone CommandKind = iota
+
+	// CmdSeq is FETCH, STORE or SEARCH using sequence numbers. EXPUNGE
+	// responses are never sent during such commands.
+	CmdSeq
+
+	// CmdUid is an UID command or another command that does not depend on
+	// sequence numbers, e.g. COPY, EXPUNGE or APPEND.
+	CmdUid
+
+	// CmdIdle is IDLE. It is set by MailboxHandle.Idle.
+	CmdIdle
+)
+
+// CommandFor returns CmdUid if uid is set and CmdSeq otherwise.
+func CommandFor(uid bool) CommandKind {
+	if uid {
+		return CmdUid
+	}
+	return CmdSeq
+}
+
+func (kind CommandKind) String() string {
+	switch kind {
+	case CmdNone:
+		return "none"
+	case CmdSeq:
+		return "seq"
+	case CmdUid:
+		return "uid"
+	case CmdIdle:
+		return "idle"
+	}
+	return fmt.Sprintf("CommandKind(%d)", int(kind))
+}
+
+// BeginCommand marks the start of the command of the specified kind.
+//
+// While the command is in progress, Sync(true) is downgraded to Sync(false)
+// if EXPUNGE responses are not allowed and the error wrapping
+// ErrUnsafeExpunge is reported via Manager.ErrorHook.
+func (handle *MailboxHandle) BeginCommand(kind CommandKind) {
+	handle.touch()
+
+	handle.lock.Lock()
+	defer handle.lock.Unlock()
+	handle.command = kind
+}
+
+// EndCommand marks the end of the command started by BeginCommand and sends
+// all pending updates, including EXPUNGE responses if they are allowed for
+// the command.
+func (handle *MailboxHandle) EndCommand() {
+	handle.touch()
+
+	handle.lock.Lock()
+	kind := handle.command
+	handle.command = CmdNone
+	if handle.conn == nil {
+		handle.lock.Unlock()
+		return
+	}
+	if handle.closed {
+		handle.flushBye(kind != CmdSeq)
+		return
+	}
+	handle.syncUnlocked(kind != CmdSeq)
+	handle.lock.Unlock()
+}
+
+// Command returns the kind of the command in progress.
+func (handle *MailboxHandle) Command() CommandKind {
+	handle.lock.RLock()
+	defer handle.lock.RUnlock()
+	return handle.command
+}
@@ -0,0 +1,107 @@
+package mess
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/emersion/go-imap/backend"
+)
+
+func TestCommandUnsafeExpunge(t *testing.T) {
+	m := NewManager()
+	var reported []error
+	m.ErrorHook = func(err error) {
+		reported = append(reported, err)
+	}
+
+	hndl, conn := openTestHandle(m, "INBOX", 1, 2, 3)
+	other, _ := openTestHandle(m, "INBOX", 1, 2, 3)
+	defer hndl.Close()
+	defer other.Close()
+	other.Removed(2)
+
+	hndl.BeginCommand(CmdSeq)
+	if hndl.Command() != CmdSeq {
+		t.Fatal("Command kind not set")
+	}
+	hndl.Sync(true)
+	if upds := conn.take(); len(upds) != 0 {
+		t.Fatal("Unexpected updates during FETCH:", upds)
+	}
+	if len(reported) != 1 || !errors.Is(reported[0], ErrUnsafeExpunge) {
+		t.Fatal("Expected ErrUnsafeExpunge to be reported, got", reported)
+	}
+	hndl.EndCommand()
+	if upds := conn.take(); len(upds) != 0 {
+		t.Fatal("Unexpected updates after FETCH:", upds)
+	}
+	if hndl.Command() != CmdNone {
+		t.Fatal("Command kind not reset")
+	}
+
+	hndl.BeginCommand(CmdUid)
+	hndl.EndCommand()
+	upds := conn.take()
+	if len(upds) != 1 || upds[0].(*backend.ExpungeUpdate).SeqNum != 2 {
+		t.Fatal("Expected 2 EXPUNGE after UID command, got", upds)
+	}
+	if len(reported) != 1 {
+		t.Fatal("Unexpected errors:", reported[1:])
+	}
+}
+
+func TestCommandNone(t *testing.T) {
+	m := NewManager()
+	m.ErrorHook = func(err error) {
+		t.Error("Unexpected error:", err)
+	}
+
+	hndl, conn := openTestHandle(m, "INBOX", 1, 2)
+	other, _ := openTestHandle(m, "INBOX", 1, 2)
+	defer hndl.Close()
+	defer other.Close()
+	other.Removed(1)
+
+	// Untracked connections are trusted to pass the correct value.
+	hndl.Sync(true)
+	if upds := conn.take(); len(upds) != 1 {
+		t.Fatal("Expected EXPUNGE, got", upds)
+	}
+}
+
+func TestCommandIdle(t *testing.T) {
+	m := NewManager()
+	hndl, conn := openTestHandle(m, "INBOX", 1, 2)
+	defer hndl.Close()
+
+	done := make(chan struct{})
+	idleDone := make(chan struct{})
+	go func() {
+		hndl.Idle(done)
+		close(idleDone)
+	}()
+
+	for hndl.Command() != CmdIdle {
+		time.Sleep(time.Millisecond)
+	}
+	hndl.Removed(1)
+	for {
+		conn.lock.Lock()
+		n := len(conn.updates)
+		conn.lock.Unlock()
+		if n != 0 {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+	close(done)
+	<-idleDone
+
+	if hndl.Command() != CmdNone {
+		t.Fatal("Command kind not reset after IDLE")
+	}
+	if upds := conn.take(); len(upds) != 1 {
+		t.Fatal("Expected EXPUNGE during IDLE, got", upds)
+	}
+}
@@ -0,0 +1,38 @@
+package mess
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/emersion/go-imap/backend"
+)
+
+var ErrUnknownUpdateType = errors.New("Unknown update type")
+
+// UpdateError is returned by ExternalUpdate for updates that cannot be
+// dispatched.
+type UpdateError struct {
+	Update Update
+	Err    error
+}
+
+func (err *UpdateError) Error() string {
+	return fmt.Sprintf("Update %d for %v discarded: %v", err.Update.Type, err.Update.Key, err.Err)
+}
+
+func (err *UpdateError) Unwrap() error {
+	return err.Err
+}
+
+func (m *Manager) reportError(err error) {
+	if m.ErrorHook != nil {
+		m.ErrorHook(err)
+	}
+}
+
+// send sends the update to the connection reporting errors via ErrorHook.
+func (handle *MailboxHandle) send(upd backend.Update) {
+	if err := handle.conn.SendUpdate(upd); err != nil {
+		handle.m.reportError(fmt.Errorf("Failed to send update for %v: %w", handle.key, err))
+	}
+}
@@ -0,0 +1,40 @@
+package mess
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestExternalUpdateErrors(t *testing.T) {
+	m := NewManager()
+
+	var reported []error
+	m.ErrorHook = func(err error) {
+		reported = append(reported, err)
+	}
+
+	test := func(upd Update, expected error) {
+		t.Helper()
+
+		err := m.ExternalUpdate(upd)
+		var updErr *UpdateError
+		if !errors.As(err, &updErr) {
+			t.Fatalf("%+v: expected *UpdateError, got %v", upd, err)
+		}
+		if expected != nil && !errors.Is(err, expected) {
+			t.Fatalf("%+v: expected %v, got %v", upd, expected, err)
+		}
+		if len(reported) == 0 || reported[len(reported)-1] != err {
+			t.Fatalf("%+v: error not reported via ErrorHook", upd)
+		}
+	}
+
+	test(Update{Type: UpdNewMessage, Key: "INBOX", SeqSet: "a:b"}, nil)
+	test(Update{Type: UpdFlags, Key: "INBOX", SeqSet: "1:2"}, nil)
+	test(Update{Type: UpdRemoved, Key: "INBOX", SeqSet: ""}, nil)
+	test(Update{Type: UpdateType(100), Key: "INBOX"}, ErrUnknownUpdateType)
+
+	if err := m.ExternalUpdate(Update{Type: UpdNewMessage, Key: "INBOX", SeqSet: "1"}); err != nil {
+		t.Fatal("Unexpected error:", err)
+	}
+}
@@ -0,0 +1,108 @@
+package mess
+
+import "github.com/emersion/go-imap"
+
+// DefaultFlagsCacheSize is the number of messages per handle for which the
+// last reported flags are remembered if Manager.FlagsCacheSize is not set.
+const DefaultFlagsCacheSize = 1024
+
+func (m *Manager) flagsCacheSize() int {
+	if m.FlagsCacheSize == 0 {
+		return DefaultFlagsCacheSize
+	}
+	return m.FlagsCacheSize
+}
+
+func countFlag(flags []string, flag string) int {
+	count := 0
+	for _, f := range flags {
+		if f == flag {
+			count++
+		}
+	}
+	return count
+}
+
+// sameFlags reports whether a and b contain the same flags in any order.
+// \Recent is ignored since it does not change during the session.
+func sameFlags(a, b []string) bool {
+	if len(a)-countFlag(a, imap.RecentFlag) != len(b)-countFlag(b, imap.RecentFlag) {
+		return false
+	}
+	for _, f := range a {
+		if f != imap.RecentFlag && countFlag(a, f) != countFlag(b, f) {
+			return false
+		}
+	}
+	return true
+}
+
+// rememberFlags records flags as known to the client. An arbitrary entry is
+// evicted if the cache is full, this only results in a redundant FETCH later.
+//
+// handle.lock should be held.
+func (handle *MailboxHandle) rememberFlags(uid uint32, flags []string) {
+	size := handle.m.flagsCacheSize()
+	if size < 0 {
+		return
+	}
+	if handle.sentFlags == nil {
+		handle.sentFlags = make(map[uint32][]string)
+	}
+	if _, ok := handle.sentFlags[uid]; !ok && len(handle.sentFlags) >= size {
+		for evict := range handle.sentFlags {
+			delete(handle.sentFlags, evict)
+			break
+		}
+	}
+	handle.sentFlags[uid] = flags
+}
+
+// flagsKnown indicates whether flags were the last ones reported to the
+// client for the message.
+//
+// handle.lock should be held.
+func (handle *MailboxHandle) flagsKnown(uid uint32, flags []string) bool {
+	known, ok := handle.sentFlags[uid]
+	return ok && sameFlags(known, flags)
+}
+
+// FlagsSeen should be called for each FETCH response with FLAGS sent by the
+// backend so the handle does not send the same flags again in an untagged
+// FETCH. \Recent in flags is ignored.
+//
+// Calling it is not required, but without it a change reverted before the
+// Sync may be missed by the client that fetched the intermediate flags.
+func (handle *MailboxHandle) FlagsSeen(uid uint32, flags []string) {
+	if handle.conn == nil {
+		return
+	}
+
+	flagsCopy := make([]string, 0, len(flags))
+	for _, f := range flags {
+		if f != imap.RecentFlag {
+			flagsCopy = append(flagsCopy, f)
+		}
+	}
+
+	handle.lock.Lock()
+	defer handle.lock.Unlock()
+	if handle.m.tracing() {
+		handle.m.trace(TraceEvent{
+			Kind:   TraceFlagsSeen,
+			Key:    handle.key,
+			Handle: handle.id,
+			UIDs:   []uint32{uid},
+			Flags:  flagsCopy,
+		})
+	}
+	handle.rememberFlags(uid, flagsCopy)
+}
+
+// forgetFlags removes the message from the cache, e.g. after .SILENT STORE
+// the client was not notified about.
+func (handle *MailboxHandle) forgetFlags(uid uint32) {
+	handle.lock.Lock()
+	defer handle.lock.Unlock()
+	delete(handle.sentFlags, uid)
+}
@@ -0,0 +1,192 @@
+package mess
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/emersion/go-imap"
+	"github.com/emersion/go-imap/backend"
+)
+
+func TestFlagsCacheRedundant(t *testing.T) {
+	m := NewManager()
+	hndl, _ := openTestHandle(m, "INBOX", 1, 2)
+	other, conn := openTestHandle(m, "INBOX", 1, 2)
+	defer hndl.Close()
+	defer other.Close()
+
+	hndl.FlagsChanged(1, []string{imap.SeenFlag, imap.FlaggedFlag}, false)
+	other.Sync(true)
+	if upds := conn.take(); len(upds) != 1 {
+		t.Fatal("Expected FETCH, got", upds)
+	}
+
+	// Same flags in different order.
+	hndl.FlagsChanged(1, []string{imap.FlaggedFlag, imap.SeenFlag}, false)
+	other.Sync(true)
+	if upds := conn.take(); len(upds) != 0 {
+		t.Fatal("Redundant FETCH sent:", upds)
+	}
+
+	// Changes reverted before Sync are not visible to the client.
+	hndl.FlagsChanged(1, nil, false)
+	hndl.FlagsChanged(1, []string{imap.SeenFlag, imap.FlaggedFlag}, false)
+	other.Sync(true)
+	if upds := conn.take(); len(upds) != 0 {
+		t.Fatal("Redundant FETCH sent:", upds)
+	}
+
+	hndl.FlagsChanged(1, nil, false)
+	other.Sync(true)
+	upds := conn.take()
+	if len(upds) != 1 || len(upds[0].(*backend.MessageUpdate).Flags) != 0 {
+		t.Fatal("Expected FETCH with empty flags, got", upds)
+	}
+}
+
+func TestFlagsCoalesced(t *testing.T) {
+	m := NewManager()
+	hndl, _ := openTestHandle(m, "INBOX", 1)
+	other, conn := openTestHandle(m, "INBOX", 1)
+	defer hndl.Close()
+	defer other.Close()
+
+	hndl.FlagsChanged(1, []string{imap.SeenFlag}, false)
+	hndl.FlagsChanged(1, []string{imap.FlaggedFlag}, false)
+	other.Sync(true)
+	upds := conn.take()
+	if len(upds) != 1 || !reflect.DeepEqual(upds[0].(*backend.MessageUpdate).Flags, []string{imap.FlaggedFlag}) {
+		t.Fatal("Expected single FETCH with the last flags, got", upds)
+	}
+}
+
+func TestFlagsCacheSilent(t *testing.T) {
+	m := NewManager()
+	hndl, conn := openTestHandle(m, "INBOX", 1)
+	other, _ := openTestHandle(m, "INBOX", 1)
+	defer hndl.Close()
+	defer other.Close()
+
+	hndl.FlagsChanged(1, []string{imap.SeenFlag}, false)
+	hndl.Sync(true)
+	conn.take()
+
+	// The client does not know the result of .SILENT STORE, so the flags it
+	// saw before are not trusted anymore.
+	hndl.FlagsChanged(1, []string{imap.FlaggedFlag}, true)
+	other.FlagsChanged(1, []string{imap.SeenFlag}, false)
+	hndl.Sync(true)
+	if upds := conn.take(); len(upds) != 1 {
+		t.Fatal("Expected FETCH, got", upds)
+	}
+}
+
+func TestFlagsCacheSeen(t *testing.T) {
+	m := NewManager()
+	hndl, _ := openTestHandle(m, "INBOX", 1)
+	other, conn := openTestHandle(m, "INBOX", 1)
+	defer hndl.Close()
+	defer other.Close()
+
+	other.FlagsSeen(1, []string{imap.SeenFlag})
+	hndl.FlagsChanged(1, []string{imap.SeenFlag}, false)
+	other.Sync(true)
+	if upds := conn.take(); len(upds) != 0 {
+		t.Fatal("FETCH sent for flags reported by the backend:", upds)
+	}
+}
+
+func TestFlagsCacheSize(t *testing.T) {
+	m := NewManager()
+	m.FlagsCacheSize = 1
+	hndl, _ := openTestHandle(m, "INBOX", 1, 2)
+	other, conn := openTestHandle(m, "INBOX", 1, 2)
+	defer hndl.Close()
+	defer other.Close()
+
+	hndl.FlagsChanged(1, []string{imap.SeenFlag}, false)
+	hndl.FlagsChanged(2, []string{imap.SeenFlag}, false)
+	other.Sync(true)
+	conn.take()
+
+	other.lock.RLock()
+	size := len(other.sentFlags)
+	other.lock.RUnlock()
+	if size != 1 {
+		t.Fatal("Cache size is not limited:", size)
+	}
+
+	hndl.FlagsChanged(2, []string{imap.SeenFlag}, false)
+	other.Sync(true)
+	if upds := conn.take(); len(upds) != 0 {
+		t.Fatal("Redundant FETCH sent:", upds)
+	}
+	hndl.FlagsChanged(1, []string{imap.SeenFlag}, false)
+	other.Sync(true)
+	if upds := conn.take(); len(upds) != 1 {
+		t.Fatal("Expected FETCH for the evicted message, got", upds)
+	}
+
+}
+
+func TestFlagsCacheDisabled(t *testing.T) {
+	m := NewManager()
+	m.FlagsCacheSize = -1
+	hndl, _ := openTestHandle(m, "INBOX", 1)
+	other, conn := openTestHandle(m, "INBOX", 1)
+	defer hndl.Close()
+	defer other.Close()
+
+	for i := 0; i < 2; i++ {
+		hndl.FlagsChanged(1, []string{imap.SeenFlag}, false)
+		other.Sync(true)
+		if upds := conn.take(); len(upds) != 1 {
+			t.Fatal("Expected FETCH with disabled cache, got", upds)
+		}
+	}
+}
+
+func TestSameFlags(t *testing.T) {
+	test := func(a, b []string, expected bool) {
+		t.Helper()
+		if sameFlags(a, b) != expected || sameFlags(b, a) != expected {
+			t.Errorf("sameFlags(%v, %v) != %v", a, b, expected)
+		}
+	}
+
+	test(nil, []string{}, true)
+	test([]string{"A", "B"}, []string{"B", "A"}, true)
+	test([]string{"A", "A"}, []string{"A", "B"}, false)
+	test([]string{"A", "B"}, []string{"A", "B", "C"}, false)
+	test([]string{"A", imap.RecentFlag}, []string{"A"}, true)
+	test([]string{imap.RecentFlag}, []string{"A"}, false)
+}
+
+func TestFlagsCacheSeenRecent(t *testing.T) {
+	m := NewManager()
+	hndl, conn := openTestHandle(m, "INBOX")
+	other, _ := openTestHandle(m, "INBOX")
+	defer hndl.Close()
+	defer other.Close()
+
+	m.NewMessage("INBOX", 1)
+	hndl.Sync(true)
+	conn.take()
+	if !hndl.IsRecent(1) {
+		t.Fatal("Message is not \\Recent for the first session")
+	}
+
+	hndl.FlagsSeen(1, []string{imap.SeenFlag, imap.RecentFlag})
+	hndl.lock.RLock()
+	seen := hndl.sentFlags[1]
+	hndl.lock.RUnlock()
+	if !reflect.DeepEqual(seen, []string{imap.SeenFlag}) {
+		t.Fatal("\\Recent is remembered:", seen)
+	}
+
+	other.FlagsChanged(1, []string{imap.SeenFlag}, false)
+	hndl.Sync(true)
+	if upds := conn.take(); len(upds) != 0 {
+		t.Fatal("Redundant FETCH sent:", upds)
+	}
+}
@@ -0,0 +1,49 @@
+package mess
+
+import (
+	"sync"
+
+	"github.com/emersion/go-imap"
+	"github.com/emersion/go-imap/backend"
+)
+
+type testConn struct {
+	lock    sync.Mutex
+	updates []backend.Update
+}
+
+func (c *testConn) SendUpdate(upd backend.Update) error {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.updates = append(c.updates, upd)
+	return nil
+}
+
+func (c *testConn) take() []backend.Update {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	upds := c.updates
+	c.updates = nil
+	return upds
+}
+
+type testMailbox struct {
+	backend.Mailbox
+	conn *testConn
+}
+
+func (mbox testMailbox) Conn() backend.Conn {
+	if mbox.conn == nil {
+		return nil
+	}
+	return mbox.conn
+}
+
+func openTestHandle(m *Manager, key interface{}, uids ...uint32) (*MailboxHandle, *testConn) {
+	conn := &testConn{}
+	handle, err := m.Mailbox(key, testMailbox{conn: conn}, uids, &imap.SeqSet{})
+	if err != nil {
+		panic(err)
+	}
+	return handle, conn
+}
@@ -0,0 +1,417 @@
+package mess
+
+import (
+	"errors"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/emersion/go-imap"
+)
+
+var (
+	ErrCannotCalculateChanges = errors.New("Cannot calculate changes")
+	ErrDynamicSet             = errors.New("Set of changed messages contains *")
+)
+
+// EmailID identifies a message within JMAP account.
+type EmailID struct {
+	Mailbox interface{}
+	UID     uint32
+}
+
+// EmailChanges is the result of JMAPState.EmailChanges, it has the same
+// meaning as Email/changes response fields.
+type EmailChanges struct {
+	OldState       string
+	NewState       string
+	HasMoreChanges bool
+	Created        []EmailID
+	Updated        []EmailID
+	Destroyed      []EmailID
+}
+
+// MailboxChanges is the result of JMAPState.MailboxChanges, it has the same
+// meaning as Mailbox/changes response fields.
+//
+// Mailboxes are identified by keys passed to Manager.
+type MailboxChanges struct {
+	OldState       string
+	NewState       string
+	HasMoreChanges bool
+	Created        []interface{}
+	Updated        []interface{}
+	Destroyed      []interface{}
+}
+
+type changeKind int
+
+const (
+	changeCreated changeKind = iota
+	changeUpdated
+	changeDestroyed
+)
+
+type changeEntry struct {
+	state uint64
+	id    interface{}
+	kind  changeKind
+}
+
+type changeLog struct {
+	state uint64
+	// oldest is the lowest state changes can be calculated from.
+	oldest  uint64
+	entries []changeEntry
+}
+
+func (l *changeLog) bump() {
+	l.state++
+}
+
+func (l *changeLog) add(id interface{}, kind changeKind) {
+	l.entries = append(l.entries, changeEntry{state: l.state, id: id, kind: kind})
+}
+
+// trim drops the oldest changes so at most limit entries are left.
+func (l *changeLog) trim(limit int) {
+	if limit < 0 {
+		limit = 0
+	}
+	if len(l.entries) <= limit {
+		return
+	}
+
+	// Drop whole states so we never return a partial set of changes for one.
+	drop := len(l.entries) - limit
+	dropState := l.entries[drop-1].state
+	for drop < len(l.entries) && l.entries[drop].state == dropState {
+		drop++
+	}
+	l.entries = append(l.entries[:0], l.entries[drop:]...)
+	l.oldest = dropState
+}
+
+// truncate makes all changes before the current state uncalculable.
+func (l *changeLog) truncate() {
+	l.entries = l.entries[:0]
+	l.oldest = l.state
+}
+
+func (l *changeLog) changes(since uint64, max int) (created, updated, destroyed []interface{}, newState uint64, more bool, err error) {
+	if since < l.oldest || since > l.state {
+		return nil, nil, nil, 0, false, ErrCannotCalculateChanges
+	}
+
+	newState = since
+	kinds := make(map[interface{}]changeKind)
+	order := make([]interface{}, 0, 16)
+	for i := 0; i < len(l.entries); i++ {
+		ent := l.entries[i]
+		if ent.state <= since {
+			continue
+		}
+
+		// Take all entries for the state at once.
+		j := i
+		for j < len(l.entries) && l.entries[j].state == ent.state {
+			j++
+		}
+		if max > 0 && len(kinds)+(j-i) > max {
+			if newState == since {
+				// Changes for one state are never split and the client
+				// cannot be moved to an intermediate state.
+				return nil, nil, nil, 0, false, ErrCannotCalculateChanges
+			}
+			more = true
+			break
+		}
+		for _, ent := range l.entries[i:j] {
+			prev, ok := kinds[ent.id]
+			if !ok {
+				kinds[ent.id] = ent.kind
+				order = append(order, ent.id)
+				continue
+			}
+			switch {
+			case prev == changeCreated && ent.kind == changeDestroyed:
+				delete(kinds, ent.id)
+			case prev == changeCreated:
+			default:
+				kinds[ent.id] = ent.kind
+			}
+		}
+		newState = ent.state
+		i = j - 1
+	}
+	if !more {
+		newState = l.state
+	}
+
+	for _, id := range order {
+		kind, ok := kinds[id]
+		if !ok {
+			continue
+		}
+		switch kind {
+		case changeCreated:
+			created = append(created, id)
+		case changeUpdated:
+			updated = append(updated, id)
+		case changeDestroyed:
+			destroyed = append(destroyed, id)
+		}
+	}
+
+	return created, updated, destroyed, newState, more, nil
+}
+
+type jmapAccount struct {
+	email   changeLog
+	mailbox changeLog
+}
+
+// JMAPState maintains JMAP state strings and change logs for Email and Mailbox
+// data types derived from the Update stream.
+//
+// It should be fed all updates generated by the Manager (see
+// SetExternalSink) and all updates received from other nodes (see
+// ExternalUpdate).
+//
+// State strings include an epoch so states issued by another JMAPState
+// object (e.g. before restart) are never misinterpreted.
+type JMAPState struct {
+	// Account maps the mailbox key into the JMAP account ID.
+	Account func(key interface{}) string
+
+	// LogSize is the maximum amount of changes remembered per account and
+	// data type. Clients asking for older states receive
+	// ErrCannotCalculateChanges. Zero or negative value disables the log.
+	LogSize int
+
+	// Epoch is included in all state strings. NewJMAPState sets it to
+	// the creation time, so states issued by other objects (e.g. before
+	// restart) are not accepted.
+	//
+	// Nodes that apply the same updates in the same order (e.g. read from
+	// a shared log) may set it to the same value so a client can continue
+	// with another node. It should not be changed after the first Apply.
+	Epoch string
+
+	// ErrorHook, if set, is called by Consume for updates that cannot be
+	// applied.
+	ErrorHook func(err error)
+
+	lock     sync.Mutex
+	accounts map[string]*jmapAccount
+}
+
+func NewJMAPState(account func(key interface{}) string) *JMAPState {
+	return &JMAPState{
+		Account:  account,
+		LogSize:  10000,
+		Epoch:    strconv.FormatInt(time.Now().UnixNano(), 36),
+		accounts: make(map[string]*jmapAccount),
+	}
+}
+
+func (s *JMAPState) account(key interface{}) *jmapAccount {
+	id := s.Account(key)
+	acc := s.accounts[id]
+	if acc == nil {
+		acc = &jmapAccount{}
+		s.accounts[id] = acc
+	}
+	return acc
+}
+
+// Apply updates the state according to the passed update.
+//
+// If the changed messages cannot be determined from the update, Email
+// changes since earlier states cannot be calculated anymore and
+// *UpdateError is returned.
+func (s *JMAPState) Apply(upd Update) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	acc := s.account(upd.Key)
+
+	emailChange := func(kind changeKind) error {
+		set, err := imap.ParseSeqSet(upd.SeqSet)
+		if err == nil && set.Dynamic() {
+			err = ErrDynamicSet
+		}
+
+		acc.email.bump()
+		switch {
+		case err != nil:
+			// The change is lost, clients have to resynchronize.
+			acc.email.truncate()
+		case seqSetCount(set) > s.LogSize:
+			// The change would not fit into the log anyway.
+			acc.email.truncate()
+		default:
+			for _, seq := range set.Set {
+				for uid := seq.Start; uid <= seq.Stop && uid != 0; uid++ {
+					acc.email.add(EmailID{Mailbox: upd.Key, UID: uid}, kind)
+				}
+			}
+			acc.email.trim(s.LogSize)
+		}
+
+		// Counters (totalEmails, unreadEmails, etc) change
+		// together with messages.
+		acc.mailbox.bump()
+		acc.mailbox.add(upd.Key, changeUpdated)
+		acc.mailbox.trim(s.LogSize)
+
+		if err != nil {
+			return &UpdateError{Update: upd, Err: err}
+		}
+		return nil
+	}
+
+	switch upd.Type {
+	case UpdNewMessage:
+		return emailChange(changeCreated)
+	case UpdFlags:
+		return emailChange(changeUpdated)
+	case UpdRemoved:
+		return emailChange(changeDestroyed)
+	case UpdMboxDestroyed:
+		acc.mailbox.bump()
+		acc.mailbox.add(upd.Key, changeDestroyed)
+		acc.mailbox.trim(s.LogSize)
+
+		// We do not know which messages were in the mailbox
+		// so clients have to resynchronize.
+		acc.email.bump()
+		acc.email.truncate()
+	}
+	return nil
+}
+
+// Consume calls Apply for all updates received from the channel until it is
+// closed. Errors are reported via ErrorHook.
+func (s *JMAPState) Consume(upds <-chan Update) {
+	for upd := range upds {
+		if err := s.Apply(upd); err != nil && s.ErrorHook != nil {
+			s.ErrorHook(err)
+		}
+	}
+}
+
+func (s *JMAPState) formatState(state uint64) string {
+	return s.Epoch + "-" + strconv.FormatUint(state, 10)
+}
+
+func (s *JMAPState) parseState(state string) (uint64, error) {
+	// Epoch may contain '-' too.
+	sep := strings.LastIndexByte(state, '-')
+	if sep == -1 || state[:sep] != s.Epoch {
+		return 0, ErrCannotCalculateChanges
+	}
+	val, err := strconv.ParseUint(state[sep+1:], 10, 64)
+	if err != nil {
+		return 0, ErrCannotCalculateChanges
+	}
+	return val, nil
+}
+
+// EmailState returns the current Email state string for the account.
+func (s *JMAPState) EmailState(account string) string {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	acc := s.accounts[account]
+	if acc == nil {
+		return s.formatState(0)
+	}
+	return s.formatState(acc.email.state)
+}
+
+// MailboxState returns the current Mailbox state string for the account.
+func (s *JMAPState) MailboxState(account string) string {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	acc := s.accounts[account]
+	if acc == nil {
+		return s.formatState(0)
+	}
+	return s.formatState(acc.mailbox.state)
+}
+
+// EmailChanges returns Email changes since the specified state.
+//
+// maxChanges limits the amount of returned IDs, if it is zero - all
+// changes are returned. ErrCannotCalculateChanges is returned if
+// the state is unknown or too old.
+func (s *JMAPState) EmailChanges(account, sinceState string, maxChanges int) (*EmailChanges, error) {
+	since, err := s.parseState(sinceState)
+	if err != nil {
+		return nil, err
+	}
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	acc := s.accounts[account]
+	if acc == nil {
+		acc = &jmapAccount{}
+	}
+
+	created, updated, destroyed, newState, more, err := acc.email.changes(since, maxChanges)
+	if err != nil {
+		return nil, err
+	}
+
+	res := &EmailChanges{
+		OldState:       sinceState,
+		NewState:       s.formatState(newState),
+		HasMoreChanges: more,
+	}
+	for _, id := range created {
+		res.Created = append(res.Created, id.(EmailID))
+	}
+	for _, id := range updated {
+		res.Updated = append(res.Updated, id.(EmailID))
+	}
+	for _, id := range destroyed {
+		res.Destroyed = append(res.Destroyed, id.(EmailID))
+	}
+	return res, nil
+}
+
+// MailboxChanges returns Mailbox changes since the specified state.
+//
+// See EmailChanges for the meaning of arguments.
+func (s *JMAPState) MailboxChanges(account, sinceState string, maxChanges int) (*MailboxChanges, error) {
+	since, err := s.parseState(sinceState)
+	if err != nil {
+		return nil, err
+	}
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	acc := s.accounts[account]
+	if acc == nil {
+		acc = &jmapAccount{}
+	}
+
+	created, updated, destroyed, newState, more, err := acc.mailbox.changes(since, maxChanges)
+	if err != nil {
+		return nil, err
+	}
+
+	return &MailboxChanges{
+		OldState:       sinceState,
+		NewState:       s.formatState(newState),
+		HasMoreChanges: more,
+		Created:        created,
+		Updated:        updated,
+		Destroyed:      destroyed,
+	}, nil
+}
@@ -0,0 +1,189 @@
+package mess
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestJMAPStateChanges(t *testing.T) {
+	s := NewJMAPState(func(key interface{}) string { return "acc" })
+
+	initial := s.EmailState("acc")
+	initialMbox := s.MailboxState("acc")
+
+	s.Apply(Update{Type: UpdNewMessage, Key: "INBOX", SeqSet: "1:3"})
+	s.Apply(Update{Type: UpdFlags, Key: "INBOX", SeqSet: "2"})
+	s.Apply(Update{Type: UpdRemoved, Key: "INBOX", SeqSet: "3"})
+
+	changes, err := s.EmailChanges("acc", initial, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(changes.Created) != 2 || len(changes.Updated) != 0 || len(changes.Destroyed) != 0 {
+		t.Fatalf("unexpected changes: %+v", changes)
+	}
+	if changes.NewState != s.EmailState("acc") {
+		t.Fatalf("wrong new state: %v != %v", changes.NewState, s.EmailState("acc"))
+	}
+
+	mboxChanges, err := s.MailboxChanges("acc", initialMbox, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(mboxChanges.Updated) != 1 || mboxChanges.Updated[0] != "INBOX" {
+		t.Fatalf("unexpected mailbox changes: %+v", mboxChanges)
+	}
+
+	afterNew := s.EmailState("acc")
+	s.Apply(Update{Type: UpdFlags, Key: "INBOX", SeqSet: "1"})
+	s.Apply(Update{Type: UpdRemoved, Key: "INBOX", SeqSet: "2"})
+
+	changes, err = s.EmailChanges("acc", afterNew, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !changes.HasMoreChanges || len(changes.Updated) != 1 || changes.Updated[0].UID != 1 {
+		t.Fatalf("unexpected changes: %+v", changes)
+	}
+	changes, err = s.EmailChanges("acc", changes.NewState, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if changes.HasMoreChanges || len(changes.Destroyed) != 1 || changes.Destroyed[0].UID != 2 {
+		t.Fatalf("unexpected changes: %+v", changes)
+	}
+}
+
+func TestJMAPStateCannotCalculate(t *testing.T) {
+	s := NewJMAPState(func(key interface{}) string { return "acc" })
+	s.LogSize = 2
+
+	initial := s.EmailState("acc")
+	s.Apply(Update{Type: UpdNewMessage, Key: "INBOX", SeqSet: "1"})
+	s.Apply(Update{Type: UpdNewMessage, Key: "INBOX", SeqSet: "2"})
+	s.Apply(Update{Type: UpdNewMessage, Key: "INBOX", SeqSet: "3"})
+
+	if _, err := s.EmailChanges("acc", initial, 0); err != ErrCannotCalculateChanges {
+		t.Fatal("expected ErrCannotCalculateChanges, got", err)
+	}
+	if _, err := s.EmailChanges("acc", "bogus-1", 0); err != ErrCannotCalculateChanges {
+		t.Fatal("expected ErrCannotCalculateChanges, got", err)
+	}
+
+	current := s.EmailState("acc")
+	s.Apply(Update{Type: UpdMboxDestroyed, Key: "INBOX"})
+	if _, err := s.EmailChanges("acc", current, 0); err != ErrCannotCalculateChanges {
+		t.Fatal("expected ErrCannotCalculateChanges, got", err)
+	}
+	if _, err := s.EmailChanges("acc", s.EmailState("acc"), 0); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestJMAPStateMaxChanges(t *testing.T) {
+	s := NewJMAPState(func(key interface{}) string { return "acc" })
+
+	initial := s.EmailState("acc")
+	s.Apply(Update{Type: UpdNewMessage, Key: "INBOX", SeqSet: "1:3"})
+
+	// Changes for a single state are never split.
+	if _, err := s.EmailChanges("acc", initial, 2); err != ErrCannotCalculateChanges {
+		t.Fatal("expected ErrCannotCalculateChanges, got", err)
+	}
+	changes, err := s.EmailChanges("acc", initial, 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(changes.Created) != 3 {
+		t.Fatalf("unexpected changes: %+v", changes)
+	}
+}
+
+func TestJMAPStateLogSize(t *testing.T) {
+	s := NewJMAPState(func(key interface{}) string { return "acc" })
+	s.LogSize = -1
+
+	initial := s.EmailState("acc")
+	s.Apply(Update{Type: UpdNewMessage, Key: "INBOX", SeqSet: "1"})
+	if _, err := s.EmailChanges("acc", initial, 0); err != ErrCannotCalculateChanges {
+		t.Fatal("expected ErrCannotCalculateChanges, got", err)
+	}
+}
+
+func TestJMAPStateLargeUpdate(t *testing.T) {
+	s := NewJMAPState(func(key interface{}) string { return "acc" })
+	s.LogSize = 100
+
+	initial := s.EmailState("acc")
+	s.Apply(Update{Type: UpdNewMessage, Key: "INBOX", SeqSet: "1:50"})
+	afterNew := s.EmailState("acc")
+	s.Apply(Update{Type: UpdRemoved, Key: "INBOX", SeqSet: "1:4000000000"})
+
+	if _, err := s.EmailChanges("acc", afterNew, 0); err != ErrCannotCalculateChanges {
+		t.Fatal("expected ErrCannotCalculateChanges, got", err)
+	}
+	if _, err := s.EmailChanges("acc", s.EmailState("acc"), 0); err != nil {
+		t.Fatal(err)
+	}
+
+	// Older states are dropped once per update.
+	s.Apply(Update{Type: UpdNewMessage, Key: "INBOX", SeqSet: "1:60"})
+	s.Apply(Update{Type: UpdNewMessage, Key: "INBOX", SeqSet: "61:120"})
+	if _, err := s.EmailChanges("acc", initial, 0); err != ErrCannotCalculateChanges {
+		t.Fatal("expected ErrCannotCalculateChanges, got", err)
+	}
+	s.lock.Lock()
+	entries := len(s.accounts["acc"].email.entries)
+	s.lock.Unlock()
+	if entries != 60 {
+		t.Fatal("expected 60 log entries, got", entries)
+	}
+}
+
+func TestJMAPStateApplyError(t *testing.T) {
+	s := NewJMAPState(func(key interface{}) string { return "acc" })
+
+	initial := s.EmailState("acc")
+	var updErr *UpdateError
+	if err := s.Apply(Update{Type: UpdFlags, Key: "INBOX", SeqSet: "a:b"}); !errors.As(err, &updErr) {
+		t.Fatal("expected *UpdateError, got", err)
+	}
+	if err := s.Apply(Update{Type: UpdRemoved, Key: "INBOX", SeqSet: "1:*"}); !errors.Is(err, ErrDynamicSet) {
+		t.Fatal("expected ErrDynamicSet, got", err)
+	}
+	if _, err := s.EmailChanges("acc", initial, 0); err != ErrCannotCalculateChanges {
+		t.Fatal("expected ErrCannotCalculateChanges, got", err)
+	}
+
+	var reported []error
+	s.ErrorHook = func(err error) {
+		reported = append(reported, err)
+	}
+	upds := make(chan Update, 1)
+	upds <- Update{Type: UpdNewMessage, Key: "INBOX", SeqSet: ""}
+	close(upds)
+	s.Consume(upds)
+	if len(reported) != 1 {
+		t.Fatal("error not reported via ErrorHook:", reported)
+	}
+}
+
+func TestJMAPStateEpoch(t *testing.T) {
+	s1 := NewJMAPState(func(key interface{}) string { return "acc" })
+	s2 := NewJMAPState(func(key interface{}) string { return "acc" })
+	s1.Epoch = "cluster-a"
+	s2.Epoch = "cluster-a"
+
+	upd := Update{Type: UpdNewMessage, Key: "INBOX", SeqSet: "1"}
+	initial := s1.EmailState("acc")
+	s1.Apply(upd)
+	s2.Apply(upd)
+
+	changes, err := s2.EmailChanges("acc", initial, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(changes.Created) != 1 || changes.NewState != s1.EmailState("acc") {
+		t.Fatalf("unexpected changes: %+v", changes)
+	}
+}
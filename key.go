@@ -0,0 +1,162 @@
+package mess
+
+import (
+	"fmt"
+	"sync"
+)
+
+// MailboxKey is a structured mailbox key that can be passed to Manager
+// instead of an opaque value.
+//
+// Manager understands such keys and is able to perform per-account operations
+// on them (see AccountMailboxes, DropAccount, SubscribeAccount).
+//
+// MailboxKey should be passed by value, pointers to it are treated as opaque
+// keys and compared by address.
+//
+// Note that if updates are serialized (see SetExternalSink), the transport is
+// responsible for restoring the key type on the receiving side.
+type MailboxKey struct {
+	Account   string
+	MailboxID string
+}
+
+func keyAccount(key interface{}) (string, bool) {
+	if key, ok := key.(MailboxKey); ok {
+		return key.Account, true
+	}
+	return "", false
+}
+
+type accountSub struct {
+	upds chan<- Update
+}
+
+type accountSubs struct {
+	lock sync.RWMutex
+	subs map[string]map[*accountSub]struct{}
+}
+
+// forEachShared calls f for each sharedHandle with the key belonging to the
+// specified account.
+//
+// f is called with the shard lock held.
+func (m *Manager) forEachShared(account string, f func(key interface{}, shared *sharedHandle)) {
+	m.forEachShard(func(shard *handlesShard) {
+		for key, shared := range shard.handles {
+			acc, ok := keyAccount(key)
+			if !ok || acc != account {
+				continue
+			}
+			f(key, shared)
+		}
+	})
+}
+
+// AccountMailboxes returns the list of keys for mailboxes of the account that
+// are currently selected by at least one connection.
+//
+// Only mailboxes selected using MailboxKey are considered.
+func (m *Manager) AccountMailboxes(account string) []MailboxKey {
+	var keys []MailboxKey
+	m.forEachShared(account, func(key interface{}, _ *sharedHandle) {
+		if key, ok := key.(MailboxKey); ok {
+			keys = append(keys, key)
+		}
+	})
+	return keys
+}
+
+// DropAccount stops dispatching updates to all connections that have a mailbox
+// of the specified account selected.
+//
+// It has the same effect on the affected connections as MailboxDestroyed but
+// is not propagated to other nodes via SetExternalSink.
+func (m *Manager) DropAccount(account string) {
+	var keys []interface{}
+	m.forEachShared(account, func(key interface{}, _ *sharedHandle) {
+		keys = append(keys, key)
+	})
+
+	for _, key := range keys {
+		m.mailboxDestroyed(key)
+	}
+}
+
+// SubscribeAccount registers the channel that will receive all updates for
+// mailboxes of the specified account, both generated locally and received via
+// ExternalUpdate. This is intended to be used to implement NOTIFY-like
+// functionality.
+//
+// Updates are sent without blocking, if the channel is full the update is
+// dropped and reported via ErrorHook, so a buffered channel should be used.
+// Returned function should be called to unregister the channel.
+func (m *Manager) SubscribeAccount(account string, upds chan<- Update) (unsubscribe func()) {
+	m.accountSubs.lock.Lock()
+	defer m.accountSubs.lock.Unlock()
+
+	if m.accountSubs.subs == nil {
+		m.accountSubs.subs = make(map[string]map[*accountSub]struct{})
+	}
+	subs := m.accountSubs.subs[account]
+	if subs == nil {
+		subs = make(map[*accountSub]struct{})
+		m.accountSubs.subs[account] = subs
+	}
+	sub := &accountSub{upds: upds}
+	subs[sub] = struct{}{}
+
+	return func() {
+		m.accountSubs.lock.Lock()
+		defer m.accountSubs.lock.Unlock()
+
+		delete(subs, sub)
+		if len(subs) == 0 {
+			delete(m.accountSubs.subs, account)
+		}
+	}
+}
+
+func (m *Manager) notifyAccount(upd Update) {
+	account, ok := keyAccount(upd.Key)
+	if !ok {
+		return
+	}
+
+	m.accountSubs.lock.RLock()
+	defer m.accountSubs.lock.RUnlock()
+
+	// The lock is held so the channel is not closed after unsubscribe
+	// while we send to it, the send should never block.
+	for sub := range m.accountSubs.subs[account] {
+		select {
+		case sub.upds <- upd:
+		default:
+			m.reportError(fmt.Errorf("Account subscriber for %v is full, update for %v dropped", account, upd.Key))
+		}
+	}
+}
+
+// emit sends the update generated by this Manager to all interested parties.
+func (m *Manager) emit(upd Update) {
+	m.closeLock.RLock()
+	// Sink is closed on Shutdown.
+	if m.closed {
+		m.closeLock.RUnlock()
+		return
+	}
+	sink := m.sink
+	// Shutdown waits for the sends before closing the sink.
+	m.emitting.Add(1)
+	m.closeLock.RUnlock()
+	defer m.emitting.Done()
+
+	if sink != nil {
+		select {
+		case sink <- upd:
+		case <-m.abortEmit:
+			m.reportError(fmt.Errorf("Update for %v is not propagated: %w", upd.Key, ErrManagerClosed))
+		}
+	}
+	m.notifyAccount(upd)
+}
@@ -0,0 +1,114 @@
+package mess
+
+import (
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestAccountOperations(t *testing.T) {
+	m := NewManager()
+
+	inbox := MailboxKey{Account: "foxcpp", MailboxID: "INBOX"}
+	sent := MailboxKey{Account: "foxcpp", MailboxID: "Sent"}
+	other := MailboxKey{Account: "emersion", MailboxID: "INBOX"}
+
+	openTestHandle(m, inbox, 1, 2)
+	openTestHandle(m, sent)
+	otherHndl, otherConn := openTestHandle(m, other)
+
+	if keys := m.AccountMailboxes("foxcpp"); len(keys) != 2 {
+		t.Fatal("Expected 2 mailboxes, got", keys)
+	}
+
+	upds := make(chan Update, 10)
+	unsubscribe := m.SubscribeAccount("foxcpp", upds)
+	m.NewMessage(inbox, 3)
+	m.ExternalUpdate(Update{Type: UpdRemoved, Key: sent, SeqSet: "1"})
+	m.NewMessage(other, 1)
+	unsubscribe()
+	m.NewMessage(inbox, 4)
+	close(upds)
+
+	var received []Update
+	for upd := range upds {
+		received = append(received, upd)
+	}
+	if len(received) != 2 || received[0].Key != inbox || received[1].Key != sent {
+		t.Fatal("Unexpected updates received:", received)
+	}
+
+	m.DropAccount("foxcpp")
+	if keys := m.AccountMailboxes("foxcpp"); len(keys) != 0 {
+		t.Fatal("Expected no mailboxes, got", keys)
+	}
+	if keys := m.AccountMailboxes("emersion"); len(keys) != 1 {
+		t.Fatal("Expected 1 mailbox, got", keys)
+	}
+
+	otherHndl.Sync(true)
+	if upds := otherConn.take(); len(upds) != 2 {
+		t.Fatal("Expected EXISTS and RECENT, got", upds)
+	}
+}
+
+func TestAccountSubscriberFull(t *testing.T) {
+	m := NewManager()
+	var reported []error
+	m.ErrorHook = func(err error) {
+		reported = append(reported, err)
+	}
+
+	key := MailboxKey{Account: "foxcpp", MailboxID: "INBOX"}
+	hndl, _ := openTestHandle(m, key, 1)
+	defer hndl.Close()
+
+	// Nobody reads the channel.
+	unsubscribe := m.SubscribeAccount("foxcpp", make(chan Update))
+	defer unsubscribe()
+
+	done := make(chan struct{})
+	go func() {
+		m.NewMessage(key, 2)
+		m.DropAccount("other")
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Slow subscriber blocks the Manager")
+	}
+	if len(reported) != 1 {
+		t.Fatal("Expected dropped update to be reported, got", reported)
+	}
+}
+
+func TestPointerKey(t *testing.T) {
+	m := NewManager()
+	var unsubscribed []interface{}
+	m.ExternalUnsubscribe = func(key interface{}) {
+		unsubscribed = append(unsubscribed, key)
+	}
+
+	key := &MailboxKey{Account: "foxcpp", MailboxID: "INBOX"}
+	hndl, conn := openTestHandle(m, key, 1)
+
+	// The key is compared by address so changes to the value do not matter.
+	shard := m.shard(key)
+	for i := 0; i < 100; i++ {
+		key.MailboxID = "INBOX" + strconv.Itoa(i)
+		if m.shard(key) != shard {
+			t.Fatal("Shard changed with the key value")
+		}
+	}
+	m.NewMessage(key, 2)
+	hndl.Sync(true)
+	if upds := conn.take(); len(upds) != 2 {
+		t.Fatal("Expected EXISTS and RECENT, got", upds)
+	}
+
+	hndl.Close()
+	if len(unsubscribed) != 1 || unsubscribed[0] != key {
+		t.Fatal("Expected key to be unsubscribed, got", unsubscribed)
+	}
+}
@@ -0,0 +1,145 @@
+package mess
+
+import (
+	"sort"
+	"strings"
+
+	"github.com/emersion/go-imap"
+	"github.com/emersion/go-imap/backend"
+)
+
+// KeywordsMailbox can be implemented by the Mailbox passed to Manager.Mailbox
+// to enable keyword tracking for the key.
+//
+// If it is implemented, the Manager keeps the set of flags used in the
+// mailbox and sends untagged FLAGS and PERMANENTFLAGS responses to all
+// sessions once a new keyword (flag without the backslash) appears in
+// FlagsChanged or KeywordsAdded.
+type KeywordsMailbox interface {
+	Mailbox
+
+	// Keywords returns the flags reported in the FLAGS response on
+	// SELECT. allowNew indicates whether clients can create new keywords
+	// (\* in PERMANENTFLAGS).
+	Keywords() (flags []string, allowNew bool)
+}
+
+// keywordsUpdate is the FLAGS update pending for the connection.
+type keywordsUpdate struct {
+	version   uint64
+	flags     []string
+	permanent []string
+}
+
+// seedKeywords enables keyword tracking and merges the flags reported by the
+// new session into the set. Other sessions are not notified since the
+// flags are not new, they were just not reported before.
+func (shared *sharedHandle) seedKeywords(flags []string, allowNew bool) {
+	shared.keywordsLock.Lock()
+	if shared.keywords == nil {
+		shared.keywords = make(map[string]struct{}, len(flags))
+		shared.allowNew = allowNew
+	}
+	for _, f := range flags {
+		if f != imap.RecentFlag {
+			shared.keywords[f] = struct{}{}
+		}
+	}
+	shared.keywordsLock.Unlock()
+}
+
+// addKeywords adds keywords from flags to the set and queues FLAGS update for
+// all handles if any of them is new. System flags are always defined so they
+// are ignored. It does nothing if keyword tracking is not enabled.
+func (shared *sharedHandle) addKeywords(flags []string) {
+	shared.keywordsLock.Lock()
+	if shared.keywords == nil {
+		shared.keywordsLock.Unlock()
+		return
+	}
+	added := false
+	for _, f := range flags {
+		if strings.HasPrefix(f, "\\") {
+			continue
+		}
+		if _, ok := shared.keywords[f]; !ok {
+			shared.keywords[f] = struct{}{}
+			added = true
+		}
+	}
+	if !added {
+		shared.keywordsLock.Unlock()
+		return
+	}
+
+	shared.keywordsVersion++
+	upd := keywordsUpdate{
+		version: shared.keywordsVersion,
+		flags:   make([]string, 0, len(shared.keywords)),
+	}
+	for f := range shared.keywords {
+		upd.flags = append(upd.flags, f)
+	}
+	sort.Strings(upd.flags)
+	upd.permanent = upd.flags
+	if shared.allowNew {
+		upd.permanent = append(append([]string(nil), upd.flags...), "\\*")
+	}
+	shared.keywordsLock.Unlock()
+
+	shared.handlesLock.RLock()
+	defer shared.handlesLock.RUnlock()
+
+	for hndl := range shared.handles {
+		hndl.lock.Lock()
+		// Concurrent calls may queue updates out of order.
+		if hndl.pendingKeywords == nil || hndl.pendingKeywords.version < upd.version {
+			hndl.pendingKeywords = &upd
+			hndl.idleUpdate()
+		}
+		hndl.lock.Unlock()
+	}
+}
+
+// sendKeywords sends the pending FLAGS update.
+//
+// handle.lock should be held.
+func (handle *MailboxHandle) sendKeywords() {
+	if handle.pendingKeywords == nil {
+		return
+	}
+	status := imap.NewMailboxStatus("", nil)
+	status.Flags = handle.pendingKeywords.flags
+	status.PermanentFlags = handle.pendingKeywords.permanent
+	handle.send(&backend.MailboxUpdate{MailboxStatus: status})
+	handle.pendingKeywords = nil
+}
+
+// KeywordsAdded should be called when messages with the specified flags are
+// added to the mailbox, e.g. by APPEND or COPY, so sessions can be notified
+// about new keywords. It is not necessary for flags passed to FlagsChanged.
+func (m *Manager) KeywordsAdded(key interface{}, flags []string) error {
+	if m.isClosed() {
+		return ErrManagerClosed
+	}
+	if len(flags) == 0 {
+		return nil
+	}
+
+	upd := Update{
+		Type:     UpdKeywords,
+		Key:      key,
+		NewFlags: flags,
+	}
+	m.traceUpdate(&upd, false)
+	m.emit(upd)
+
+	m.keywordsAdded(key, flags)
+	return nil
+}
+
+func (m *Manager) keywordsAdded(key interface{}, flags []string) {
+	m.withShared(key, func(shared *sharedHandle) {
+		shared.addKeywords(flags)
+	})
+}
@@ -0,0 +1,162 @@
+package mess
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/emersion/go-imap"
+	"github.com/emersion/go-imap/backend"
+)
+
+type keywordsMailbox struct {
+	testMailbox
+	flags []string
+}
+
+func (mbox keywordsMailbox) Keywords() ([]string, bool) {
+	return mbox.flags, true
+}
+
+func openKeywordsHandle(m *Manager, key interface{}, flags []string, uids ...uint32) (*MailboxHandle, *testConn) {
+	conn := &testConn{}
+	handle, err := m.Mailbox(key, keywordsMailbox{testMailbox{conn: conn}, flags}, uids, &imap.SeqSet{})
+	if err != nil {
+		panic(err)
+	}
+	return handle, conn
+}
+
+func TestKeywordsNew(t *testing.T) {
+	m := NewManager()
+	hndl, conn := openKeywordsHandle(m, "INBOX", []string{imap.SeenFlag, "$A"}, 1, 2)
+	other, otherConn := openKeywordsHandle(m, "INBOX", []string{imap.SeenFlag}, 1, 2)
+	defer hndl.Close()
+	defer other.Close()
+
+	// Known keywords and system flags are not announced.
+	hndl.FlagsChanged(1, []string{imap.SeenFlag, imap.FlaggedFlag, "$A"}, false)
+	other.Sync(true)
+	upds := otherConn.take()
+	if len(upds) != 1 {
+		t.Fatal("Expected FETCH only, got", upds)
+	}
+	if _, ok := upds[0].(*backend.MessageUpdate); !ok {
+		t.Fatal("Expected FETCH, got", upds[0])
+	}
+
+	hndl.Sync(true)
+	conn.take()
+
+	hndl.FlagsChanged(2, []string{"$B"}, true)
+	other.Sync(true)
+	upds = otherConn.take()
+	if len(upds) != 2 {
+		t.Fatal("Expected FLAGS and FETCH, got", upds)
+	}
+	status := upds[0].(*backend.MailboxUpdate).MailboxStatus
+	if !reflect.DeepEqual(status.Flags, []string{"$A", "$B", imap.SeenFlag}) {
+		t.Error("Wrong FLAGS:", status.Flags)
+	}
+	if !reflect.DeepEqual(status.PermanentFlags, []string{"$A", "$B", imap.SeenFlag, "\\*"}) {
+		t.Error("Wrong PERMANENTFLAGS:", status.PermanentFlags)
+	}
+	if _, ok := upds[1].(*backend.MessageUpdate); !ok {
+		t.Fatal("FETCH is not sent after FLAGS:", upds)
+	}
+
+	// FLAGS is sent even for .SILENT STORE.
+	hndl.Sync(true)
+	upds = conn.take()
+	if len(upds) != 1 {
+		t.Fatal("Expected FLAGS, got", upds)
+	}
+	if _, ok := upds[0].(*backend.MailboxUpdate); !ok {
+		t.Fatal("Expected FLAGS, got", upds[0])
+	}
+}
+
+func TestKeywordsUntracked(t *testing.T) {
+	m := NewManager()
+	hndl, _ := openTestHandle(m, "INBOX", 1)
+	other, otherConn := openTestHandle(m, "INBOX", 1)
+	defer hndl.Close()
+	defer other.Close()
+
+	hndl.FlagsChanged(1, []string{"$New"}, false)
+	m.KeywordsAdded("INBOX", []string{"$Other"})
+	other.Sync(true)
+	upds := otherConn.take()
+	if len(upds) != 1 {
+		t.Fatal("Expected FETCH only, got", upds)
+	}
+	if _, ok := upds[0].(*backend.MessageUpdate); !ok {
+		t.Fatal("Expected FETCH, got", upds[0])
+	}
+}
+
+func TestKeywordsAdded(t *testing.T) {
+	m := NewManager()
+	sink := make(chan Update, 1)
+	m.SetExternalSink(sink)
+
+	hndl, conn := openKeywordsHandle(m, "INBOX", nil, 1)
+	defer hndl.Close()
+
+	m.KeywordsAdded("INBOX", []string{"$A", imap.RecentFlag})
+	upd := <-sink
+	if upd.Type != UpdKeywords || !reflect.DeepEqual(upd.NewFlags, []string{"$A", imap.RecentFlag}) {
+		t.Fatal("Unexpected external update:", upd)
+	}
+
+	hndl.Sync(true)
+	upds := conn.take()
+	if len(upds) != 1 {
+		t.Fatal("Expected FLAGS, got", upds)
+	}
+	status := upds[0].(*backend.MailboxUpdate).MailboxStatus
+	if !reflect.DeepEqual(status.Flags, []string{"$A"}) {
+		t.Error("Wrong FLAGS:", status.Flags)
+	}
+}
+
+func TestKeywordsExternal(t *testing.T) {
+	m := NewManager()
+	hndl, conn := openKeywordsHandle(m, "INBOX", []string{"$A"}, 1)
+	defer hndl.Close()
+
+	if err := m.ExternalUpdate(Update{Type: UpdKeywords, Key: "INBOX", NewFlags: []string{"$A"}}); err != nil {
+		t.Fatal(err)
+	}
+	hndl.Sync(true)
+	if upds := conn.take(); len(upds) != 0 {
+		t.Fatal("FLAGS sent for known keyword:", upds)
+	}
+
+	if err := m.ExternalUpdate(Update{Type: UpdKeywords, Key: "INBOX", NewFlags: []string{"$B"}}); err != nil {
+		t.Fatal(err)
+	}
+	hndl.Sync(true)
+	if upds := conn.take(); len(upds) != 1 {
+		t.Fatal("Expected FLAGS, got", upds)
+	}
+}
+
+func TestKeywordsAccountSubscriber(t *testing.T) {
+	m := NewManager()
+	key := MailboxKey{Account: "foxcpp", MailboxID: "INBOX"}
+
+	upds := make(chan Update, 1)
+	defer m.SubscribeAccount("foxcpp", upds)()
+
+	if err := m.ExternalUpdate(Update{Type: UpdKeywords, Key: key, NewFlags: []string{"$A"}}); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case upd := <-upds:
+		if upd.Type != UpdKeywords || upd.Key != key {
+			t.Fatal("Unexpected update:", upd)
+		}
+	default:
+		t.Fatal("Keywords update is not sent to the account subscriber")
+	}
+}
@@ -0,0 +1,124 @@
+package mess
+
+import (
+	"context"
+	"runtime/debug"
+	"sync/atomic"
+	"time"
+
+	"github.com/emersion/go-imap/server"
+)
+
+// reapReason is the text of BYE sent to sessions evicted by Reap.
+const reapReason = "Session expired"
+
+// LeakedHandle describes the MailboxHandle evicted by Manager.Reap.
+type LeakedHandle struct {
+	Key     interface{}
+	Session SessionInfo
+	Reason  string
+
+	// Stack contains the stack trace of the Manager.Mailbox call that
+	// created the handle. It is populated only if Manager.DebugLeaks is set.
+	Stack []byte
+}
+
+// BindContext ties the handle lifetime to the context. Once ctx is done, the
+// handle is considered leaked and will be evicted by Manager.Reap unless
+// it is closed before.
+func (handle *MailboxHandle) BindContext(ctx context.Context) {
+	handle.lock.Lock()
+	defer handle.lock.Unlock()
+	handle.ctx = ctx
+}
+
+func (handle *MailboxHandle) touch() {
+	atomic.StoreInt64(&handle.lastUsed, time.Now().UnixNano())
+}
+
+// leakReason returns the non-empty string if handle should be evicted by Reap.
+func (handle *MailboxHandle) leakReason(now time.Time) string {
+	handle.lock.RLock()
+	defer handle.lock.RUnlock()
+
+	if handle.ctx != nil && handle.ctx.Err() != nil {
+		return "context done: " + handle.ctx.Err().Error()
+	}
+
+	// go-imap server connections let us know when the client is gone.
+	if c, ok := handle.conn.(interface{ Context() *server.Context }); ok {
+		if ctx := c.Context(); ctx != nil && ctx.LoggedOut != nil {
+			select {
+			case <-ctx.LoggedOut:
+				return "connection closed"
+			default:
+			}
+		}
+	}
+
+	if handle.m.IdleTTL != 0 && handle.idleerNotify == nil {
+		lastUsed := time.Unix(0, atomic.LoadInt64(&handle.lastUsed))
+		if now.Sub(lastUsed) > handle.m.IdleTTL {
+			return "not used since " + lastUsed.Format(time.RFC3339)
+		}
+	}
+
+	return ""
+}
+
+// Reap closes all handles that are likely leaked by the backend, i.e. their
+// connection is gone, their context (see BindContext) is done or they were
+// not used for longer than IdleTTL.
+//
+// Evicted handles are marked as closed, similarly to CloseSessions, so if
+// the client is still there, it is sent BYE instead of silently missing
+// updates.
+//
+// It is meant to be called periodically and returns the information
+// about evicted handles that should be logged to help find the leak.
+func (m *Manager) Reap() []LeakedHandle {
+	now := time.Now()
+
+	var (
+		leaked  []LeakedHandle
+		handles []*MailboxHandle
+	)
+	m.forEachShard(func(shard *handlesShard) {
+		for key, shared := range shard.handles {
+			shared.handlesLock.RLock()
+			for hndl := range shared.handles {
+				reason := hndl.leakReason(now)
+				if reason == "" {
+					continue
+				}
+
+				handles = append(handles, hndl)
+				leaked = append(leaked, LeakedHandle{
+					Key:     key,
+					Session: hndl.info,
+					Reason:  reason,
+					Stack:   hndl.stack,
+				})
+			}
+			shared.handlesLock.RUnlock()
+		}
+	})
+
+	for _, hndl := range handles {
+		hndl.lock.Lock()
+		if !hndl.closed {
+			hndl.markClosed(reapReason)
+		}
+		hndl.lock.Unlock()
+		hndl.Close()
+	}
+
+	return leaked
+}
+
+func creationStack(m *Manager) []byte {
+	if !m.DebugLeaks {
+		return nil
+	}
+	return debug.Stack()
+}
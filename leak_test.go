@@ -0,0 +1,80 @@
+package mess
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/emersion/go-imap"
+	"github.com/emersion/go-imap/backend"
+)
+
+func TestReap(t *testing.T) {
+	m := NewManager()
+	m.DebugLeaks = true
+
+	var unsubscribed []interface{}
+	m.ExternalUnsubscribe = func(key interface{}) {
+		unsubscribed = append(unsubscribed, key)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	bound, _ := openTestHandle(m, "INBOX", 1)
+	bound.BindContext(ctx)
+	openTestHandle(m, "Sent", 1)
+
+	if leaked := m.Reap(); len(leaked) != 0 {
+		t.Fatal("Unexpected leaked handles:", leaked)
+	}
+
+	cancel()
+	leaked := m.Reap()
+	if len(leaked) != 1 || leaked[0].Key != "INBOX" || len(leaked[0].Stack) == 0 {
+		t.Fatal("Unexpected leaked handles:", leaked)
+	}
+	if len(unsubscribed) != 1 || unsubscribed[0] != "INBOX" {
+		t.Fatal("ExternalUnsubscribe not called:", unsubscribed)
+	}
+
+	viewed, _ := openTestHandle(m, "Junk", 1)
+	inCommand, _ := openTestHandle(m, "Archive", 1)
+	m.IdleTTL = time.Millisecond
+	time.Sleep(5 * time.Millisecond)
+	used, _ := openTestHandle(m, "Drafts", 1)
+	used.Sync(false)
+	viewed.View()
+	inCommand.BeginCommand(CmdUid)
+
+	leaked = m.Reap()
+	if len(leaked) != 1 || leaked[0].Key != "Sent" {
+		t.Fatal("Unexpected leaked handles:", leaked)
+	}
+	if sessions := m.Sessions(); len(sessions) != 3 {
+		t.Fatal("Unexpected sessions left:", sessions)
+	}
+}
+
+func TestReapIdleBye(t *testing.T) {
+	m := NewManager()
+	m.IdleTTL = time.Millisecond
+	hndl, conn := openTestHandle(m, "INBOX", 1)
+	time.Sleep(5 * time.Millisecond)
+
+	if leaked := m.Reap(); len(leaked) != 1 {
+		t.Fatal("Unexpected leaked handles:", leaked)
+	}
+	if !hndl.Closed() {
+		t.Fatal("Reaped handle is not marked as closed")
+	}
+
+	// The client comes back.
+	hndl.BeginCommand(CmdSeq)
+	hndl.EndCommand()
+	upds := conn.take()
+	if len(upds) != 1 {
+		t.Fatal("Expected BYE, got", upds)
+	}
+	if status, ok := upds[0].(*backend.StatusUpdate); !ok || status.Type != imap.StatusRespBye {
+		t.Fatal("Expected BYE, got", upds[0])
+	}
+}
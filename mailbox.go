@@ -1,7 +1,8 @@
 package mess
 
 import (
-	"errors"
+	"context"
+	"fmt"
 	"strconv"
 	"sync"
 
@@ -19,15 +20,117 @@ type sharedHandle struct {
 
 	handlesLock sync.RWMutex
 	handles     map[*MailboxHandle]struct{}
+	// oldest is the handle with the lowest ID, it gets \Recent for new
+	// messages so the choice is stable, e.g. when a recording is replayed
+	// (see Replay).
+	oldest *MailboxHandle
+
+	// keywords is the set of flags used in the mailbox, it is nil if
+	// keyword tracking is not enabled, see KeywordsMailbox.
+	keywordsLock    sync.Mutex
+	keywords        map[string]struct{}
+	allowNew        bool
+	keywordsVersion uint64
+}
+
+// newMessages queues the new messages for all handles and marks recent as
+// \Recent in one of the sessions. ok is false if there are no sessions.
+func (shared *sharedHandle) newMessages(uid, recent *imap.SeqSet, traceID uint64) (ok bool) {
+	shared.handlesLock.RLock()
+	defer shared.handlesLock.RUnlock()
+
+	recentHndl := shared.oldest
+	if recentHndl == nil {
+		return false
+	}
+
+	for hndl := range shared.handles {
+		hndl.lock.Lock()
+		hndl.pendingCreated.AddSet(uid)
+		if hndl == recentHndl && recent != nil && !recent.Empty() {
+			hndl.addRecent(recent)
+			hndl.hasNewRecent = true
+		}
+		hndl.traceEnqueue(traceID, uid)
+		hndl.idleUpdate()
+		hndl.lock.Unlock()
+	}
+
+	return true
+}
+
+// addHandle adds the handle to the set. handlesLock should be held.
+func (shared *sharedHandle) addHandle(hndl *MailboxHandle) {
+	shared.handles[hndl] = struct{}{}
+	if shared.oldest == nil || hndl.id < shared.oldest.id {
+		shared.oldest = hndl
+	}
+}
+
+// removeHandle removes the handle from the set. handlesLock should be held.
+func (shared *sharedHandle) removeHandle(hndl *MailboxHandle) {
+	delete(shared.handles, hndl)
+	if shared.oldest != hndl {
+		return
+	}
+	shared.oldest = nil
+	for other := range shared.handles {
+		if shared.oldest == nil || other.id < shared.oldest.id {
+			shared.oldest = other
+		}
+	}
+}
+
+// clearHandles removes all handles from the set. handlesLock should be
+// held.
+func (shared *sharedHandle) clearHandles() {
+	shared.handles = nil
+	shared.oldest = nil
+}
+
+func (shared *sharedHandle) removed(seq *imap.SeqSet, traceID uint64) {
+	shared.handlesLock.RLock()
+	defer shared.handlesLock.RUnlock()
+
+	for hndl := range shared.handles {
+		hndl.lock.Lock()
+		hndl.pendingExpunge.AddSet(seq)
+		hndl.traceEnqueue(traceID, seq)
+		hndl.idleUpdate()
+		hndl.lock.Unlock()
+	}
+}
+
+// flagsChanged queues the flags update for all handles except for
+// the specified one.
+func (shared *sharedHandle) flagsChanged(uid uint32, newFlags []string, except *MailboxHandle, traceID uint64) {
+	shared.handlesLock.RLock()
+	defer shared.handlesLock.RUnlock()
+
+	for hndl := range shared.handles {
+		if hndl == except {
+			continue
+		}
+
+		hndl.enqueueFlagsUpdate(uid, newFlags, traceID)
+	}
 }
 
 type MailboxHandle struct {
+	// Accessed atomically, kept first for 64-bit alignment.
+	lastUsed int64
+
 	m      *Manager
+	id     uint64
 	key    interface{}
 	shared *sharedHandle
 	conn   backend.Conn
+	info   SessionInfo
+	stack  []byte
 
 	lock           sync.RWMutex
+	closed         bool
+	ctx            context.Context
 	idleerNotify   chan struct{}
 	uidMap         []uint32
 	recent         *imap.SeqSet
@@ -36,91 +139,38 @@ type MailboxHandle struct {
 	pendingExpunge imap.SeqSet
 	pendingCreated imap.SeqSet
 	pendingFlags   []flagsUpdate
-}
+	command        CommandKind
 
-var ErrNoMessages = errors.New("No messages matched")
+	pendingKeywords *keywordsUpdate
+
+	// BYE queued by CloseSessions or Shutdown. If byeFlush is set, pending
+	// updates are sent before it. byeSent, if not nil, is closed once BYE is
+	// sent or the handle is closed.
+	byePending bool
+	byeReason  string
+	byeFlush   bool
+	byeSent    chan struct{}
+
+	// Flags last reported to the client, see flagscache.go.
+	sentFlags map[uint32][]string
+
+	// Populated only if Manager.Tracer is set.
+	pendingTraceIDs []uint64
+}
 
 // ResolveSeq converts the passed UIDs or sequence numbers set into UIDs set
 // that is appropriate for mailbox operations in this connection.
 //
-// If resolution algorithm results in an empty set, ErrNoMessages is
-// returned.
-// Resulting set *may* include UIDs that were expunged in other
-// connections, backend should ignore these as specified in RFC 3501.
+// It is a shorthand for handle.View().ResolveSeq.
 func (handle *MailboxHandle) ResolveSeq(uid bool, set *imap.SeqSet) (*imap.SeqSet, error) {
-	handle.lock.RLock()
-	defer handle.lock.RUnlock()
-
-	if len(handle.uidMap) == 0 {
-		return &imap.SeqSet{}, ErrNoMessages
-	}
-
-	if uid {
-		for i, seq := range set.Set {
-			if seq.Start == 0 {
-				seq.Start = handle.uidMap[len(handle.uidMap)-1]
-			}
-			if seq.Stop == 0 {
-				seq.Stop = handle.uidMap[len(handle.uidMap)-1]
-			}
-
-			// Resolving certain UID sets may yield cases in which
-			// start value is bigger than stop. However, as opposed to
-			// seqnum sets, this is a valid and meaningful set
-			// that may be passed to backend as go-imap cannot sort it
-			// meaningfully.
-			//
-			// E.g. UIDNEXT:*  should be basically equivalent to *
-			// and refer to the last message.
-			if seq.Start > seq.Stop {
-				seq.Start, seq.Stop = seq.Stop, seq.Start
-			}
-
-			set.Set[i] = seq
-		}
-
-		return set, nil
-	}
-
-	result := &imap.SeqSet{}
-	for _, seq := range set.Set {
-		seq, ok := seqToUid(handle.uidMap, seq)
-		if !ok {
-			continue
-		}
-		result.AddRange(seq.Start, seq.Stop)
-	}
-
-	if len(result.Set) == 0 {
-		return &imap.SeqSet{}, ErrNoMessages
-	}
-
-	return result, nil
+	handle.touch()
+	return handle.View().ResolveSeq(uid, set)
 }
 
 // ResolveCriteria converts all SeqNum rules into corresponding Uid
 // rules. Argument is modified directly.
 func (handle *MailboxHandle) ResolveCriteria(criteria *imap.SearchCriteria) {
-	if criteria.Uid != nil {
-		seq, _ := handle.ResolveSeq(true, criteria.Uid)
-		criteria.Uid = seq
-	}
-	if criteria.SeqNum != nil {
-		if criteria.Uid == nil {
-			criteria.Uid = new(imap.SeqSet)
-		}
-		seq, _ := handle.ResolveSeq(false, criteria.SeqNum)
-		criteria.Uid.AddSet(seq)
-		criteria.SeqNum = nil
-	}
-
-	for _, not := range criteria.Not {
-		handle.ResolveCriteria(not)
-	}
-	for _, or := range criteria.Or {
-		handle.ResolveCriteria(or[0])
-		handle.ResolveCriteria(or[1])
-	}
+	handle.View().ResolveCriteria(criteria)
 }
 
 func (handle *MailboxHandle) UidAsSeq(uid uint32) (uint32, bool) {
@@ -134,11 +184,17 @@ func (handle *MailboxHandle) UidAsSeq(uid uint32) (uint32, bool) {
 func (handle *MailboxHandle) Idle(done <-chan struct{}) {
 	handle.lock.Lock()
 	handle.idleerNotify = make(chan struct{}, 1)
+	handle.command = CmdIdle
+	// Updates queued before IDLE started should not wait for the next one.
+	if len(handle.pendingFlags) != 0 || !handle.pendingCreated.Empty() || !handle.pendingExpunge.Empty() || handle.pendingKeywords != nil {
+		handle.idleerNotify <- struct{}{}
+	}
 	handle.lock.Unlock()
 
 	defer func() {
 		handle.lock.Lock()
 		handle.idleerNotify = nil
+		handle.command = CmdNone
 		handle.lock.Unlock()
 	}()
 
@@ -158,30 +214,61 @@ func (handle *MailboxHandle) Idle(done <-chan struct{}) {
 //
 // expunge should be set to true if EXPUNGE updates should be
 // sent. IT SHOULD NOT BE SET WHILE EXECUTING A COMMAND
-// USING SEQUENCE NUMBERS (except for COPY).
+// USING SEQUENCE NUMBERS (except for COPY). If the command is tracked using
+// BeginCommand, unsafe requests are downgraded automatically.
 func (handle *MailboxHandle) Sync(expunge bool) {
 	if handle.conn == nil {
 		return
 	}
 
+	handle.touch()
+
 	handle.lock.Lock()
-	defer handle.lock.Unlock()
+	if handle.closed {
+		handle.flushBye(expunge && handle.command != CmdSeq)
+		return
+	}
+	unsafe := expunge && handle.command == CmdSeq
+	handle.syncUnlocked(expunge && !unsafe)
+	kind := handle.command
+	handle.lock.Unlock()
 
-	handle.syncUnlocked(expunge)
+	if unsafe {
+		handle.m.reportError(fmt.Errorf("Sync(true) for %v during %v command downgraded: %w", handle.key, kind, ErrUnsafeExpunge))
+	}
 }
 
 func (handle *MailboxHandle) syncUnlocked(expunge bool) {
+	if handle.m.tracing() && (len(handle.pendingTraceIDs) != 0 || expunge && !handle.pendingExpunge.Empty()) {
+		handle.m.trace(TraceEvent{
+			Kind:     TraceFlush,
+			Key:      handle.key,
+			Handle:   handle.id,
+			TraceIDs: handle.pendingTraceIDs,
+			Expunge:  expunge,
+		})
+		handle.pendingTraceIDs = nil
+	}
+
+	// FLAGS goes first so clients know about keywords used in FETCH.
+	handle.sendKeywords()
+
 	for _, upd := range handle.pendingFlags {
 		seq, ok := uidToSeq(handle.uidMap, imap.Seq{Start: upd.uid, Stop: upd.uid})
 		if !ok {
 			// Likely the corresponding message was expunged.
 			continue
 		}
+		if handle.flagsKnown(upd.uid, upd.newFlags) {
+			continue
+		}
+		handle.rememberFlags(upd.uid, upd.newFlags)
+
 		updMsg := imap.NewMessage(seq.Start, []imap.FetchItem{imap.FetchFlags, imap.FetchUid})
 		updMsg.Flags = upd.newFlags
 
 		updMsg.Uid = upd.uid
-		handle.conn.SendUpdate(&backend.MessageUpdate{
+		handle.send(&backend.MessageUpdate{
 			Message: updMsg,
 		})
 	}
@@ -189,24 +276,42 @@ func (handle *MailboxHandle) syncUnlocked(expunge bool) {
 
 	if expunge && !handle.pendingExpunge.Empty() {
 		expunged := make([]uint32, 0, 16)
-		newMap := handle.uidMap[:0] /* SliceTricks: filtering without allocations */
+		// uidMap may be referenced by a View, so it is never modified in place.
+		newMap := make([]uint32, 0, len(handle.uidMap))
 		for i, uid := range handle.uidMap {
 			if handle.pendingExpunge.Contains(uid) {
 				expunged = append(expunged, uint32(i+1))
+				delete(handle.sentFlags, uid)
 				continue
 			}
 			newMap = append(newMap, uid)
 		}
 		handle.uidMap = newMap
 
+		// Messages not announced yet are expunged on the next call.
+		handle.pendingExpunge = seqSetIntersect(&handle.pendingExpunge, &handle.pendingCreated)
+
 		for i := len(expunged) - 1; i >= 0; i-- {
-			handle.conn.SendUpdate(&backend.ExpungeUpdate{SeqNum: expunged[i]})
+			handle.send(&backend.ExpungeUpdate{SeqNum: expunged[i]})
+		}
+
+		if handle.m.tracing() {
+			sent := make([]uint32, 0, len(expunged))
+			for i := len(expunged) - 1; i >= 0; i-- {
+				sent = append(sent, expunged[i])
+			}
+			handle.m.trace(TraceEvent{
+				Kind:    TraceExpunge,
+				Key:     handle.key,
+				Handle:  handle.id,
+				SeqNums: sent,
+			})
 		}
 	}
 
 	if !handle.pendingCreated.Empty() {
 		for _, seq := range handle.pendingCreated.Set {
-			for i := seq.Start; i <= seq.Stop; i++ {
+			for i := seq.Start; i <= seq.Stop && i != 0; i++ {
 				handle.uidMap = append(handle.uidMap, i)
 			}
 		}
@@ -214,7 +319,7 @@ func (handle *MailboxHandle) syncUnlocked(expunge bool) {
 
 		status := imap.NewMailboxStatus("", []imap.StatusItem{imap.StatusMessages})
 		status.Messages = uint32(len(handle.uidMap))
-		handle.conn.SendUpdate(&backend.MailboxUpdate{
+		handle.send(&backend.MailboxUpdate{
 			MailboxStatus: status,
 		})
 
@@ -228,29 +333,29 @@ func (handle *MailboxHandle) syncUnlocked(expunge bool) {
 			status := imap.NewMailboxStatus("", []imap.StatusItem{imap.StatusRecent})
 			status.Recent = handle.recentCount
 			handle.hasNewRecent = false
-			handle.conn.SendUpdate(&backend.MailboxUpdate{
+			handle.send(&backend.MailboxUpdate{
 				MailboxStatus: status,
 			})
 		}
 	}
 }
 
-func (handle *MailboxHandle) enqueueFlagsUpdate(uid uint32, newFlags []string) {
+func (handle *MailboxHandle) enqueueFlagsUpdate(uid uint32, newFlags []string, traceID uint64) {
 	upd := flagsUpdate{
 		uid:      uid,
 		newFlags: newFlags,
 	}
 
 	handle.lock.Lock()
-	if handle.recent.Contains(uid) {
+	if handle.recent != nil && handle.recent.Contains(uid) {
 		upd.newFlags = make([]string, len(newFlags))
 		copy(upd.newFlags, newFlags)
 		upd.newFlags = append(upd.newFlags, imap.RecentFlag)
 	}
 
 	exists := false
-	for i, upd := range handle.pendingFlags {
-		if upd.uid == uid {
+	for i, pending := range handle.pendingFlags {
+		if pending.uid == uid {
 			handle.pendingFlags[i].newFlags = upd.newFlags
 			exists = true
 			break
@@ -260,6 +365,9 @@ func (handle *MailboxHandle) enqueueFlagsUpdate(uid uint32, newFlags []string) {
 		handle.pendingFlags = append(handle.pendingFlags, upd)
 	}
 
+	if handle.m.tracing() {
+		handle.traceEnqueueUids(traceID, []uint32{uid})
+	}
 	handle.idleUpdate()
 	handle.lock.Unlock()
 }
@@ -269,30 +377,33 @@ func (handle *MailboxHandle) enqueueFlagsUpdate(uid uint32, newFlags []string) {
 //
 // newFlags should not include \Recent, silent should be set
 // if UpdateMessagesFlags was called with it set.
-func (handle *MailboxHandle) FlagsChanged(uid uint32, newFlags []string, silent bool) {
-	if handle.m.sink != nil {
-		handle.m.sink <- Update{
-			Type:     UpdFlags,
-			Key:      handle.key,
-			SeqSet:   strconv.FormatUint(uint64(uid), 10),
-			NewFlags: newFlags,
-		}
+func (handle *MailboxHandle) FlagsChanged(uid uint32, newFlags []string, silent bool) error {
+	if handle.m.isClosed() {
+		return ErrManagerClosed
 	}
 
-	if handle.conn == nil {
-		return
+	upd := Update{
+		Type:     UpdFlags,
+		Key:      handle.key,
+		SeqSet:   strconv.FormatUint(uint64(uid), 10),
+		NewFlags: newFlags,
 	}
+	traceID := handle.traceUpdate(&upd, silent)
+	handle.m.emit(upd)
 
-	handle.shared.handlesLock.RLock()
-	defer handle.shared.handlesLock.RUnlock()
+	if handle.conn == nil {
+		return nil
+	}
 
-	for hndl := range handle.shared.handles {
-		if hndl == handle && silent {
-			continue
-		}
+	handle.shared.addKeywords(newFlags)
 
-		hndl.enqueueFlagsUpdate(uid, newFlags)
+	var except *MailboxHandle
+	if silent {
+		except = handle
+		handle.forgetFlags(uid)
 	}
+	handle.shared.flagsChanged(uid, newFlags, except, traceID)
+	return nil
 }
 
 // IsRecent indicates whether the message should be considered
@@ -300,7 +411,7 @@ func (handle *MailboxHandle) FlagsChanged(uid uint32, newFlags []string, silent
 func (handle *MailboxHandle) IsRecent(uid uint32) bool {
 	handle.lock.RLock()
 	defer handle.lock.RUnlock()
-	return handle.recent.Contains(uid)
+	return handle.recent != nil && handle.recent.Contains(uid)
 }
 
 func (handle *MailboxHandle) idleUpdate() {
@@ -314,55 +425,64 @@ func (handle *MailboxHandle) idleUpdate() {
 
 // Removed performs all necessary update dispatching actions
 // for a specified removed message.
-func (handle *MailboxHandle) Removed(uid uint32) {
-	if handle.m.sink != nil {
-		handle.m.sink <- Update{
-			Type:   UpdRemoved,
-			Key:    handle.key,
-			SeqSet: strconv.FormatUint(uint64(uid), 10),
-		}
+func (handle *MailboxHandle) Removed(uid uint32) error {
+	if handle.m.isClosed() {
+		return ErrManagerClosed
+	}
+
+	upd := Update{
+		Type:   UpdRemoved,
+		Key:    handle.key,
+		SeqSet: strconv.FormatUint(uint64(uid), 10),
 	}
+	traceID := handle.traceUpdate(&upd, false)
+	handle.m.emit(upd)
 
 	if handle.conn == nil {
-		return
+		return nil
 	}
 
-	handle.shared.handlesLock.RLock()
-	defer handle.shared.handlesLock.RUnlock()
+	handle.shared.removed(&imap.SeqSet{Set: []imap.Seq{{Start: uid, Stop: uid}}}, traceID)
+	return nil
+}
 
-	for hndl := range handle.shared.handles {
-		hndl.lock.Lock()
-		hndl.pendingExpunge.AddNum(uid)
-		hndl.idleUpdate()
-		hndl.lock.Unlock()
+func (handle *MailboxHandle) RemovedSet(seq imap.SeqSet) error {
+	if handle.m.isClosed() {
+		return ErrManagerClosed
 	}
-}
 
-func (handle *MailboxHandle) RemovedSet(seq imap.SeqSet) {
-	if handle.m.sink != nil {
-		handle.m.sink <- Update{
-			Type:   UpdRemoved,
-			Key:    handle.key,
-			SeqSet: seq.String(),
-		}
+	upd := Update{
+		Type:   UpdRemoved,
+		Key:    handle.key,
+		SeqSet: seq.String(),
 	}
+	traceID := handle.traceUpdate(&upd, false)
+	handle.m.emit(upd)
 
 	if handle.conn == nil {
-		return
+		return nil
 	}
 
-	handle.shared.handlesLock.RLock()
-	defer handle.shared.handlesLock.RUnlock()
+	handle.shared.removed(&seq, traceID)
+	return nil
+}
+
+// Closed indicates whether the session was terminated using
+// Manager.CloseSessions.
+func (handle *MailboxHandle) Closed() bool {
+	handle.lock.RLock()
+	defer handle.lock.RUnlock()
+	return handle.closed
+}
 
-	for hndl := range handle.shared.handles {
-		hndl.lock.Lock()
-		hndl.pendingExpunge.AddSet(&seq)
-		hndl.idleUpdate()
-		hndl.lock.Unlock()
-	}
+// SessionInfo returns the session metadata the handle was created with.
+func (handle *MailboxHandle) SessionInfo() SessionInfo {
+	return handle.info
 }
 
 func (handle *MailboxHandle) MsgsCount() int {
+	handle.lock.RLock()
+	defer handle.lock.RUnlock()
 	return len(handle.uidMap)
 }
 
@@ -371,19 +491,33 @@ func (handle *MailboxHandle) Close() error {
 		return nil
 	}
 
-	handle.m.handlesLock.Lock()
-	defer handle.m.handlesLock.Unlock()
+	handle.lock.Lock()
+	if handle.byeSent != nil {
+		// Nobody is going to send BYE anymore.
+		close(handle.byeSent)
+		handle.byeSent = nil
+	}
+	handle.lock.Unlock()
+
+	shard := handle.m.shard(handle.shared.key)
+	shard.lock.Lock()
+	defer shard.lock.Unlock()
 
 	handle.shared.handlesLock.Lock()
 	defer handle.shared.handlesLock.Unlock()
 
-	delete(handle.shared.handles, handle)
-
-	if len(handle.shared.handles) == 0 {
-		delete(handle.m.handles, handle.shared.key)
-		if handle.m.ExternalUnsubscribe != nil {
-			handle.m.ExternalUnsubscribe(handle.shared.key)
-		}
+	handle.shared.removeHandle(handle)
+	handle.m.trace(TraceEvent{
+		Kind:   TraceClose,
+		Key:    handle.key,
+		Handle: handle.id,
+	})
+
+	// The key might be already reused by another sharedHandle if
+	// the mailbox was destroyed or its sessions were closed.
+	if len(handle.shared.handles) == 0 && shard.handles[handle.shared.key] == handle.shared {
+		delete(shard.handles, handle.shared.key)
+		handle.m.unsubscribe(handle.shared.key)
 	}
 
 	return nil
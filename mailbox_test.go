@@ -0,0 +1,42 @@
+package mess
+
+import (
+	"math"
+	"testing"
+
+	"github.com/emersion/go-imap/backend"
+)
+
+func TestSyncExpungePending(t *testing.T) {
+	m := NewManager()
+	hndl, conn := openTestHandle(m, "INBOX", 1)
+	defer hndl.Close()
+
+	m.NewMessage("INBOX", math.MaxUint32)
+	hndl.Removed(1)
+	hndl.Removed(math.MaxUint32)
+
+	// Message not announced yet is expunged by the following call.
+	hndl.Sync(true)
+	upds := conn.take()
+	if len(upds) != 3 || upds[0].(*backend.ExpungeUpdate).SeqNum != 1 {
+		t.Fatal("Expected EXPUNGE, EXISTS and RECENT, got", upds)
+	}
+	hndl.lock.RLock()
+	pending := hndl.pendingExpunge.String()
+	hndl.lock.RUnlock()
+	if pending != "4294967295" {
+		t.Fatal("Expected only the new message to stay pending, got", pending)
+	}
+
+	hndl.Sync(true)
+	if upds := conn.take(); len(upds) != 1 || upds[0].(*backend.ExpungeUpdate).SeqNum != 1 {
+		t.Fatal("Expected EXPUNGE, got", upds)
+	}
+	hndl.lock.RLock()
+	empty := hndl.pendingExpunge.Empty()
+	hndl.lock.RUnlock()
+	if !empty {
+		t.Fatal("pendingExpunge is not cleared")
+	}
+}
@@ -1,10 +1,12 @@
 package main
 
 import (
+	"context"
 	"fmt"
 	"net"
 	"os"
 	"os/signal"
+	"time"
 
 	"github.com/emersion/go-imap/server"
 	"github.com/foxcpp/go-imap-mess/memory"
@@ -19,8 +21,8 @@ func main() {
 
 	endpoint := os.Args[1]
 
-	srv := server.New(memory.New())
-	defer srv.Close()
+	be := memory.New()
+	srv := server.New(be)
 
 	srv.AllowInsecureAuth = true
 
@@ -40,4 +42,13 @@ func main() {
 	signal.Notify(sig, os.Interrupt)
 
 	<-sig
+
+	// Pending updates are flushed while connections are still open.
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := be.Manager().Shutdown(ctx); err != nil {
+		fmt.Fprintf(os.Stderr, "%v\n", err)
+	}
+
+	srv.Close()
 }
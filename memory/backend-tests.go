@@ -9,7 +9,7 @@ func (b *Backend) GetUser(username string) (backend.User, error) {
 	if usr == nil {
 		return nil, backend.ErrInvalidCredentials
 	}
-	return usr, nil
+	return usr.forBackend(b), nil
 }
 
 func (b *Backend) CreateUser(name string) error {
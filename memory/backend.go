@@ -13,17 +13,37 @@ import (
 type Backend struct {
 	users   map[string]*User
 	manager *sequpdate.Manager
+
+	// Keywords enables keyword tracking, sessions are sent untagged FLAGS
+	// once a new keyword is used in the mailbox. See
+	// sequpdate.KeywordsMailbox.
+	Keywords bool
 }
 
 func (be *Backend) Login(_ *imap.ConnInfo, username, password string) (backend.User, error) {
 	user, ok := be.users[username]
 	if ok && user.password == password {
-		return user, nil
+		return user.forBackend(be), nil
 	}
 
 	return nil, errors.New("Bad username or password")
 }
 
+// Manager returns the update manager used by the backend.
+func (be *Backend) Manager() *sequpdate.Manager {
+	return be.manager
+}
+
+// NewNode returns a Backend that shares the storage with be but uses mngr
+// for update dispatching, as if it was another server in a cluster.
+func (be *Backend) NewNode(mngr *sequpdate.Manager) *Backend {
+	return &Backend{
+		users:    be.users,
+		manager:  mngr,
+		Keywords: be.Keywords,
+	}
+}
+
 func New() *Backend {
 	mngr := sequpdate.NewManager()
 	user := &User{
@@ -1,9 +1,11 @@
 package memory
 
 import (
+	"sort"
 	"strings"
 	"sync"
 	"sync/atomic"
+	"time"
 
 	"github.com/emersion/go-imap"
 	"github.com/emersion/go-imap/backend"
@@ -27,9 +29,13 @@ type Mailbox struct {
 
 type SelectedMailbox struct {
 	*Mailbox
-	conn     backend.Conn
-	readOnly bool
-	handle   *sequpdate.MailboxHandle
+	// session is the User the mailbox was selected by, it may use a
+	// different Manager than mbox.user (see Backend.NewNode).
+	session    *User
+	readOnly   bool
+	selectedAt time.Time
+
+	sequpdate.Selected
 }
 
 func (mbox *Mailbox) Name() string {
@@ -59,8 +65,24 @@ func (mbox *Mailbox) uidNext() uint32 {
 	return atomic.AddUint32(&mbox.lastUid, 1)
 }
 
-func (mbox *SelectedMailbox) Conn() backend.Conn {
-	return mbox.conn
+func (mbox *SelectedMailbox) SessionInfo() sequpdate.SessionInfo {
+	return sequpdate.SessionInfo{
+		Username:   mbox.user.username,
+		ReadOnly:   mbox.readOnly,
+		SelectedAt: mbox.selectedAt,
+	}
+}
+
+// keywordsMailbox is passed to the Manager instead of SelectedMailbox if
+// keyword tracking is enabled (see Backend.Keywords).
+type keywordsMailbox struct {
+	*SelectedMailbox
+}
+
+// Keywords implements sequpdate.KeywordsMailbox, new keywords can be
+// created by clients.
+func (mbox keywordsMailbox) Keywords() ([]string, bool) {
+	return mbox.flags(), true
 }
 
 func (mbox *Mailbox) flags() []string {
@@ -83,6 +105,20 @@ func (mbox *Mailbox) flags() []string {
 	return flags
 }
 
+// messageByUid returns the message with the specified UID or nil if there is
+// no such message.
+//
+// MessagesLock should be held.
+func (mbox *Mailbox) messageByUid(uid uint32) *Message {
+	i := sort.Search(len(mbox.Messages), func(i int) bool {
+		return mbox.Messages[i].Uid >= uid
+	})
+	if i == len(mbox.Messages) || mbox.Messages[i].Uid != uid {
+		return nil
+	}
+	return mbox.Messages[i]
+}
+
 func (mbox *Mailbox) unseenSeqNum() uint32 {
 	mbox.MessagesLock.RLock()
 	defer mbox.MessagesLock.RUnlock()
@@ -105,15 +141,6 @@ func (mbox *Mailbox) unseenSeqNum() uint32 {
 	return 0
 }
 
-func (mbox *SelectedMailbox) Poll(expunge bool) error {
-	mbox.handle.Sync(expunge)
-	return nil
-}
-
-func (mbox *SelectedMailbox) Idle(done <-chan struct{}) {
-	mbox.handle.Idle(done)
-}
-
 func (mbox *SelectedMailbox) ListMessages(uid bool, seqSet *imap.SeqSet, items []imap.FetchItem, ch chan<- *imap.Message) error {
 	shouldSetSeen := false
 	for _, item := range items {
@@ -134,25 +161,15 @@ func (mbox *SelectedMailbox) ListMessages(uid bool, seqSet *imap.SeqSet, items [
 		defer mbox.MessagesLock.RUnlock()
 	}
 
-	defer mbox.handle.Sync(false)
+	defer mbox.Command(sequpdate.CommandFor(uid))()
 	defer close(ch)
 
-	seqSet, err := mbox.handle.ResolveSeq(uid, seqSet)
-	if err != nil {
-		if uid {
-			return nil
-		}
-		return err
-	}
-
-	for _, msg := range mbox.Messages {
-		if !seqSet.Contains(msg.Uid) {
-			continue
-		}
-
-		seq, ok := mbox.handle.UidAsSeq(msg.Uid)
-		if !ok {
-			continue
+	view := mbox.Handle.View()
+	err := view.ForEach(uid, seqSet, func(seq, msgUid uint32) bool {
+		msg := mbox.messageByUid(msgUid)
+		if msg == nil {
+			// Expunged in another session.
+			return true
 		}
 
 		if shouldSetSeen {
@@ -164,16 +181,26 @@ func (mbox *SelectedMailbox) ListMessages(uid bool, seqSet *imap.SeqSet, items [
 			}
 			if !hasSeen {
 				msg.Flags = append(msg.Flags, imap.SeenFlag)
+				mbox.Handle.FlagsChanged(msg.Uid, msg.Flags, false)
 			}
-			mbox.handle.FlagsChanged(msg.Uid, msg.Flags, false)
 		}
 
-		m, err := msg.Fetch(seq, items, mbox.handle.IsRecent(msg.Uid))
+		m, err := msg.Fetch(seq, items, view.IsRecent(msg.Uid))
 		if err != nil {
-			continue
+			return true
+		}
+		if _, ok := m.Items[imap.FetchFlags]; ok {
+			mbox.Handle.FlagsSeen(msg.Uid, m.Flags)
 		}
 
 		ch <- m
+		return true
+	})
+	if err != nil {
+		if uid && err == sequpdate.ErrNoMessages {
+			return nil
+		}
+		return err
 	}
 
 	return nil
@@ -183,18 +210,19 @@ func (mbox *SelectedMailbox) SearchMessages(uid bool, criteria *imap.SearchCrite
 	mbox.MessagesLock.RLock()
 	defer mbox.MessagesLock.RUnlock()
 
-	mbox.handle.ResolveCriteria(criteria)
+	view := mbox.Handle.View()
+	view.ResolveCriteria(criteria)
 
-	defer mbox.handle.Sync(uid)
+	defer mbox.Command(sequpdate.CommandFor(uid))()
 
 	var ids []uint32
 	for _, msg := range mbox.Messages {
-		seq, ok := mbox.handle.UidAsSeq(msg.Uid)
+		seq, ok := view.UidAsSeq(msg.Uid)
 		if !ok {
 			continue
 		}
 
-		ok, err := msg.Match(seq, criteria, mbox.handle.IsRecent(msg.Uid))
+		ok, err := msg.Match(seq, criteria, view.IsRecent(msg.Uid))
 		if err != nil || !ok {
 			continue
 		}
@@ -211,38 +239,21 @@ func (mbox *SelectedMailbox) SearchMessages(uid bool, criteria *imap.SearchCrite
 }
 
 func (mbox *SelectedMailbox) UpdateMessagesFlags(uid bool, seqset *imap.SeqSet, op imap.FlagsOp, silent bool, flags []string) error {
-	newFlags := flags[:0]
-	for _, f := range flags {
-		if f == imap.RecentFlag {
-			continue
-		}
-		newFlags = append(newFlags, f)
-	}
-	flags = newFlags
-
 	mbox.MessagesLock.RLock()
 	defer mbox.MessagesLock.RUnlock()
 
-	defer mbox.handle.Sync(uid)
+	return mbox.StoreFlags(uid, seqset, op, silent, flags, func(uids *imap.SeqSet, op imap.FlagsOp, flags []string) (map[uint32][]string, error) {
+		newFlags := make(map[uint32][]string)
+		for _, msg := range mbox.Messages {
+			if !uids.Contains(msg.Uid) {
+				continue
+			}
 
-	seqset, err := mbox.handle.ResolveSeq(uid, seqset)
-	if err != nil {
-		if uid {
-			return nil
+			msg.Flags = backendutil.UpdateFlags(msg.Flags, op, flags)
+			newFlags[msg.Uid] = msg.Flags
 		}
-		return err
-	}
-
-	for _, msg := range mbox.Messages {
-		if !seqset.Contains(msg.Uid) {
-			continue
-		}
-
-		msg.Flags = backendutil.UpdateFlags(msg.Flags, op, flags)
-		mbox.handle.FlagsChanged(msg.Uid, msg.Flags, silent)
-	}
-
-	return nil
+		return newFlags, nil
+	})
 }
 
 func (mbox *SelectedMailbox) CopyMessages(uid bool, seqset *imap.SeqSet, destName string) error {
@@ -250,43 +261,47 @@ func (mbox *SelectedMailbox) CopyMessages(uid bool, seqset *imap.SeqSet, destNam
 	if !ok {
 		return backend.ErrNoSuchMailbox
 	}
-	destKey := mbox.user.username + "\x00" + destName
+	destKey := mbox.user.key(destName)
 
 	mbox.MessagesLock.RLock()
 	defer mbox.MessagesLock.RUnlock()
 
-	defer mbox.handle.Sync(true)
+	defer mbox.Command(sequpdate.CmdUid)()
 
 	dest.MessagesLock.Lock()
 	defer dest.MessagesLock.Unlock()
 
-	seqset, err := mbox.handle.ResolveSeq(uid, seqset)
-	if err != nil {
-		if uid {
-			return nil
-		}
+	seqset, err := mbox.Resolve(uid, seqset)
+	if err != nil || seqset == nil {
 		return err
 	}
 
+	var flags []string
 	for _, msg := range mbox.Messages {
 		if !seqset.Contains(msg.Uid) {
 			continue
 		}
+		flags = append(flags, msg.Flags...)
 
 		msgCopy := *msg
 		msgCopy.Uid = dest.uidNext()
 
-		if mbox.user.mngr.NewMessage(destKey, msgCopy.Uid) {
+		if storeRecent, _ := mbox.session.mngr.NewMessage(destKey, msgCopy.Uid); storeRecent {
 			msgCopy.Recent = true
 		}
 
 		dest.Messages = append(dest.Messages, &msgCopy)
 	}
 
+	if mbox.session.keywords {
+		mbox.session.mngr.KeywordsAdded(destKey, flags)
+	}
 	return nil
 }
 
 func (mbox *SelectedMailbox) Expunge() error {
+	defer mbox.Command(sequpdate.CmdUid)()
+
 	mbox.MessagesLock.Lock()
 	defer mbox.MessagesLock.Unlock()
 
@@ -303,15 +318,9 @@ func (mbox *SelectedMailbox) Expunge() error {
 
 		if deleted {
 			mbox.Messages = append(mbox.Messages[:i], mbox.Messages[i+1:]...)
-			mbox.handle.Removed(msg.Uid)
+			mbox.Handle.Removed(msg.Uid)
 		}
 	}
 
-	mbox.handle.Sync(true)
-
 	return nil
 }
-
-func (mbox *SelectedMailbox) Close() error {
-	return mbox.handle.Close()
-}
@@ -18,6 +18,23 @@ type User struct {
 	password  string
 	mailboxes map[string]*Mailbox
 	mngr      *sequpdate.Manager
+	keywords  bool
+}
+
+// forBackend returns the User that shares the storage with u but uses
+// the Manager and settings of be.
+func (u *User) forBackend(be *Backend) *User {
+	if u.mngr == be.manager && u.keywords == be.Keywords {
+		return u
+	}
+	uCopy := *u
+	uCopy.mngr = be.manager
+	uCopy.keywords = be.Keywords
+	return &uCopy
+}
+
+func (u *User) key(mbox string) sequpdate.MailboxKey {
+	return sequpdate.MailboxKey{Account: u.username, MailboxID: mbox}
 }
 
 func (u *User) Username() string {
@@ -68,16 +85,18 @@ func (u *User) GetMailbox(name string, readOnly bool, conn backend.Conn) (*imap.
 	mailbox.MessagesLock.Unlock()
 
 	selected := &SelectedMailbox{
-		Mailbox:  mailbox,
-		conn:     conn,
-		readOnly: readOnly,
+		Mailbox:    mailbox,
+		session:    u,
+		readOnly:   readOnly,
+		selectedAt: time.Now(),
 	}
-
-	handle, err := u.mngr.Mailbox(u.username+"\x00"+name, selected, uids, &recent)
-	if err != nil {
+	var mbox sequpdate.Mailbox = selected
+	if u.keywords {
+		mbox = keywordsMailbox{selected}
+	}
+	if err := selected.Open(u.mngr, u.key(name), conn, mbox, uids, &recent); err != nil {
 		return nil, nil, err
 	}
-	selected.handle = handle
 
 	return status, selected, nil
 }
@@ -164,9 +183,12 @@ func (u *User) CreateMessage(mboxName string, flags []string, date time.Time, bo
 	}
 	mbox.Messages = append(mbox.Messages, msg)
 
-	if u.mngr.NewMessage(u.username+"\x00"+mboxName, msg.Uid) {
+	if storeRecent, _ := u.mngr.NewMessage(u.key(mboxName), msg.Uid); storeRecent {
 		msg.Recent = true
 	}
+	if u.keywords {
+		u.mngr.KeywordsAdded(u.key(mboxName), flags)
+	}
 	return nil
 }
 
@@ -206,7 +228,7 @@ func (u *User) DeleteMailbox(name string) error {
 
 	delete(u.mailboxes, name)
 
-	u.mngr.MailboxDestroyed(u.username + "\x00" + name)
+	u.mngr.MailboxDestroyed(u.key(name))
 
 	return nil
 }
@@ -225,7 +247,7 @@ func (u *User) RenameMailbox(existingName, newName string) error {
 				Messages: mbox.Messages,
 				user:     u,
 			}
-			u.mngr.MailboxDestroyed(u.username + "\x00" + mbox.name)
+			u.mngr.MailboxDestroyed(u.key(mbox.name))
 		}
 	}
 
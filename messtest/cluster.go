@@ -0,0 +1,272 @@
+package messtest
+
+import (
+	"math/rand"
+	"sort"
+
+	mess "github.com/foxcpp/go-imap-mess"
+	"github.com/foxcpp/go-imap-mess/memory"
+)
+
+// sinkSize is the buffer size of the node sink. Updates are moved to an
+// unbounded queue as they arrive, so it only reduces context switches.
+const sinkSize = 64
+
+// maxSettleSteps bounds Settle in case of a bus that never drains.
+const maxSettleSteps = 100000
+
+// BusOptions control faults injected by the Cluster bus. Zero value is a
+// reliable bus that delivers updates in order on the next Step.
+type BusOptions struct {
+	// Seed for the random number generator used for fault injection.
+	Seed int64
+
+	// MaxDelay is the maximum number of steps an update spends in flight
+	// in addition to the first one.
+	MaxDelay int
+
+	// Reorder allows updates sent from one node to another to be delivered
+	// in a different order. Updates due at the same step are shuffled,
+	// with MaxDelay they can also overtake each other across steps. Without
+	// it, delays preserve the order.
+	Reorder bool
+
+	// DupRate and LossRate are probabilities (0 to 1) of each delivery being
+	// duplicated or lost.
+	DupRate  float64
+	LossRate float64
+}
+
+// Node is a single Manager in the Cluster.
+type Node struct {
+	ID      int
+	Manager *mess.Manager
+
+	// Backend is set for clusters created using NewMemoryCluster. All
+	// backends share the same storage.
+	Backend *memory.Backend
+
+	sink  chan mess.Update
+	flush chan chan []mess.Update
+	done  chan struct{}
+	// queue is accessed by forward until done is closed.
+	queue []mess.Update
+}
+
+// forward moves updates from the sink to the queue so the Manager never
+// blocks on the sink between Step calls. It is the only reader of the sink,
+// so the order is preserved.
+func (n *Node) forward() {
+	defer close(n.done)
+	for {
+		select {
+		case upd, ok := <-n.sink:
+			if !ok {
+				return
+			}
+			n.queue = append(n.queue, upd)
+		case reply := <-n.flush:
+			for drained := false; !drained; {
+				select {
+				case upd, ok := <-n.sink:
+					if !ok {
+						reply <- n.queue
+						n.queue = nil
+						return
+					}
+					n.queue = append(n.queue, upd)
+				default:
+					drained = true
+				}
+			}
+			reply <- n.queue
+			n.queue = nil
+		}
+	}
+}
+
+// take returns updates generated by the node since the last call.
+func (n *Node) take() []mess.Update {
+	reply := make(chan []mess.Update, 1)
+	select {
+	case n.flush <- reply:
+		return <-reply
+	case <-n.done:
+		// Sink is closed by Shutdown.
+		queue := n.queue
+		n.queue = nil
+		return queue
+	}
+}
+
+type delivery struct {
+	at  int
+	seq int
+	to  *Node
+	upd mess.Update
+}
+
+// Cluster is a set of Managers connected by an in-memory bus using
+// SetExternalSink and ExternalUpdate.
+//
+// Updates are delivered only by Step and Settle, so scenarios are
+// deterministic for the same BusOptions. Cluster is not safe for concurrent
+// use, but operations on nodes can be performed from other goroutines between
+// the Step calls.
+type Cluster struct {
+	Nodes []*Node
+
+	// Errors contains all errors returned by ExternalUpdate.
+	Errors []error
+
+	// Statistics.
+	Delivered, Dropped, Duplicated int
+
+	opts     BusOptions
+	rng      *rand.Rand
+	now      int
+	seq      int
+	inflight []delivery
+	lastAt   map[[2]int]int
+}
+
+// NewCluster creates the cluster of n fresh Managers.
+func NewCluster(n int, opts BusOptions) *Cluster {
+	nodes := make([]*Node, 0, n)
+	for i := 0; i < n; i++ {
+		nodes = append(nodes, &Node{ID: i, Manager: mess.NewManager()})
+	}
+	return newCluster(nodes, opts)
+}
+
+// NewMemoryCluster creates the cluster of n memory backends sharing the same
+// storage, each with its own Manager.
+func NewMemoryCluster(n int, opts BusOptions) *Cluster {
+	be := memory.New()
+	nodes := make([]*Node, 0, n)
+	for i := 0; i < n; i++ {
+		nodeBe := be
+		if i != 0 {
+			nodeBe = be.NewNode(mess.NewManager())
+		}
+		nodes = append(nodes, &Node{
+			ID:      i,
+			Manager: nodeBe.Manager(),
+			Backend: nodeBe,
+		})
+	}
+	return newCluster(nodes, opts)
+}
+
+func newCluster(nodes []*Node, opts BusOptions) *Cluster {
+	for _, node := range nodes {
+		node.sink = make(chan mess.Update, sinkSize)
+		node.flush = make(chan chan []mess.Update)
+		node.done = make(chan struct{})
+		node.Manager.SetExternalSink(node.sink)
+		go node.forward()
+	}
+	return &Cluster{
+		Nodes:  nodes,
+		opts:   opts,
+		rng:    rand.New(rand.NewSource(opts.Seed)),
+		lastAt: map[[2]int]int{},
+	}
+}
+
+// collect moves updates generated by nodes to the bus.
+func (c *Cluster) collect() {
+	for _, from := range c.Nodes {
+		for _, upd := range from.take() {
+			for _, to := range c.Nodes {
+				if to == from {
+					continue
+				}
+				c.send(from, to, upd)
+			}
+		}
+	}
+}
+
+func (c *Cluster) send(from, to *Node, upd mess.Update) {
+	if c.opts.LossRate != 0 && c.rng.Float64() < c.opts.LossRate {
+		c.Dropped++
+		return
+	}
+	copies := 1
+	if c.opts.DupRate != 0 && c.rng.Float64() < c.opts.DupRate {
+		c.Duplicated++
+		copies = 2
+	}
+
+	for i := 0; i < copies; i++ {
+		at := c.now + 1
+		if c.opts.MaxDelay != 0 {
+			at += c.rng.Intn(c.opts.MaxDelay + 1)
+		}
+		link := [2]int{from.ID, to.ID}
+		if !c.opts.Reorder && at < c.lastAt[link] {
+			at = c.lastAt[link]
+		}
+		c.lastAt[link] = at
+
+		c.seq++
+		c.inflight = append(c.inflight, delivery{at: at, seq: c.seq, to: to, upd: upd})
+	}
+}
+
+// Step advances the bus clock and delivers all updates that are due. It
+// returns the number of delivered updates.
+func (c *Cluster) Step() int {
+	c.collect()
+	c.now++
+
+	var due, rest []delivery
+	for _, d := range c.inflight {
+		if d.at <= c.now {
+			due = append(due, d)
+		} else {
+			rest = append(rest, d)
+		}
+	}
+	c.inflight = rest
+
+	if c.opts.Reorder {
+		c.rng.Shuffle(len(due), func(i, j int) {
+			due[i], due[j] = due[j], due[i]
+		})
+	} else {
+		sort.Slice(due, func(i, j int) bool {
+			if due[i].at != due[j].at {
+				return due[i].at < due[j].at
+			}
+			return due[i].seq < due[j].seq
+		})
+	}
+	for _, d := range due {
+		if err := d.to.Manager.ExternalUpdate(d.upd); err != nil {
+			c.Errors = append(c.Errors, err)
+		}
+		c.Delivered++
+	}
+
+	return len(due)
+}
+
+// InFlight returns the number of updates sent but not delivered yet.
+func (c *Cluster) InFlight() int {
+	c.collect()
+	return len(c.inflight)
+}
+
+// Settle calls Step until all updates are delivered. It returns false if the
+// bus did not drain after a large number of steps.
+func (c *Cluster) Settle() bool {
+	for i := 0; i < maxSettleSteps; i++ {
+		if c.InFlight() == 0 {
+			return true
+		}
+		c.Step()
+	}
+	return false
+}
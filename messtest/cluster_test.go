@@ -0,0 +1,187 @@
+package messtest
+
+import (
+	"bytes"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/emersion/go-imap"
+	"github.com/emersion/go-imap/backend"
+	mess "github.com/foxcpp/go-imap-mess"
+)
+
+func TestClusterAppendIdle(t *testing.T) {
+	c := NewMemoryCluster(2, BusOptions{})
+
+	login := func(node *Node) backend.User {
+		u, err := node.Backend.Login(nil, "username", "password")
+		if err != nil {
+			t.Fatal(err)
+		}
+		return u
+	}
+	userA, userB := login(c.Nodes[0]), login(c.Nodes[1])
+
+	conn := &FakeConn{}
+	_, mboxB, err := userB.GetMailbox("INBOX", false, conn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer mboxB.Close()
+
+	done := make(chan struct{})
+	idleDone := make(chan struct{})
+	go func() {
+		mboxB.Idle(done)
+		close(idleDone)
+	}()
+
+	body := bytes.NewReader([]byte("Subject: Test\r\n\r\nHello"))
+	if err := userA.CreateMessage("INBOX", nil, time.Now(), body, nil); err != nil {
+		t.Fatal(err)
+	}
+	if c.InFlight() != 1 {
+		t.Fatalf("Expected 1 update in flight, got %d", c.InFlight())
+	}
+	if !c.Settle() {
+		t.Fatal("Bus did not settle")
+	}
+
+	if !conn.Wait(2, 5*time.Second) {
+		t.Fatalf("Expected EXISTS and RECENT, got %v", conn.Updates())
+	}
+	close(done)
+	<-idleDone
+
+	s := &Session{T: t, Conn: conn}
+	s.ExpectExists(2)
+	s.ExpectRecent(1)
+	s.ExpectNone()
+
+	if len(c.Errors) != 0 {
+		t.Fatal("Unexpected errors:", c.Errors)
+	}
+}
+
+func TestClusterDelay(t *testing.T) {
+	c := NewCluster(2, BusOptions{MaxDelay: 5, Seed: 1})
+
+	s := Open(t, c.Nodes[1].Manager, "INBOX", []uint32{1}, nil)
+	defer s.Close()
+
+	for uid := uint32(2); uid <= 10; uid++ {
+		c.Nodes[0].Manager.NewMessage("INBOX", uid)
+	}
+	// Without Reorder updates must arrive in order, otherwise sync below would
+	// report less messages.
+	if !c.Settle() {
+		t.Fatal("Bus did not settle")
+	}
+	s.Sync(true)
+	s.ExpectExists(10)
+	s.ExpectRecent(9)
+	s.ExpectNone()
+	if c.Delivered != 9 {
+		t.Fatalf("Expected 9 deliveries, got %d", c.Delivered)
+	}
+}
+
+// runFaulty runs the same scenario with the faulty bus and returns the
+// summary of the bus state.
+func runFaulty(t *testing.T, seed int64) string {
+	c := NewCluster(3, BusOptions{
+		Seed:     seed,
+		MaxDelay: 3,
+		Reorder:  true,
+		DupRate:  0.2,
+		LossRate: 0.2,
+	})
+
+	var handles []*mess.MailboxHandle
+	for _, node := range c.Nodes[1:] {
+		handles = append(handles, Open(t, node.Manager, "INBOX", []uint32{1}, nil).Handle)
+	}
+	mngmt := c.Nodes[0].Manager.ManagementHandle("INBOX", []uint32{1}, nil)
+	defer mngmt.Close()
+	for uid := uint32(2); uid <= 20; uid++ {
+		c.Nodes[0].Manager.NewMessage("INBOX", uid)
+		mngmt.FlagsChanged(uid, []string{imap.SeenFlag}, false)
+		c.Step()
+	}
+	if !c.Settle() {
+		t.Fatal("Bus did not settle")
+	}
+
+	for _, h := range handles {
+		h.Sync(true)
+		h.Close()
+	}
+	return fmt.Sprintf("%d/%d/%d/%d", c.Delivered, c.Dropped, c.Duplicated, len(c.Errors))
+}
+
+func TestClusterFaultsDeterministic(t *testing.T) {
+	first := runFaulty(t, 42)
+	if second := runFaulty(t, 42); first != second {
+		t.Fatalf("Same seed produced different results: %s and %s", first, second)
+	}
+
+	var dropped, dups int
+	if _, err := fmt.Sscanf(first, "%d/%d/%d", new(int), &dropped, &dups); err != nil {
+		t.Fatal(err)
+	}
+	if dropped == 0 || dups == 0 {
+		t.Fatalf("Expected some faults to be injected, got %s", first)
+	}
+}
+
+func TestClusterReorder(t *testing.T) {
+	c := NewCluster(2, BusOptions{Reorder: true, Seed: 1})
+
+	key := mess.MailboxKey{Account: "u", MailboxID: "INBOX"}
+	upds := make(chan mess.Update, 20)
+	defer c.Nodes[1].Manager.SubscribeAccount("u", upds)()
+
+	for uid := 1; uid <= 20; uid++ {
+		c.Nodes[0].Manager.NewMessage(key, uint32(uid))
+	}
+	// All updates are due at the same step without MaxDelay.
+	if delivered := c.Step(); delivered != 20 {
+		t.Fatalf("Expected 20 deliveries, got %d", delivered)
+	}
+
+	ordered := true
+	for i := 1; i <= 20; i++ {
+		if upd := <-upds; upd.SeqSet != fmt.Sprint(i) {
+			ordered = false
+		}
+	}
+	if ordered {
+		t.Fatal("Updates were not reordered")
+	}
+}
+
+func TestClusterManyUpdates(t *testing.T) {
+	c := NewCluster(2, BusOptions{})
+
+	const count = 100000
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for uid := uint32(1); uid <= count; uid++ {
+			c.Nodes[0].Manager.NewMessage("INBOX", uid)
+		}
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Node blocked on the sink between Step calls")
+	}
+
+	if !c.Settle() {
+		t.Fatal("Bus did not settle")
+	}
+	if c.Delivered != count {
+		t.Fatalf("Expected %d deliveries, got %d", count, c.Delivered)
+	}
+}
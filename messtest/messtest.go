@@ -0,0 +1,282 @@
+// Package messtest provides utilities for testing backends that use
+// go-imap-mess without a real IMAP server.
+package messtest
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/emersion/go-imap"
+	"github.com/emersion/go-imap/backend"
+	mess "github.com/foxcpp/go-imap-mess"
+)
+
+// FakeConn is a backend.Conn that records all updates sent to it.
+type FakeConn struct {
+	lock    sync.Mutex
+	updates []backend.Update
+	changed chan struct{}
+}
+
+func (c *FakeConn) SendUpdate(upd backend.Update) error {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.updates = append(c.updates, upd)
+	if c.changed != nil {
+		close(c.changed)
+		c.changed = nil
+	}
+	return nil
+}
+
+// Wait waits until at least n updates are recorded and reports whether
+// they were recorded before timeout expired. It is meant to be used with
+// updates sent from other goroutines, e.g. by MailboxHandle.Idle.
+func (c *FakeConn) Wait(n int, timeout time.Duration) bool {
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+
+	for {
+		c.lock.Lock()
+		if len(c.updates) >= n {
+			c.lock.Unlock()
+			return true
+		}
+		if c.changed == nil {
+			c.changed = make(chan struct{})
+		}
+		changed := c.changed
+		c.lock.Unlock()
+
+		select {
+		case <-changed:
+		case <-timer.C:
+			c.lock.Lock()
+			defer c.lock.Unlock()
+			return len(c.updates) >= n
+		}
+	}
+}
+
+// Updates returns all updates recorded since the last Take call.
+func (c *FakeConn) Updates() []backend.Update {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return append([]backend.Update(nil), c.updates...)
+}
+
+// Take returns recorded updates and removes them from the connection.
+func (c *FakeConn) Take() []backend.Update {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	upds := c.updates
+	c.updates = nil
+	return upds
+}
+
+// Mailbox is a mess.Mailbox that returns the specified connection. Other
+// backend.Mailbox methods panic.
+type Mailbox struct {
+	backend.Mailbox
+	FakeConn *FakeConn
+	Session  mess.SessionInfo
+}
+
+func (mbox Mailbox) Conn() backend.Conn {
+	return mbox.FakeConn
+}
+
+func (mbox Mailbox) SessionInfo() mess.SessionInfo {
+	return mbox.Session
+}
+
+// Session is a handle opened with a FakeConn. Expect* methods check the
+// updates sent to the connection in the order they were sent, each matched
+// update is consumed.
+type Session struct {
+	T      testing.TB
+	Handle *mess.MailboxHandle
+	Conn   *FakeConn
+
+	queue []backend.Update
+}
+
+// Open creates a handle for the key backed by a new FakeConn. The test is
+// failed if Manager.Mailbox returns an error.
+func Open(t testing.TB, m *mess.Manager, key interface{}, uids []uint32, recent *imap.SeqSet) *Session {
+	t.Helper()
+
+	conn := &FakeConn{}
+	handle, err := m.Mailbox(key, Mailbox{FakeConn: conn}, uids, recent)
+	if err != nil {
+		t.Fatalf("Mailbox(%v): %v", key, err)
+	}
+	return &Session{T: t, Handle: handle, Conn: conn}
+}
+
+// OpenN opens n sessions for the key with the same list of messages.
+func OpenN(t testing.TB, m *mess.Manager, key interface{}, n int, uids ...uint32) []*Session {
+	t.Helper()
+
+	sessions := make([]*Session, 0, n)
+	for i := 0; i < n; i++ {
+		uidsCopy := append([]uint32(nil), uids...)
+		sessions = append(sessions, Open(t, m, key, uidsCopy, nil))
+	}
+	return sessions
+}
+
+// Sync is a shorthand for s.Handle.Sync.
+func (s *Session) Sync(expunge bool) {
+	s.Handle.Sync(expunge)
+}
+
+// Close closes the handle.
+func (s *Session) Close() {
+	s.T.Helper()
+	if err := s.Handle.Close(); err != nil {
+		s.T.Errorf("Close: %v", err)
+	}
+}
+
+func (s *Session) next(expected string) backend.Update {
+	s.T.Helper()
+
+	s.queue = append(s.queue, s.Conn.Take()...)
+	if len(s.queue) == 0 {
+		s.T.Fatalf("Expected %s, got nothing", expected)
+	}
+	upd := s.queue[0]
+	s.queue = s.queue[1:]
+	return upd
+}
+
+func (s *Session) nextStatus(item imap.StatusItem, expected string) *imap.MailboxStatus {
+	s.T.Helper()
+
+	upd := s.next(expected)
+	mboxUpd, ok := upd.(*backend.MailboxUpdate)
+	if !ok {
+		s.T.Fatalf("Expected %s, got %s", expected, Describe(upd))
+	}
+	if _, ok := mboxUpd.Items[item]; !ok {
+		s.T.Fatalf("Expected %s, got %s", expected, Describe(upd))
+	}
+	return mboxUpd.MailboxStatus
+}
+
+// ExpectExists checks that the next update is EXISTS with the specified
+// number of messages.
+func (s *Session) ExpectExists(n uint32) {
+	s.T.Helper()
+	if status := s.nextStatus(imap.StatusMessages, "EXISTS"); status.Messages != n {
+		s.T.Fatalf("Expected %d EXISTS, got %d EXISTS", n, status.Messages)
+	}
+}
+
+// ExpectRecent checks that the next update is RECENT with the specified
+// number of messages.
+func (s *Session) ExpectRecent(n uint32) {
+	s.T.Helper()
+	if status := s.nextStatus(imap.StatusRecent, "RECENT"); status.Recent != n {
+		s.T.Fatalf("Expected %d RECENT, got %d RECENT", n, status.Recent)
+	}
+}
+
+// ExpectExpunge checks that the next updates are EXPUNGE responses for the
+// specified sequence numbers in that order.
+func (s *Session) ExpectExpunge(seq ...uint32) {
+	s.T.Helper()
+	for _, seqNum := range seq {
+		upd := s.next("EXPUNGE")
+		expunge, ok := upd.(*backend.ExpungeUpdate)
+		if !ok || expunge.SeqNum != seqNum {
+			s.T.Fatalf("Expected %d EXPUNGE, got %s", seqNum, Describe(upd))
+		}
+	}
+}
+
+// ExpectFetchFlags checks that the next update is FETCH FLAGS for the
+// specified sequence number. Order of flags is not significant.
+func (s *Session) ExpectFetchFlags(seq uint32, flags ...string) {
+	s.T.Helper()
+
+	upd := s.next("FETCH")
+	msgUpd, ok := upd.(*backend.MessageUpdate)
+	if !ok || msgUpd.SeqNum != seq {
+		s.T.Fatalf("Expected %d FETCH, got %s", seq, Describe(upd))
+	}
+	if !sameFlags(msgUpd.Flags, flags) {
+		s.T.Fatalf("Expected %d FETCH (FLAGS %v), got %s", seq, flags, Describe(upd))
+	}
+}
+
+// ExpectBye checks that the next update is the BYE response.
+func (s *Session) ExpectBye() {
+	s.T.Helper()
+
+	upd := s.next("BYE")
+	status, ok := upd.(*backend.StatusUpdate)
+	if !ok || status.Type != imap.StatusRespBye {
+		s.T.Fatalf("Expected BYE, got %s", Describe(upd))
+	}
+}
+
+// ExpectNone checks that no more updates were sent.
+func (s *Session) ExpectNone() {
+	s.T.Helper()
+
+	s.queue = append(s.queue, s.Conn.Take()...)
+	if len(s.queue) != 0 {
+		s.T.Fatalf("Expected no updates, got %s", Describe(s.queue[0]))
+	}
+}
+
+func sameFlags(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	a = append([]string(nil), a...)
+	b = append([]string(nil), b...)
+	sort.Strings(a)
+	sort.Strings(b)
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// Describe returns the human-readable representation of the update similar to
+// the corresponding IMAP response.
+func Describe(upd backend.Update) string {
+	switch upd := upd.(type) {
+	case *backend.MailboxUpdate:
+		var parts []string
+		if _, ok := upd.Items[imap.StatusMessages]; ok {
+			parts = append(parts, fmt.Sprintf("* %d EXISTS", upd.Messages))
+		}
+		if _, ok := upd.Items[imap.StatusRecent]; ok {
+			parts = append(parts, fmt.Sprintf("* %d RECENT", upd.Recent))
+		}
+		if upd.Flags != nil {
+			parts = append(parts, fmt.Sprintf("* FLAGS (%s)", strings.Join(upd.Flags, " ")))
+		}
+		if len(parts) == 0 {
+			return "mailbox update"
+		}
+		return strings.Join(parts, ", ")
+	case *backend.ExpungeUpdate:
+		return fmt.Sprintf("* %d EXPUNGE", upd.SeqNum)
+	case *backend.MessageUpdate:
+		return fmt.Sprintf("* %d FETCH (UID %d FLAGS (%s))", upd.SeqNum, upd.Uid, strings.Join(upd.Flags, " "))
+	case *backend.StatusUpdate:
+		return fmt.Sprintf("* %s %s", upd.Type, upd.Info)
+	}
+	return fmt.Sprintf("%T", upd)
+}
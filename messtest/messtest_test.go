@@ -0,0 +1,107 @@
+package messtest
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/emersion/go-imap"
+	mess "github.com/foxcpp/go-imap-mess"
+)
+
+// failT records failures instead of stopping the test.
+type failT struct {
+	testing.TB
+	failed bool
+	msg    string
+}
+
+func (t *failT) Helper() {}
+
+func (t *failT) Fatalf(format string, args ...interface{}) {
+	t.failed = true
+	t.msg = fmt.Sprintf(format, args...)
+	panic(t)
+}
+
+func expectFailure(t *testing.T, f func(ft *failT)) {
+	t.Helper()
+
+	ft := &failT{TB: t}
+	func() {
+		defer func() {
+			if r := recover(); r != nil && r != ft {
+				panic(r)
+			}
+		}()
+		f(ft)
+	}()
+	if !ft.failed {
+		t.Error("Expected assertion to fail")
+	}
+}
+
+func TestSessions(t *testing.T) {
+	m := mess.NewManager()
+	sessions := OpenN(t, m, "INBOX", 2, 1, 2, 3)
+	s1, s2 := sessions[0], sessions[1]
+
+	m.NewMessage("INBOX", 4)
+	s1.Handle.FlagsChanged(2, []string{imap.SeenFlag}, true)
+	s2.Handle.Removed(1)
+
+	s1.Sync(true)
+	s1.ExpectExpunge(1)
+	s1.ExpectExists(3)
+	s1.ExpectRecent(1)
+	s1.ExpectNone()
+
+	s2.Sync(false)
+	s2.ExpectFetchFlags(2, imap.SeenFlag)
+	s2.ExpectExists(4)
+	s2.ExpectNone()
+	s2.Sync(true)
+	s2.ExpectExpunge(1)
+	s2.ExpectNone()
+
+	m.CloseSessions("INBOX", "Bye")
+	s1.Sync(false)
+	s1.ExpectBye()
+	s2.Sync(false)
+	s2.ExpectBye()
+}
+
+func TestAssertionFailures(t *testing.T) {
+	m := mess.NewManager()
+	s := Open(t, m, "INBOX", []uint32{1, 2}, nil)
+	s.Handle.FlagsChanged(1, []string{imap.SeenFlag}, false)
+	s.Sync(true)
+
+	expectFailure(t, func(ft *failT) {
+		s.T = ft
+		s.ExpectExists(2)
+	})
+
+	s.T = t
+	m.NewMessage("INBOX", 3)
+	s.Sync(true)
+	expectFailure(t, func(ft *failT) {
+		s.T = ft
+		s.ExpectExists(2)
+	})
+	expectFailure(t, func(ft *failT) {
+		s.T = ft
+		s.ExpectExpunge(1)
+	})
+
+	s.T = t
+	s.Handle.FlagsChanged(1, []string{imap.FlaggedFlag}, false)
+	s.Sync(true)
+	expectFailure(t, func(ft *failT) {
+		s.T = ft
+		s.ExpectNone()
+	})
+	expectFailure(t, func(ft *failT) {
+		s.T = ft
+		s.ExpectFetchFlags(1, imap.SeenFlag)
+	})
+}
@@ -0,0 +1,358 @@
+package mess
+
+import (
+	"fmt"
+	"math/rand"
+	"reflect"
+	"sort"
+	"testing"
+
+	"github.com/emersion/go-imap"
+	"github.com/emersion/go-imap/backend"
+)
+
+// modelSession is the reference model of what a client should have seen,
+// it is maintained independently from MailboxHandle internals.
+type modelSession struct {
+	hndl *MailboxHandle
+	conn *testConn
+
+	uids         []uint32
+	recent       map[uint32]bool
+	recentCount  uint32
+	hasNewRecent bool
+
+	pendingExpunge map[uint32]bool
+	pendingCreated []uint32
+	pendingFlags   []uint32
+	flags          map[uint32][]string
+	// Flags last reported to the client.
+	seen map[uint32][]string
+}
+
+type model struct {
+	t    *testing.T
+	rng  *rand.Rand
+	m    *Manager
+	key  string
+	log  []string
+	step int
+
+	lastUid  uint32
+	exists   []uint32
+	sessions []*modelSession
+}
+
+func (md *model) fatalf(format string, args ...interface{}) {
+	md.t.Helper()
+	md.t.Fatalf("step %d: %s\nhistory:\n%v", md.step, fmt.Sprintf(format, args...), md.log)
+}
+
+func (md *model) open() {
+	uids := append([]uint32(nil), md.exists...)
+	conn := &testConn{}
+	hndl, err := md.m.Mailbox(md.key, testMailbox{conn: conn}, uids, nil)
+	if err != nil {
+		md.fatalf("Mailbox: %v", err)
+	}
+	md.sessions = append(md.sessions, &modelSession{
+		hndl:           hndl,
+		conn:           conn,
+		uids:           append([]uint32(nil), uids...),
+		recent:         map[uint32]bool{},
+		pendingExpunge: map[uint32]bool{},
+		flags:          map[uint32][]string{},
+		seen:           map[uint32][]string{},
+	})
+	md.log = append(md.log, "open")
+}
+
+func (md *model) close(i int) {
+	if err := md.sessions[i].hndl.Close(); err != nil {
+		md.fatalf("Close: %v", err)
+	}
+	md.sessions = append(md.sessions[:i], md.sessions[i+1:]...)
+	md.log = append(md.log, fmt.Sprintf("close %d", i))
+}
+
+func (md *model) newMessages(n int) {
+	set := imap.SeqSet{}
+	set.AddRange(md.lastUid+1, md.lastUid+uint32(n))
+
+	storeRecent, err := md.m.NewMessages(md.key, set)
+	if err != nil {
+		md.fatalf("NewMessages: %v", err)
+	}
+	if storeRecent {
+		md.fatalf("NewMessages returned storeRecent with %d sessions", len(md.sessions))
+	}
+
+	for i := 0; i < n; i++ {
+		md.lastUid++
+		md.exists = append(md.exists, md.lastUid)
+		for j, s := range md.sessions {
+			s.pendingCreated = append(s.pendingCreated, md.lastUid)
+			// The oldest session gets \Recent.
+			if j == 0 {
+				s.recent[md.lastUid] = true
+				s.recentCount++
+				s.hasNewRecent = true
+			}
+		}
+	}
+	md.log = append(md.log, fmt.Sprintf("new %v", set.String()))
+}
+
+func (md *model) removed(i int, uid uint32) {
+	md.sessions[i].hndl.Removed(uid)
+
+	for j, existing := range md.exists {
+		if existing == uid {
+			md.exists = append(md.exists[:j], md.exists[j+1:]...)
+			break
+		}
+	}
+	for _, s := range md.sessions {
+		s.pendingExpunge[uid] = true
+	}
+	md.log = append(md.log, fmt.Sprintf("removed %d by %d", uid, i))
+}
+
+func (md *model) flagsChanged(i int, uid uint32, flags []string, silent bool) {
+	md.sessions[i].hndl.FlagsChanged(uid, flags, silent)
+
+	for j, s := range md.sessions {
+		if silent && j == i {
+			delete(s.seen, uid)
+			continue
+		}
+		sent := append([]string(nil), flags...)
+		if s.recent[uid] {
+			sent = append(sent, imap.RecentFlag)
+		}
+		if _, ok := s.flags[uid]; !ok {
+			s.pendingFlags = append(s.pendingFlags, uid)
+		}
+		s.flags[uid] = sent
+	}
+	md.log = append(md.log, fmt.Sprintf("flags %d %v silent=%v by %d", uid, flags, silent, i))
+}
+
+func seqOf(uids []uint32, uid uint32) (uint32, bool) {
+	for i, u := range uids {
+		if u == uid {
+			return uint32(i + 1), true
+		}
+	}
+	return 0, false
+}
+
+func describeUpdate(upd backend.Update) string {
+	switch upd := upd.(type) {
+	case *backend.MessageUpdate:
+		flags := append([]string(nil), upd.Flags...)
+		sort.Strings(flags)
+		return fmt.Sprintf("%d FETCH UID %d FLAGS %v", upd.SeqNum, upd.Uid, flags)
+	case *backend.ExpungeUpdate:
+		return fmt.Sprintf("%d EXPUNGE", upd.SeqNum)
+	case *backend.MailboxUpdate:
+		if _, ok := upd.Items[imap.StatusMessages]; ok {
+			return fmt.Sprintf("%d EXISTS", upd.Messages)
+		}
+		if _, ok := upd.Items[imap.StatusRecent]; ok {
+			return fmt.Sprintf("%d RECENT", upd.Recent)
+		}
+	}
+	return fmt.Sprintf("%T", upd)
+}
+
+func (md *model) sync(i int, expunge bool) {
+	s := md.sessions[i]
+	s.hndl.Sync(expunge)
+
+	var expected []string
+	for _, uid := range s.pendingFlags {
+		seq, ok := seqOf(s.uids, uid)
+		if !ok {
+			continue
+		}
+		flags := append([]string(nil), s.flags[uid]...)
+		sort.Strings(flags)
+		if seen, ok := s.seen[uid]; ok && reflect.DeepEqual(seen, flags) {
+			continue
+		}
+		s.seen[uid] = flags
+		expected = append(expected, fmt.Sprintf("%d FETCH UID %d FLAGS %v", seq, uid, flags))
+	}
+	s.pendingFlags = nil
+	s.flags = map[uint32][]string{}
+
+	if expunge {
+		for seq := len(s.uids); seq > 0; seq-- {
+			uid := s.uids[seq-1]
+			if !s.pendingExpunge[uid] {
+				continue
+			}
+			expected = append(expected, fmt.Sprintf("%d EXPUNGE", seq))
+			s.uids = append(s.uids[:seq-1], s.uids[seq:]...)
+			delete(s.pendingExpunge, uid)
+			delete(s.seen, uid)
+		}
+	}
+
+	if len(s.pendingCreated) != 0 {
+		s.uids = append(s.uids, s.pendingCreated...)
+		s.pendingCreated = nil
+		expected = append(expected, fmt.Sprintf("%d EXISTS", len(s.uids)))
+		if s.hasNewRecent {
+			expected = append(expected, fmt.Sprintf("%d RECENT", s.recentCount))
+			s.hasNewRecent = false
+		}
+	}
+
+	var actual []string
+	for _, upd := range s.conn.take() {
+		actual = append(actual, describeUpdate(upd))
+	}
+	md.log = append(md.log, fmt.Sprintf("sync %d expunge=%v: %v", i, expunge, actual))
+	if !reflect.DeepEqual(actual, expected) {
+		md.fatalf("Session %d: expected %v, got %v", i, expected, actual)
+	}
+
+	if uids := s.hndl.View().Uids(); !(len(uids) == 0 && len(s.uids) == 0) && !reflect.DeepEqual(uids, s.uids) {
+		md.fatalf("Session %d: expected UIDs %v, got %v", i, s.uids, uids)
+	}
+	s.hndl.lock.RLock()
+	pending := seqSetCount(&s.hndl.pendingExpunge)
+	s.hndl.lock.RUnlock()
+	if expunge && pending != len(s.pendingExpunge) {
+		md.fatalf("Session %d: %d pending expunges left, expected %d", i, pending, len(s.pendingExpunge))
+	}
+}
+
+func (md *model) resolve(i int) {
+	s := md.sessions[i]
+	count := uint32(len(s.uids))
+	seq := imap.Seq{
+		Start: uint32(md.rng.Intn(int(count) + 2)),
+		Stop:  uint32(md.rng.Intn(int(count) + 2)),
+	}
+	set := &imap.SeqSet{Set: []imap.Seq{seq}}
+
+	start, stop := seq.Start, seq.Stop
+	if start == 0 {
+		start = count
+	}
+	if stop == 0 {
+		stop = count
+	}
+	if start > stop {
+		start, stop = stop, start
+	}
+
+	var expectedPairs []SeqUid
+	for seqNum := start; seqNum <= stop && seqNum <= count; seqNum++ {
+		if seqNum == 0 {
+			continue
+		}
+		expectedPairs = append(expectedPairs, SeqUid{Seq: seqNum, Uid: s.uids[seqNum-1]})
+	}
+
+	pairs, err := s.hndl.ResolvePairs(false, set)
+	if len(expectedPairs) == 0 {
+		if err != ErrNoMessages {
+			md.fatalf("Session %d: ResolvePairs(%v): expected ErrNoMessages, got %v, %v", i, seq, pairs, err)
+		}
+	} else if err != nil || !reflect.DeepEqual(pairs, expectedPairs) {
+		md.fatalf("Session %d: ResolvePairs(%v): expected %v, got %v, %v", i, seq, expectedPairs, pairs, err)
+	}
+
+	if seq.Start > seq.Stop && seq.Stop != 0 || seq.Start > count || seq.Stop > count {
+		// Reversed ranges and sequence numbers bigger than the number of
+		// messages are not valid for ResolveSeq.
+		return
+	}
+	uidSet, err := s.hndl.ResolveSeq(false, &imap.SeqSet{Set: []imap.Seq{seq}})
+	if len(expectedPairs) == 0 {
+		if err == nil {
+			md.fatalf("Session %d: ResolveSeq(%v): expected error, got %v", i, seq, uidSet)
+		}
+		return
+	}
+	if err != nil {
+		md.fatalf("Session %d: ResolveSeq(%v): %v", i, seq, err)
+	}
+	for seqNum, uid := range s.uids {
+		matched := uint32(seqNum+1) >= start && uint32(seqNum+1) <= stop
+		if uidSet.Contains(uid) != matched {
+			md.fatalf("Session %d: ResolveSeq(%v) = %v, UID %d (seq %d) match: %v", i, seq, uidSet, uid, seqNum+1, !matched)
+		}
+	}
+}
+
+func (md *model) randomUid() (uint32, bool) {
+	if len(md.exists) == 0 {
+		return 0, false
+	}
+	return md.exists[md.rng.Intn(len(md.exists))], true
+}
+
+func (md *model) randomFlags() []string {
+	all := []string{imap.SeenFlag, imap.FlaggedFlag, imap.DeletedFlag, "$Label1"}
+	var flags []string
+	for _, f := range all {
+		if md.rng.Intn(2) == 0 {
+			flags = append(flags, f)
+		}
+	}
+	return flags
+}
+
+func (md *model) run(steps int) {
+	for md.step = 0; md.step < steps; md.step++ {
+		if len(md.sessions) == 0 {
+			md.open()
+			continue
+		}
+		i := md.rng.Intn(len(md.sessions))
+
+		switch op := md.rng.Intn(100); {
+		case op < 3:
+			md.open()
+		case op < 5:
+			md.close(i)
+		case op < 20:
+			md.newMessages(md.rng.Intn(3) + 1)
+		case op < 35:
+			if uid, ok := md.randomUid(); ok {
+				md.removed(i, uid)
+			}
+		case op < 45:
+			if uid, ok := md.randomUid(); ok {
+				md.flagsChanged(i, uid, md.randomFlags(), md.rng.Intn(2) == 0)
+			}
+		case op < 55:
+			// Session may still see a message removed in another session.
+			if uids := md.sessions[i].uids; len(uids) != 0 {
+				uid := uids[md.rng.Intn(len(uids))]
+				md.flagsChanged(i, uid, md.randomFlags(), md.rng.Intn(2) == 0)
+			}
+		case op < 80:
+			md.sync(i, md.rng.Intn(2) == 0)
+		default:
+			md.resolve(i)
+		}
+	}
+}
+
+func TestModel(t *testing.T) {
+	for seed := int64(1); seed <= 50; seed++ {
+		md := &model{
+			t:   t,
+			rng: rand.New(rand.NewSource(seed)),
+			m:   NewManager(),
+			key: "INBOX",
+		}
+		md.run(1000)
+	}
+}
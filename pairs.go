@@ -0,0 +1,137 @@
+package mess
+
+import (
+	"sort"
+
+	"github.com/emersion/go-imap"
+)
+
+// SeqUid is a pair of sequence number and UID of the same message.
+type SeqUid struct {
+	Seq uint32
+	Uid uint32
+}
+
+// seqRanges converts the set into the list of sorted non-overlapping sequence
+// number ranges.
+func (v *View) seqRanges(uid bool, set *imap.SeqSet) []imap.Seq {
+	last := uint32(len(v.uidMap))
+	ranges := make([]imap.Seq, 0, len(set.Set))
+	for _, seq := range set.Set {
+		if uid {
+			lastUid := v.uidMap[len(v.uidMap)-1]
+			if seq.Start == 0 {
+				seq.Start = lastUid
+			}
+			if seq.Stop == 0 {
+				seq.Stop = lastUid
+			}
+			// See View.ResolveSeq for why this is valid.
+			if seq.Start > seq.Stop {
+				seq.Start, seq.Stop = seq.Stop, seq.Start
+			}
+
+			start := sort.Search(len(v.uidMap), func(i int) bool {
+				return v.uidMap[i] >= seq.Start
+			})
+			stop := sort.Search(len(v.uidMap), func(i int) bool {
+				return v.uidMap[i] > seq.Stop
+			})
+			if start >= stop {
+				continue
+			}
+			seq = imap.Seq{Start: uint32(start) + 1, Stop: uint32(stop)}
+		} else {
+			if seq.Start == 0 {
+				seq.Start = last
+			}
+			if seq.Stop == 0 {
+				seq.Stop = last
+			}
+			if seq.Start > seq.Stop {
+				seq.Start, seq.Stop = seq.Stop, seq.Start
+			}
+			if seq.Start > last {
+				continue
+			}
+			if seq.Stop > last {
+				seq.Stop = last
+			}
+		}
+
+		ranges = append(ranges, seq)
+	}
+
+	sort.Slice(ranges, func(i, j int) bool {
+		return ranges[i].Start < ranges[j].Start
+	})
+	merged := ranges[:0]
+	for _, seq := range ranges {
+		if len(merged) != 0 && merged[len(merged)-1].Stop+1 >= seq.Start {
+			if merged[len(merged)-1].Stop < seq.Stop {
+				merged[len(merged)-1].Stop = seq.Stop
+			}
+			continue
+		}
+		merged = append(merged, seq)
+	}
+
+	return merged
+}
+
+// ForEach calls f for each message matched by the set in the order of sequence
+// numbers. Iteration is stopped if f returns false.
+//
+// set is interpreted as a UID set if uid is true and as a sequence numbers set
+// otherwise. As with ResolveSeq, * refers to the last message and
+// reversed ranges are accepted.
+//
+// If no messages are matched, ErrNoMessages is returned and f is never
+// called.
+func (v *View) ForEach(uid bool, set *imap.SeqSet, f func(seq, uid uint32) bool) error {
+	if v.closed {
+		return ErrSessionClosed
+	}
+	if len(v.uidMap) == 0 {
+		return ErrNoMessages
+	}
+
+	matched := false
+	for _, seq := range v.seqRanges(uid, set) {
+		for i := seq.Start; i <= seq.Stop; i++ {
+			msgUid := v.uidMap[i-1]
+			if msgUid == 0 {
+				continue
+			}
+
+			matched = true
+			if !f(i, msgUid) {
+				return nil
+			}
+		}
+	}
+
+	if !matched {
+		return ErrNoMessages
+	}
+	return nil
+}
+
+// ResolvePairs is similar to ResolveSeq but returns both sequence number and
+// UID for each matched message in the order of sequence numbers.
+//
+// It is meant to be used to build FETCH and STORE responses in one pass.
+func (v *View) ResolvePairs(uid bool, set *imap.SeqSet) ([]SeqUid, error) {
+	var pairs []SeqUid
+	err := v.ForEach(uid, set, func(seq, uid uint32) bool {
+		pairs = append(pairs, SeqUid{Seq: seq, Uid: uid})
+		return true
+	})
+	return pairs, err
+}
+
+// ResolvePairs is a shorthand for handle.View().ResolvePairs.
+func (handle *MailboxHandle) ResolvePairs(uid bool, set *imap.SeqSet) ([]SeqUid, error) {
+	handle.touch()
+	return handle.View().ResolvePairs(uid, set)
+}
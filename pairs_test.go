@@ -0,0 +1,47 @@
+package mess
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/emersion/go-imap"
+)
+
+func TestResolvePairs(t *testing.T) {
+	view := &View{uidMap: []uint32{2, 4, 6, 7, 8}}
+
+	test := func(uid bool, set string, expected []SeqUid, expectedErr error) {
+		t.Helper()
+
+		seqSet, err := imap.ParseSeqSet(set)
+		if err != nil {
+			t.Fatal(err)
+		}
+		pairs, err := view.ResolvePairs(uid, seqSet)
+		if err != expectedErr {
+			t.Errorf("%v %v: expected error %v, got %v", uid, set, expectedErr, err)
+			return
+		}
+		if !reflect.DeepEqual(pairs, expected) {
+			t.Errorf("%v %v: expected %v, got %v", uid, set, expected, pairs)
+		}
+	}
+
+	test(false, "1:*", []SeqUid{{1, 2}, {2, 4}, {3, 6}, {4, 7}, {5, 8}}, nil)
+	test(false, "*", []SeqUid{{5, 8}}, nil)
+	test(false, "4,2,3", []SeqUid{{2, 4}, {3, 6}, {4, 7}}, nil)
+	test(false, "4:2", []SeqUid{{2, 4}, {3, 6}, {4, 7}}, nil)
+	test(false, "4:10", []SeqUid{{4, 7}, {5, 8}}, nil)
+	test(false, "6:10", nil, ErrNoMessages)
+
+	test(true, "1:*", []SeqUid{{1, 2}, {2, 4}, {3, 6}, {4, 7}, {5, 8}}, nil)
+	test(true, "3:5", []SeqUid{{2, 4}}, nil)
+	test(true, "5", nil, ErrNoMessages)
+	test(true, "7,2,4:6", []SeqUid{{1, 2}, {2, 4}, {3, 6}, {4, 7}}, nil)
+	test(true, "100:*", []SeqUid{{5, 8}}, nil)
+	test(true, "*:7", []SeqUid{{4, 7}, {5, 8}}, nil)
+	test(true, "9:20", nil, ErrNoMessages)
+
+	view = &View{}
+	test(false, "1:*", nil, ErrNoMessages)
+}
@@ -0,0 +1,182 @@
+package mess
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/emersion/go-imap"
+)
+
+// RecentArbiter decides which session cluster-wide gets \Recent for a new
+// message when multiple Managers share the mailbox state.
+//
+// Without an arbiter, each Manager that has sessions for the mailbox assigns
+// \Recent to one of them, and the origin Manager asks backend to store it
+// if it has no sessions. With an arbiter set on all Managers, \Recent is
+// assigned only if Claim succeeds. Persistent \Recent flags passed to
+// Manager.Mailbox are claimed as well, so it is safe for the backend to store
+// the flag even if a session on another node got it.
+//
+// Claim is called without internal locks held, only if there is a session
+// that can get \Recent.
+type RecentArbiter interface {
+	// Claim reports whether the caller is the first one to claim \Recent
+	// for the message.
+	Claim(key interface{}, uid uint32) (bool, error)
+
+	// Forget removes all claims for the key. It is called when mailbox is
+	// destroyed since the key can be reused with a new UIDVALIDITY.
+	Forget(key interface{}) error
+}
+
+// claimRecent returns the subset of uid claimed using RecentArbiter.
+func (m *Manager) claimRecent(key interface{}, uid *imap.SeqSet) *imap.SeqSet {
+	if m.RecentArbiter == nil {
+		return uid
+	}
+
+	claimed := &imap.SeqSet{}
+	for _, msgUid := range seqSetUids(uid) {
+		ok, err := m.RecentArbiter.Claim(key, msgUid)
+		if err != nil {
+			m.reportError(fmt.Errorf("Failed to claim \\Recent for %v/%d: %w", key, msgUid, err))
+			continue
+		}
+		if ok {
+			claimed.AddNum(msgUid)
+		}
+	}
+	return claimed
+}
+
+func (m *Manager) forgetRecent(key interface{}) {
+	if m.RecentArbiter == nil {
+		return
+	}
+	if err := m.RecentArbiter.Forget(key); err != nil {
+		m.reportError(fmt.Errorf("Failed to forget \\Recent claims for %v: %w", key, err))
+	}
+}
+
+// MemoryArbiter is the RecentArbiter for Managers running in the same
+// process.
+//
+// Claims are kept until the mailbox is destroyed, use Expire to remove old
+// ones.
+type MemoryArbiter struct {
+	lock   sync.Mutex
+	claims map[interface{}]map[uint32]time.Time
+}
+
+func NewMemoryArbiter() *MemoryArbiter {
+	return &MemoryArbiter{
+		claims: make(map[interface{}]map[uint32]time.Time),
+	}
+}
+
+func (a *MemoryArbiter) Claim(key interface{}, uid uint32) (bool, error) {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	claims := a.claims[key]
+	if claims == nil {
+		claims = make(map[uint32]time.Time)
+		a.claims[key] = claims
+	}
+	if _, ok := claims[uid]; ok {
+		return false, nil
+	}
+	claims[uid] = time.Now()
+	return true, nil
+}
+
+func (a *MemoryArbiter) Forget(key interface{}) error {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	delete(a.claims, key)
+	return nil
+}
+
+// Expire removes claims created before the specified time.
+func (a *MemoryArbiter) Expire(before time.Time) {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	for key, claims := range a.claims {
+		for uid, claimedAt := range claims {
+			if claimedAt.Before(before) {
+				delete(claims, uid)
+			}
+		}
+		if len(claims) == 0 {
+			delete(a.claims, key)
+		}
+	}
+}
+
+// FileArbiter is the RecentArbiter that stores claims as files in a directory
+// shared by all nodes. The file system should support atomic exclusive
+// creation (O_EXCL).
+//
+// Claims are kept until the mailbox is destroyed, use Expire to remove old
+// ones.
+type FileArbiter struct {
+	dir string
+}
+
+func NewFileArbiter(dir string) (*FileArbiter, error) {
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return nil, err
+	}
+	return &FileArbiter{dir: dir}, nil
+}
+
+func (a *FileArbiter) keyDir(key interface{}) string {
+	digest := sha256.Sum256([]byte(fmt.Sprintf("%T\x00%v", key, key)))
+	return filepath.Join(a.dir, hex.EncodeToString(digest[:]))
+}
+
+func (a *FileArbiter) Claim(key interface{}, uid uint32) (bool, error) {
+	dir := a.keyDir(key)
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return false, err
+	}
+
+	f, err := os.OpenFile(filepath.Join(dir, strconv.FormatUint(uint64(uid), 10)), os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0o600)
+	if err != nil {
+		if os.IsExist(err) {
+			return false, nil
+		}
+		return false, err
+	}
+	return true, f.Close()
+}
+
+func (a *FileArbiter) Forget(key interface{}) error {
+	return os.RemoveAll(a.keyDir(key))
+}
+
+// Expire removes claims created before the specified time.
+func (a *FileArbiter) Expire(before time.Time) error {
+	return filepath.Walk(a.dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			if os.IsNotExist(err) {
+				return nil
+			}
+			return err
+		}
+		if info.IsDir() || !info.ModTime().Before(before) {
+			return nil
+		}
+		if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		return nil
+	})
+}
@@ -0,0 +1,219 @@
+package mess
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/emersion/go-imap"
+	"github.com/emersion/go-imap/backend"
+)
+
+func recentCount(upds []backend.Update) int {
+	count := 0
+	for _, upd := range upds {
+		mboxUpd, ok := upd.(*backend.MailboxUpdate)
+		if !ok {
+			continue
+		}
+		if _, ok := mboxUpd.Items[imap.StatusRecent]; ok {
+			count++
+		}
+	}
+	return count
+}
+
+func TestRecentArbiter(t *testing.T) {
+	arbiter := NewMemoryArbiter()
+	m1, m2 := NewManager(), NewManager()
+	m1.RecentArbiter = arbiter
+	m2.RecentArbiter = arbiter
+
+	upds := make(chan Update, 10)
+	m1.SetExternalSink(upds)
+
+	hndl1, conn1 := openTestHandle(m1, "INBOX")
+	hndl2, conn2 := openTestHandle(m2, "INBOX")
+
+	if storeRecent, _ := m1.NewMessage("INBOX", 1); storeRecent {
+		t.Error("storeRecent should be false if a local session got \\Recent")
+	}
+	if err := m2.ExternalUpdate(<-upds); err != nil {
+		t.Fatal(err)
+	}
+
+	hndl1.Sync(true)
+	hndl2.Sync(true)
+	if !hndl1.IsRecent(1) || hndl2.IsRecent(1) {
+		t.Error("Wrong \\Recent assignment")
+	}
+	if recentCount(conn1.take()) != 1 || recentCount(conn2.take()) != 0 {
+		t.Error("RECENT should be sent only to the first session")
+	}
+
+	// Message was claimed by m1 session so persistent \Recent stored by
+	// the origin is dropped.
+	hndl3, err := m2.Mailbox("INBOX", testMailbox{conn: &testConn{}}, []uint32{1, 2}, &imap.SeqSet{Set: []imap.Seq{{Start: 1, Stop: 2}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if hndl3.IsRecent(1) || !hndl3.IsRecent(2) {
+		t.Error("Persistent \\Recent is not filtered")
+	}
+
+	m1.MailboxDestroyed("INBOX")
+	if ok, _ := arbiter.Claim("INBOX", 1); !ok {
+		t.Error("Claims are not forgotten on MailboxDestroyed")
+	}
+}
+
+// callbackArbiter calls claim for each Claim.
+type callbackArbiter struct {
+	claim func(key interface{}, uid uint32)
+}
+
+func (a callbackArbiter) Claim(key interface{}, uid uint32) (bool, error) {
+	a.claim(key, uid)
+	return true, nil
+}
+
+func (a callbackArbiter) Forget(interface{}) error {
+	return nil
+}
+
+func TestRecentArbiterUnlocked(t *testing.T) {
+	m := NewManager()
+	claims := 0
+	m.RecentArbiter = callbackArbiter{claim: func(key interface{}, uid uint32) {
+		claims++
+		// Deadlocks if Claim is called with the shard lock held.
+		hndl, _ := openTestHandle(m, key)
+		hndl.Close()
+	}}
+
+	if storeRecent, _ := m.NewMessage("INBOX", 1); !storeRecent || claims != 0 {
+		t.Fatal("Claim should not be called without sessions, storeRecent:", storeRecent, "claims:", claims)
+	}
+
+	hndl, _ := openTestHandle(m, "INBOX")
+	defer hndl.Close()
+	if storeRecent, _ := m.NewMessage("INBOX", 2); storeRecent || claims != 1 {
+		t.Fatal("Expected single claim, storeRecent:", storeRecent, "claims:", claims)
+	}
+	hndl.Sync(true)
+	if !hndl.IsRecent(2) {
+		t.Fatal("Claimed message is not \\Recent")
+	}
+}
+
+func TestMemoryArbiterExpire(t *testing.T) {
+	a := NewMemoryArbiter()
+	a.Claim("INBOX", 1)
+
+	a.Expire(time.Now().Add(-time.Minute))
+	if ok, _ := a.Claim("INBOX", 1); ok {
+		t.Error("New claim is expired")
+	}
+
+	a.Expire(time.Now().Add(time.Minute))
+	if len(a.claims) != 0 {
+		t.Error("Claims are not expired:", a.claims)
+	}
+}
+
+func TestFileArbiter(t *testing.T) {
+	dir, err := ioutil.TempDir("", "mess-arbiter-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	a, err := NewFileArbiter(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := NewFileArbiter(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	key := MailboxKey{Account: "u", MailboxID: "INBOX"}
+	if ok, err := a.Claim(key, 1); err != nil || !ok {
+		t.Fatal("First claim failed:", ok, err)
+	}
+	if ok, err := b.Claim(key, 1); err != nil || ok {
+		t.Fatal("Second claim succeeded:", ok, err)
+	}
+	if ok, err := b.Claim("INBOX", 1); err != nil || !ok {
+		t.Fatal("Claim for other key failed:", ok, err)
+	}
+
+	if err := a.Expire(time.Now().Add(time.Minute)); err != nil {
+		t.Fatal(err)
+	}
+	if ok, _ := b.Claim(key, 1); !ok {
+		t.Error("Claim is not expired")
+	}
+
+	if err := a.Forget(key); err != nil {
+		t.Fatal(err)
+	}
+	if ok, _ := b.Claim(key, 1); !ok {
+		t.Error("Claim is not forgotten")
+	}
+}
+
+func TestDisableRecent(t *testing.T) {
+	m := NewManager()
+	m.DisableRecent = true
+
+	hndl, err := m.Mailbox("INBOX", testMailbox{conn: &testConn{}}, []uint32{1}, &imap.SeqSet{Set: []imap.Seq{{Start: 1, Stop: 1}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn := hndl.conn.(*testConn)
+
+	if hndl.IsRecent(1) {
+		t.Error("Persistent \\Recent should be ignored")
+	}
+	if storeRecent, _ := m.NewMessage("INBOX", 2); storeRecent {
+		t.Error("storeRecent should be false")
+	}
+	if storeRecent, _ := m.NewMessage("Archive", 1); storeRecent {
+		t.Error("storeRecent should be false if there are no sessions")
+	}
+	hndl.FlagsChanged(1, []string{imap.SeenFlag}, false)
+	hndl.Sync(true)
+
+	upds := conn.take()
+	if recentCount(upds) != 0 {
+		t.Error("RECENT response is sent")
+	}
+	if len(upds) != 2 {
+		t.Fatal("Expected FETCH and EXISTS, got", upds)
+	}
+	if hndl.IsRecent(2) {
+		t.Error("New message is marked \\Recent")
+	}
+}
+
+func TestRecentOldestSession(t *testing.T) {
+	m := NewManager()
+	first, _ := openTestHandle(m, "INBOX")
+	second, _ := openTestHandle(m, "INBOX")
+	third, _ := openTestHandle(m, "INBOX")
+	defer second.Close()
+	defer third.Close()
+
+	m.NewMessage("INBOX", 1)
+	first.Close()
+	m.NewMessage("INBOX", 2)
+
+	if !first.IsRecent(1) || second.IsRecent(1) || third.IsRecent(1) {
+		t.Error("\\Recent for the first message should go to the oldest session")
+	}
+	if !second.IsRecent(2) || third.IsRecent(2) {
+		t.Error("\\Recent should go to the oldest remaining session")
+	}
+}
@@ -0,0 +1,338 @@
+package mess
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"sync"
+
+	"github.com/emersion/go-imap"
+	"github.com/emersion/go-imap/backend"
+)
+
+// recordHeader is the first line of the recording. The number is incremented
+// on incompatible format changes.
+const recordHeader = "mess-record 2"
+
+// settingsEvent is the event name of the line with Manager settings, it
+// follows the header.
+const settingsEvent = "settings"
+
+var ErrRecordFormat = errors.New("Not a mess recording or unsupported version")
+
+// recordLine is a single line of the recording. Event is the name of the
+// corresponding TraceKind or settingsEvent.
+type recordLine struct {
+	Event            string
+	Handle           uint64          `json:",omitempty"`
+	Key              json.RawMessage `json:",omitempty"`
+	UIDs             []uint32        `json:",omitempty"`
+	Recent           string          `json:",omitempty"`
+	Update           *Update         `json:",omitempty"`
+	External         bool            `json:",omitempty"`
+	Silent           bool            `json:",omitempty"`
+	Expunge          bool            `json:",omitempty"`
+	Flags            []string        `json:",omitempty"`
+	Keywords         *[]string       `json:",omitempty"`
+	AllowNewKeywords bool            `json:",omitempty"`
+
+	DisableRecent  bool `json:",omitempty"`
+	FlagsCacheSize int  `json:",omitempty"`
+}
+
+// Recorder is a Tracer that writes the update stream together with session
+// lifecycle events (Mailbox, Sync, FlagsSeen and Close calls) so it can be
+// fed into Replay later.
+//
+// The recording is a header line followed by one JSON object per line. Only
+// string and MailboxKey keys are supported, events for other keys are
+// dropped and ErrKeyType is reported by Err.
+//
+// Recorder should be set as Manager.Tracer before any handles are created,
+// updates generated by sessions opened earlier are not dispatched on replay.
+type Recorder struct {
+	lock sync.Mutex
+	w    *bufio.Writer
+	err  error
+}
+
+// NewRecorder creates the Recorder for the Manager m. Settings of m that
+// affect sessions (DisableRecent, FlagsCacheSize) are written to the
+// recording so Replay uses the same ones, they should not be changed later.
+func NewRecorder(w io.Writer, m *Manager) *Recorder {
+	r := &Recorder{w: bufio.NewWriter(w)}
+	_, r.err = r.w.WriteString(recordHeader + "\n")
+	r.writeLine(recordLine{
+		Event:          settingsEvent,
+		DisableRecent:  m.DisableRecent,
+		FlagsCacheSize: m.FlagsCacheSize,
+	})
+	return r
+}
+
+func (r *Recorder) Trace(ev TraceEvent) {
+	line := recordLine{
+		Event:  ev.Kind.String(),
+		Handle: ev.Handle,
+	}
+	switch ev.Kind {
+	case TraceOpen:
+		line.UIDs = ev.UIDs
+		if ev.Recent != nil && !ev.Recent.Empty() {
+			line.Recent = ev.Recent.String()
+		}
+		if ev.Keywords != nil {
+			line.Keywords = &ev.Keywords
+			line.AllowNewKeywords = ev.AllowNewKeywords
+		}
+	case TraceUpdate:
+		updCopy := *ev.Update
+		updCopy.Key = nil
+		line.Update = &updCopy
+		line.External = ev.External
+		line.Silent = ev.Silent
+	case TraceFlush:
+		line.Expunge = ev.Expunge
+	case TraceFlagsSeen:
+		line.UIDs = ev.UIDs
+		line.Flags = ev.Flags
+	case TraceClose:
+	default:
+		return
+	}
+
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	key, err := encodeJSONKey(ev.Key)
+	if err != nil {
+		r.setErr(err)
+		return
+	}
+	line.Key = key
+	r.writeLine(line)
+}
+
+// writeLine writes the line to the recording. r.lock should be held.
+func (r *Recorder) writeLine(line recordLine) {
+	blob, err := json.Marshal(line)
+	if err != nil {
+		r.setErr(err)
+		return
+	}
+	blob = append(blob, '\n')
+	if _, err := r.w.Write(blob); err != nil {
+		r.setErr(err)
+	}
+}
+
+func (r *Recorder) setErr(err error) {
+	if r.err == nil {
+		r.err = err
+	}
+}
+
+// Err returns the first error encountered while recording.
+func (r *Recorder) Err() error {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	return r.err
+}
+
+// Flush writes buffered events to the underlying writer.
+func (r *Recorder) Flush() error {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if err := r.w.Flush(); err != nil {
+		r.setErr(err)
+	}
+	return r.err
+}
+
+// SessionReport describes the updates sent to a single session during
+// replay.
+type SessionReport struct {
+	// Handle is the handle ID from the recording.
+	Handle uint64
+	Key    interface{}
+
+	Updates []backend.Update
+	Closed  bool
+}
+
+type replayConn struct {
+	report *SessionReport
+}
+
+func (c *replayConn) SendUpdate(upd backend.Update) error {
+	c.report.Updates = append(c.report.Updates, upd)
+	return nil
+}
+
+type replayMailbox struct {
+	backend.Mailbox
+	conn *replayConn
+}
+
+func (mbox replayMailbox) Conn() backend.Conn {
+	return mbox.conn
+}
+
+type replayKeywordsMailbox struct {
+	replayMailbox
+	keywords []string
+	allowNew bool
+}
+
+func (mbox replayKeywordsMailbox) Keywords() ([]string, bool) {
+	return mbox.keywords, mbox.allowNew
+}
+
+// Replay feeds the recording made by Recorder into a fresh Manager using fake
+// connections and reports what each session was sent. Reports are sorted by
+// handle ID.
+//
+// The Manager uses the settings recorded by NewRecorder. Updates received
+// from other nodes are replayed as they were received. Other nodes are not
+// simulated, so the recordings from all nodes should be replayed separately.
+func Replay(r io.Reader) ([]SessionReport, error) {
+	m := NewManager()
+	handles := map[uint64]*MailboxHandle{}
+	reports := map[uint64]*SessionReport{}
+
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(nil, 16*1024*1024)
+	if !scanner.Scan() || scanner.Text() != recordHeader {
+		if err := scanner.Err(); err != nil {
+			return nil, err
+		}
+		return nil, ErrRecordFormat
+	}
+
+	lineNum := 1
+	for scanner.Scan() {
+		lineNum++
+		if len(bytes.TrimSpace(scanner.Bytes())) == 0 {
+			continue
+		}
+
+		var line recordLine
+		if err := json.Unmarshal(scanner.Bytes(), &line); err != nil {
+			return nil, fmt.Errorf("Line %d: %v", lineNum, err)
+		}
+		if line.Event == settingsEvent {
+			m.DisableRecent = line.DisableRecent
+			m.FlagsCacheSize = line.FlagsCacheSize
+			continue
+		}
+		key, err := decodeJSONKey(line.Key)
+		if err != nil {
+			return nil, fmt.Errorf("Line %d: %v", lineNum, err)
+		}
+
+		switch line.Event {
+		case TraceOpen.String():
+			recent := &imap.SeqSet{}
+			if line.Recent != "" {
+				recent, err = imap.ParseSeqSet(line.Recent)
+				if err != nil {
+					return nil, fmt.Errorf("Line %d: %v", lineNum, err)
+				}
+			}
+			report := &SessionReport{Handle: line.Handle, Key: key}
+			conn := &replayConn{report: report}
+			var mbox Mailbox = replayMailbox{conn: conn}
+			if line.Keywords != nil {
+				mbox = replayKeywordsMailbox{
+					replayMailbox: replayMailbox{conn: conn},
+					keywords:      *line.Keywords,
+					allowNew:      line.AllowNewKeywords,
+				}
+			}
+			handle, err := m.Mailbox(key, mbox, line.UIDs, recent)
+			if err != nil {
+				return nil, fmt.Errorf("Line %d: %v", lineNum, err)
+			}
+			handles[line.Handle] = handle
+			reports[line.Handle] = report
+		case TraceUpdate.String():
+			if line.Update == nil {
+				return nil, fmt.Errorf("Line %d: Missing update", lineNum)
+			}
+			if err := replayUpdate(m, handles, line, key); err != nil {
+				return nil, fmt.Errorf("Line %d: %v", lineNum, err)
+			}
+		case TraceFlush.String():
+			if handle := handles[line.Handle]; handle != nil {
+				handle.Sync(line.Expunge)
+			}
+		case TraceFlagsSeen.String():
+			if len(line.UIDs) != 1 {
+				return nil, fmt.Errorf("Line %d: Expected one UID", lineNum)
+			}
+			if handle := handles[line.Handle]; handle != nil {
+				handle.FlagsSeen(line.UIDs[0], line.Flags)
+			}
+		case TraceClose.String():
+			if handle := handles[line.Handle]; handle != nil {
+				handle.Close()
+				delete(handles, line.Handle)
+				reports[line.Handle].Closed = true
+			}
+		default:
+			return nil, fmt.Errorf("Line %d: Unknown event: %v", lineNum, line.Event)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	result := make([]SessionReport, 0, len(reports))
+	for _, report := range reports {
+		result = append(result, *report)
+	}
+	sort.Slice(result, func(i, j int) bool {
+		return result[i].Handle < result[j].Handle
+	})
+	return result, nil
+}
+
+func replayUpdate(m *Manager, handles map[uint64]*MailboxHandle, line recordLine, key interface{}) error {
+	upd := *line.Update
+	upd.Key = key
+	upd.TraceID = 0
+
+	if line.External || line.Handle == 0 {
+		return m.externalUpdate(upd)
+	}
+
+	// Updates generated by sessions that are not in the recording were not
+	// dispatched locally (e.g. ManagementHandle).
+	handle := handles[line.Handle]
+	if handle == nil {
+		return nil
+	}
+
+	switch upd.Type {
+	case UpdFlags:
+		uid, err := strconv.ParseUint(upd.SeqSet, 10, 32)
+		if err != nil {
+			return err
+		}
+		handle.FlagsChanged(uint32(uid), upd.NewFlags, line.Silent)
+	case UpdRemoved:
+		seq, err := imap.ParseSeqSet(upd.SeqSet)
+		if err != nil {
+			return err
+		}
+		handle.RemovedSet(*seq)
+	default:
+		return m.externalUpdate(upd)
+	}
+	return nil
+}
@@ -0,0 +1,115 @@
+package mess
+
+import (
+	"bytes"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/emersion/go-imap"
+)
+
+func TestRecordReplay(t *testing.T) {
+	var buf bytes.Buffer
+	m := NewManager()
+	rec := NewRecorder(&buf, m)
+	m.Tracer = rec
+
+	key := MailboxKey{Account: "u", MailboxID: "INBOX"}
+	hndl1, conn1 := openTestHandle(m, key, 1, 2, 3)
+	hndl2, conn2 := openTestHandle(m, key, 1, 2, 3)
+	mgmt := m.ManagementHandle(key, []uint32{1, 2, 3}, nil)
+
+	m.NewMessage(key, 4)
+	hndl1.FlagsChanged(2, []string{imap.SeenFlag}, true)
+	hndl2.Removed(1)
+	hndl1.Sync(false)
+	hndl2.Sync(true)
+	mgmt.FlagsChanged(3, []string{imap.FlaggedFlag}, false)
+	if err := m.ExternalUpdate(Update{Type: UpdRemoved, Key: key, SeqSet: "3"}); err != nil {
+		t.Fatal(err)
+	}
+	hndl1.Sync(true)
+	hndl2.Sync(true)
+	hndl2.Close()
+
+	if err := rec.Flush(); err != nil {
+		t.Fatal(err)
+	}
+
+	reports, err := Replay(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(reports) != 2 {
+		t.Fatal("Wrong number of sessions:", len(reports))
+	}
+	for i, conn := range []*testConn{conn1, conn2} {
+		expected := conn.take()
+		if !reflect.DeepEqual(reports[i].Updates, expected) {
+			t.Errorf("Session %d: expected %v, got %v", i+1, expected, reports[i].Updates)
+		}
+		if reports[i].Key != key {
+			t.Errorf("Session %d: wrong key: %v", i+1, reports[i].Key)
+		}
+	}
+	if reports[0].Closed || !reports[1].Closed {
+		t.Error("Wrong Closed values")
+	}
+}
+
+func TestRecordReplayState(t *testing.T) {
+	var buf bytes.Buffer
+	m := NewManager()
+	m.DisableRecent = true
+	m.FlagsCacheSize = 1
+	rec := NewRecorder(&buf, m)
+	m.Tracer = rec
+
+	hndl1, conn1 := openKeywordsHandle(m, "INBOX", []string{imap.SeenFlag}, 1, 2)
+	hndl2, conn2 := openKeywordsHandle(m, "INBOX", nil, 1, 2)
+	defer hndl1.Close()
+	defer hndl2.Close()
+
+	hndl1.FlagsSeen(1, []string{imap.SeenFlag})
+	hndl2.FlagsChanged(1, []string{imap.SeenFlag}, false)
+	hndl2.FlagsChanged(2, []string{"$Label"}, false)
+	m.NewMessage("INBOX", 3)
+	hndl1.Sync(true)
+	hndl2.Sync(true)
+
+	if err := rec.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	reports, err := Replay(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, conn := range []*testConn{conn1, conn2} {
+		expected := conn.take()
+		// FLAGS, FETCH for the second message and EXISTS without RECENT.
+		if i == 0 && len(expected) != 3 {
+			t.Fatal("Unexpected updates for session 1:", expected)
+		}
+		if !reflect.DeepEqual(reports[i].Updates, expected) {
+			t.Errorf("Session %d: expected %v, got %v", i+1, expected, reports[i].Updates)
+		}
+	}
+}
+
+func TestReplayMalformed(t *testing.T) {
+	if _, err := Replay(strings.NewReader("mess-record 1\n")); err != ErrRecordFormat {
+		t.Error("Expected ErrRecordFormat, got", err)
+	}
+	if _, err := Replay(strings.NewReader("mess-record 2\n{\"Event\":\"foo\",\"Key\":\"INBOX\"}\n")); err == nil {
+		t.Error("Expected error for unknown event")
+	}
+
+	m := NewManager()
+	rec := NewRecorder(&bytes.Buffer{}, m)
+	m.Tracer = rec
+	m.Mailbox(42, testMailbox{conn: &testConn{}}, nil, nil)
+	if rec.Err() != ErrKeyType {
+		t.Error("Expected ErrKeyType, got", rec.Err())
+	}
+}
@@ -0,0 +1,119 @@
+package mess
+
+import (
+	"sort"
+
+	"github.com/emersion/go-imap"
+	"github.com/emersion/go-imap/backend"
+)
+
+// Selected implements Conn, Poll, Idle and Close of backend.Mailbox using
+// the MailboxHandle. It is meant to be embedded into the selected mailbox
+// type of the backend and initialized using Open.
+//
+// Mailbox operations should be wrapped using Command so pending updates are
+// sent following the RFC 3501 rules for the command type.
+type Selected struct {
+	Handle *MailboxHandle
+	conn   backend.Conn
+}
+
+// Open creates the handle for the selected mailbox. mbox should be the value
+// embedding s.
+//
+// See Manager.Mailbox for the meaning of other arguments.
+func (s *Selected) Open(m *Manager, key interface{}, conn backend.Conn, mbox Mailbox, uids []uint32, recent *imap.SeqSet) error {
+	s.conn = conn
+	handle, err := m.Mailbox(key, mbox, uids, recent)
+	if err != nil {
+		return err
+	}
+	s.Handle = handle
+	return nil
+}
+
+func (s *Selected) Conn() backend.Conn {
+	return s.conn
+}
+
+// Poll sends pending updates. go-imap calls it for NOOP and CHECK, these
+// commands are not tracked since they do nothing else.
+func (s *Selected) Poll(expunge bool) error {
+	s.Handle.Sync(expunge)
+	return nil
+}
+
+func (s *Selected) Idle(done <-chan struct{}) {
+	s.Handle.Idle(done)
+}
+
+func (s *Selected) Close() error {
+	return s.Handle.Close()
+}
+
+// Command marks the start of the command and returns the function that
+// should be deferred to mark its end and send pending updates. See
+// MailboxHandle.BeginCommand.
+//
+// Use CommandFor(uid) for commands that take the uid argument. COPY, EXPUNGE
+// and APPEND should use CmdUid regardless of the argument type.
+func (s *Selected) Command(kind CommandKind) (end func()) {
+	s.Handle.BeginCommand(kind)
+	return s.Handle.EndCommand
+}
+
+// Resolve converts the command argument to UIDs. Nil set is returned without
+// an error if the UID command matched no messages, this is not an error as
+// opposed to the same situation for sequence numbers.
+func (s *Selected) Resolve(uid bool, seqset *imap.SeqSet) (*imap.SeqSet, error) {
+	set, err := s.Handle.ResolveSeq(uid, seqset)
+	if err != nil {
+		if uid && err == ErrNoMessages {
+			return nil, nil
+		}
+		return nil, err
+	}
+	return set, nil
+}
+
+// StoreFlags implements UpdateMessagesFlags. update should apply the
+// operation to the messages with the specified UIDs, skipping ones that no
+// longer exist, and return the resulting flags.
+//
+// \Recent is removed from flags since it cannot be changed by clients. FETCH
+// responses are sent to all other connections and, unless silent is set,
+// this one.
+func (s *Selected) StoreFlags(uid bool, seqset *imap.SeqSet, op imap.FlagsOp, silent bool, flags []string,
+	update func(uids *imap.SeqSet, op imap.FlagsOp, flags []string) (map[uint32][]string, error)) error {
+
+	defer s.Command(CommandFor(uid))()
+
+	set, err := s.Resolve(uid, seqset)
+	if err != nil || set == nil {
+		return err
+	}
+
+	storeFlags := make([]string, 0, len(flags))
+	for _, f := range flags {
+		if f != imap.RecentFlag {
+			storeFlags = append(storeFlags, f)
+		}
+	}
+
+	newFlags, err := update(set, op, storeFlags)
+	if err != nil {
+		return err
+	}
+
+	// Map iteration order is random, sort UIDs to send FETCH responses in
+	// order.
+	uids := make([]uint32, 0, len(newFlags))
+	for msgUid := range newFlags {
+		uids = append(uids, msgUid)
+	}
+	sort.Slice(uids, func(i, j int) bool { return uids[i] < uids[j] })
+	for _, msgUid := range uids {
+		s.Handle.FlagsChanged(msgUid, newFlags[msgUid], silent)
+	}
+	return nil
+}
@@ -0,0 +1,150 @@
+package mess
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/emersion/go-imap"
+	"github.com/emersion/go-imap/backend"
+)
+
+// mailboxOps is backend.Mailbox without methods implemented by Selected.
+type mailboxOps interface {
+	Name() string
+	Info() (*imap.MailboxInfo, error)
+	ListMessages(uid bool, seqset *imap.SeqSet, items []imap.FetchItem, ch chan<- *imap.Message) error
+	SearchMessages(uid bool, criteria *imap.SearchCriteria) ([]uint32, error)
+	UpdateMessagesFlags(uid bool, seqset *imap.SeqSet, operation imap.FlagsOp, silent bool, flags []string) error
+	CopyMessages(uid bool, seqset *imap.SeqSet, dest string) error
+	Expunge() error
+}
+
+type testSelected struct {
+	mailboxOps
+	Selected
+}
+
+func openSelected(t *testing.T, m *Manager, uids ...uint32) (*testSelected, *testConn) {
+	t.Helper()
+
+	conn := &testConn{}
+	mbox := &testSelected{}
+	if err := mbox.Open(m, "INBOX", conn, mbox, uids, nil); err != nil {
+		t.Fatal(err)
+	}
+	return mbox, conn
+}
+
+func TestSelectedCommand(t *testing.T) {
+	m := NewManager()
+	mbox, conn := openSelected(t, m, 1, 2, 3)
+	other, _ := openSelected(t, m, 1, 2, 3)
+	defer mbox.Close()
+	defer other.Close()
+
+	other.Handle.Removed(2)
+
+	mbox.Command(CmdSeq)()
+	if upds := conn.take(); len(upds) != 0 {
+		t.Fatal("EXPUNGE sent after command using sequence numbers:", upds)
+	}
+	mbox.Command(CmdUid)()
+	upds := conn.take()
+	if len(upds) != 1 || upds[0].(*backend.ExpungeUpdate).SeqNum != 2 {
+		t.Fatal("Expected 2 EXPUNGE, got", upds)
+	}
+}
+
+func TestSelectedResolve(t *testing.T) {
+	m := NewManager()
+	mbox, _ := openSelected(t, m)
+	defer mbox.Close()
+
+	set, _ := imap.ParseSeqSet("1:*")
+	res, err := mbox.Resolve(true, set)
+	if res != nil || err != nil {
+		t.Fatal("Expected no messages and no error for UID command, got", res, err)
+	}
+	if _, err := mbox.Resolve(false, set); err != ErrNoMessages {
+		t.Fatal("Expected ErrNoMessages, got", err)
+	}
+}
+
+func TestSelectedStoreFlags(t *testing.T) {
+	m := NewManager()
+	mbox, conn := openSelected(t, m, 1, 2)
+	other, otherConn := openSelected(t, m, 1, 2)
+	defer mbox.Close()
+	defer other.Close()
+
+	var (
+		gotUids  *imap.SeqSet
+		gotFlags []string
+	)
+	update := func(uids *imap.SeqSet, op imap.FlagsOp, flags []string) (map[uint32][]string, error) {
+		gotUids, gotFlags = uids, flags
+		return map[uint32][]string{2: flags}, nil
+	}
+
+	set, _ := imap.ParseSeqSet("2")
+	if err := mbox.StoreFlags(false, set, imap.SetFlags, true, []string{imap.RecentFlag, imap.SeenFlag}, update); err != nil {
+		t.Fatal(err)
+	}
+	if gotUids.String() != "2" || !reflect.DeepEqual(gotFlags, []string{imap.SeenFlag}) {
+		t.Fatal("Unexpected update arguments:", gotUids, gotFlags)
+	}
+	if upds := conn.take(); len(upds) != 0 {
+		t.Fatal("FETCH sent for .SILENT STORE:", upds)
+	}
+
+	other.Command(CmdSeq)()
+	upds := otherConn.take()
+	if len(upds) != 1 || upds[0].(*backend.MessageUpdate).SeqNum != 2 {
+		t.Fatal("Expected 2 FETCH for other connection, got", upds)
+	}
+
+	// UID STORE for missing messages is not an error and does not call update.
+	gotUids = nil
+	set, _ = imap.ParseSeqSet("1:*")
+	mbox.Handle.Removed(1)
+	mbox.Handle.Removed(2)
+	mbox.Poll(true)
+	if err := mbox.StoreFlags(true, set, imap.AddFlags, false, []string{imap.SeenFlag}, update); err != nil {
+		t.Fatal(err)
+	}
+	if gotUids != nil {
+		t.Fatal("update called for empty mailbox")
+	}
+}
+
+func TestSelectedStoreFlagsOrder(t *testing.T) {
+	m := NewManager()
+	uids := make([]uint32, 50)
+	for i := range uids {
+		uids[i] = uint32(i + 1)
+	}
+	mbox, conn := openSelected(t, m, uids...)
+	defer mbox.Close()
+
+	update := func(uids *imap.SeqSet, op imap.FlagsOp, flags []string) (map[uint32][]string, error) {
+		res := make(map[uint32][]string)
+		for i := uint32(1); i <= 50; i++ {
+			res[i] = flags
+		}
+		return res, nil
+	}
+
+	set, _ := imap.ParseSeqSet("1:*")
+	if err := mbox.StoreFlags(false, set, imap.AddFlags, false, []string{imap.SeenFlag}, update); err != nil {
+		t.Fatal(err)
+	}
+	upds := conn.take()
+	if len(upds) != 50 {
+		t.Fatal("Expected 50 FETCH, got", upds)
+	}
+	for i, upd := range upds {
+		if seq := upd.(*backend.MessageUpdate).SeqNum; seq != uint32(i+1) {
+			t.Fatalf("FETCH %d has seq %d, want %d", i, seq, i+1)
+		}
+	}
+}
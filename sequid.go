@@ -41,6 +41,9 @@ func uidToSeq(uidMap []uint32, seq imap.Seq) (imap.Seq, bool) {
 		return uselessSeq, false
 	} else {
 		if initial.Start == initial.Stop {
+			if uidMap[seq.Start-1] != initial.Start {
+				return uselessSeq, false
+			}
 			return imap.Seq{Start: seq.Start, Stop: seq.Start}, true
 		}
 
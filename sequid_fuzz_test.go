@@ -0,0 +1,101 @@
+//go:build go1.18
+// +build go1.18
+
+package mess
+
+import (
+	"testing"
+
+	"github.com/emersion/go-imap"
+)
+
+// fuzzUidMap builds a sorted list of unique UIDs from arbitrary bytes.
+func fuzzUidMap(data []byte) []uint32 {
+	uidMap := make([]uint32, 0, len(data))
+	uid := uint32(0)
+	for _, b := range data {
+		uid += uint32(b) + 1
+		uidMap = append(uidMap, uid)
+	}
+	return uidMap
+}
+
+func FuzzUidToSeq(f *testing.F) {
+	f.Add([]byte{1, 1, 1, 0, 0}, uint32(2), uint32(8))
+	f.Add([]byte{1, 1}, uint32(3), uint32(3))
+	f.Add([]byte{}, uint32(0), uint32(0))
+	f.Fuzz(func(t *testing.T, data []byte, start, stop uint32) {
+		uidMap := fuzzUidMap(data)
+
+		seq, ok := uidToSeq(uidMap, imap.Seq{Start: start, Stop: stop})
+
+		if len(uidMap) == 0 {
+			if ok {
+				t.Fatalf("Empty map resolved to %v", seq)
+			}
+			return
+		}
+		last := uidMap[len(uidMap)-1]
+		if start == 0 {
+			start = last
+		}
+		if stop == 0 {
+			stop = last
+		}
+		if start > stop {
+			// Reversed ranges are handled by the callers.
+			return
+		}
+
+		var first, end uint32
+		for i, uid := range uidMap {
+			if uid >= start && uid <= stop {
+				if first == 0 {
+					first = uint32(i + 1)
+				}
+				end = uint32(i + 1)
+			}
+		}
+		if first == 0 {
+			if ok {
+				t.Fatalf("%d:%d in %v: expected no match, got %v", start, stop, uidMap, seq)
+			}
+			return
+		}
+		if !ok || seq.Start != first || seq.Stop != end {
+			t.Fatalf("%d:%d in %v: expected %d:%d, got %v (ok: %v)", start, stop, uidMap, first, end, seq, ok)
+		}
+	})
+}
+
+func FuzzSeqToUid(f *testing.F) {
+	f.Add([]byte{1, 1, 1, 0, 0}, uint32(2), uint32(4))
+	f.Add([]byte{1}, uint32(0), uint32(0))
+	f.Add([]byte{}, uint32(1), uint32(1))
+	f.Fuzz(func(t *testing.T, data []byte, start, stop uint32) {
+		uidMap := fuzzUidMap(data)
+
+		seq, ok := seqToUid(uidMap, imap.Seq{Start: start, Stop: stop})
+
+		count := uint32(len(uidMap))
+		if start == 0 {
+			start = count
+		}
+		if stop == 0 || stop > count {
+			stop = count
+		}
+		if start == 0 || start > count {
+			if ok {
+				t.Fatalf("%d:%d in %v: expected no match, got %v", start, stop, uidMap, seq)
+			}
+			return
+		}
+		if start > stop {
+			return
+		}
+
+		if !ok || seq.Start != uidMap[start-1] || seq.Stop != uidMap[stop-1] {
+			t.Fatalf("%d:%d in %v: expected %d:%d, got %v (ok: %v)", start, stop, uidMap, uidMap[start-1], uidMap[stop-1], seq, ok)
+		}
+	})
+}
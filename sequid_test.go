@@ -82,6 +82,7 @@ func TestUidToSeq(t *testing.T) {
 	test(imap.Seq{Start: 3, Stop: 5}, imap.Seq{Start: 2, Stop: 2}, false)
 	test(imap.Seq{Start: 9, Stop: 10}, uselessSeq, true)
 	test(imap.Seq{Start: 1, Stop: 1}, uselessSeq, true)
+	test(imap.Seq{Start: 3, Stop: 3}, uselessSeq, true)
 
 	uidMap = []uint32{}
 	test(imap.Seq{Start: 1}, uselessSeq, true)
@@ -1,27 +1,90 @@
 package mess
 
 import (
+	"context"
+	"hash/maphash"
 	"strconv"
 	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/emersion/go-imap"
 	"github.com/emersion/go-imap/backend"
 )
 
 type Manager struct {
-	handlesLock sync.RWMutex
-	handles     map[interface{}]*sharedHandle
-
-	sink chan<- Update
+	// Accessed atomically, kept first for 64-bit alignment.
+	lastTraceID  uint64
+	lastHandleID uint64
+
+	seed   maphash.Seed
+	shards [shardCount]handlesShard
+	// shardMask selects the shard from the key hash. Benchmarks set it to
+	// zero to compare with the single handles map.
+	shardMask uint64
+
+	closeLock sync.RWMutex
+	closed    bool
+	// emitting tracks updates being sent to the sink, abortEmit is closed
+	// by Shutdown to stop waiting for them.
+	emitting  sync.WaitGroup
+	abortEmit chan struct{}
+
+	sink        chan<- Update
+	accountSubs accountSubs
 
 	ExternalSubscribe   func(key interface{})
 	ExternalUnsubscribe func(key interface{})
+
+	// ExternalFlush is called by Shutdown after the sink is closed to let the
+	// transport deliver remaining updates.
+	ExternalFlush func(ctx context.Context) error
+
+	// ErrorHook, if set, is called for all errors that cannot be
+	// returned to the caller directly or that operators should be aware of,
+	// e.g. discarded cluster updates.
+	ErrorHook func(err error)
+
+	// RecentArbiter, if set, is used to make sure only one session across all
+	// nodes gets \Recent for each message.
+	RecentArbiter RecentArbiter
+
+	// DisableRecent enables IMAP4rev2 (RFC 9051) mode: \Recent is not
+	// tracked, RECENT responses are never sent, recents passed to Mailbox
+	// are ignored and NewMessages always returns false.
+	DisableRecent bool
+
+	// Tracer, if set, receives lifecycle events for all keys and handles.
+	Tracer Tracer
+
+	// IdleTTL is the time after which a handle not used by any command
+	// is considered leaked by Reap. Zero value disables the check.
+	//
+	// The handle is used by View, Sync, BeginCommand, EndCommand and
+	// methods resolving sequence numbers.
+	IdleTTL time.Duration
+
+	// DebugLeaks enables recording of the stack traces for all created
+	// handles so they can be reported by Reap. This is expensive.
+	DebugLeaks bool
+
+	// FlagsCacheSize is the maximum amount of messages per handle for which
+	// the last reported flags are remembered to skip FETCH responses that
+	// would not change anything. Zero value means DefaultFlagsCacheSize,
+	// negative value disables the cache.
+	FlagsCacheSize int
 }
 
 func NewManager() *Manager {
-	return &Manager{
-		handles: make(map[interface{}]*sharedHandle),
+	m := &Manager{
+		seed:      maphash.MakeSeed(),
+		shardMask: shardCount - 1,
+		abortEmit: make(chan struct{}),
+	}
+	for i := range m.shards {
+		m.shards[i].handles = make(map[interface{}]*sharedHandle)
 	}
+	return m
 }
 
 type Mailbox interface {
@@ -39,6 +102,7 @@ type Mailbox interface {
 func (m *Manager) ManagementHandle(key interface{}, uids []uint32, recents *imap.SeqSet) *MailboxHandle {
 	return &MailboxHandle{
 		m:      m,
+		id:     atomic.AddUint64(&m.lastHandleID, 1),
 		key:    key,
 		recent: recents,
 		uidMap: uids,
@@ -48,16 +112,43 @@ func (m *Manager) ManagementHandle(key interface{}, uids []uint32, recents *imap
 // Mailbox initializes a new message handle for the mailbox.
 //
 // key should be a server-global unique identifier for the mailbox.
-// uids should contain the list of all message UIDs existing in the mailbox.
+// uids should contain the list of all message UIDs existing in the mailbox
+// sorted in ascending order.
 //
 // recents should contain the list of message UIDs with persistent \Recent flag.
 // Note that persistent \Recent should be unset once passed to Mailbox().
 // In particular, two subsequent calls should not receive the same value.
+// If RecentArbiter is set, messages already claimed by other sessions are
+// not considered \Recent.
+//
+// If mbox implements SessionMailbox, the returned metadata is saved and
+// reported by Sessions.
 func (m *Manager) Mailbox(key interface{}, mbox Mailbox, uids []uint32, recents *imap.SeqSet) (*MailboxHandle, error) {
-	m.handlesLock.Lock()
-	defer m.handlesLock.Unlock()
+	if m.isClosed() {
+		return nil, ErrManagerClosed
+	}
+
+	conn := mbox.Conn()
+	var (
+		keywords    []string
+		allowNew    bool
+		hasKeywords bool
+	)
+	if kwMbox, ok := mbox.(KeywordsMailbox); ok {
+		keywords, allowNew = kwMbox.Keywords()
+		hasKeywords = true
+	}
+	if recents == nil || m.DisableRecent {
+		recents = &imap.SeqSet{}
+	} else if !recents.Empty() {
+		recents = m.claimRecent(key, recents)
+	}
+
+	shard := m.shard(key)
+	shard.lock.Lock()
+	defer shard.lock.Unlock()
 
-	sharedHndl, ok := m.handles[key]
+	sharedHndl, ok := shard.handles[key]
 	if sharedHndl == nil {
 		sharedHndl = &sharedHandle{
 			key:     key,
@@ -67,24 +158,44 @@ func (m *Manager) Mailbox(key interface{}, mbox Mailbox, uids []uint32, recents
 
 	handle := &MailboxHandle{
 		m:            m,
+		id:           atomic.AddUint64(&m.lastHandleID, 1),
 		key:          key,
 		shared:       sharedHndl,
-		conn:         mbox.Conn(),
+		conn:         conn,
+		info:         sessionInfo(mbox),
+		stack:        creationStack(m),
 		uidMap:       uids,
 		recent:       recents,
+		recentCount:  uint32(seqSetCount(recents)),
 		pendingFlags: make([]flagsUpdate, 0, 1),
 	}
-	for _, set := range recents.Set {
-		for i := set.Start; i <= set.Stop; i++ {
-			handle.recentCount++
+	handle.touch()
+
+	if m.tracing() {
+		ev := TraceEvent{
+			Kind:   TraceOpen,
+			Key:    key,
+			Handle: handle.id,
+			UIDs:   uids,
+			Recent: recents,
+		}
+		if hasKeywords {
+			ev.Keywords = append([]string{}, keywords...)
+			ev.AllowNewKeywords = allowNew
 		}
+		m.trace(ev)
+	}
+
+	if hasKeywords {
+		sharedHndl.seedKeywords(keywords, allowNew)
 	}
 
 	sharedHndl.handlesLock.Lock()
-	sharedHndl.handles[handle] = struct{}{}
+	sharedHndl.addHandle(handle)
 	sharedHndl.handlesLock.Unlock()
 	if !ok {
-		m.handles[key] = sharedHndl
+		shard.handles[key] = sharedHndl
+		m.trace(TraceEvent{Kind: TraceSubscribe, Key: key})
 		if m.ExternalSubscribe != nil {
 			m.ExternalSubscribe(key)
 		}
@@ -98,87 +209,85 @@ func (m *Manager) Mailbox(key interface{}, mbox Mailbox, uids []uint32, recents
 //
 // Return value indicates whether backend should store
 // a persistent \Recent flag in DB for further retrieval
-// (see Mailbox)
-func (m *Manager) NewMessages(key interface{}, uid imap.SeqSet) (storeRecent bool) {
-	if m.sink != nil {
-		m.sink <- Update{
-			Type:   UpdNewMessage,
-			Key:    key,
-			SeqSet: uid.String(),
-		}
+// (see Mailbox). ErrManagerClosed is returned after Shutdown,
+// storeRecent is set in this case.
+func (m *Manager) NewMessages(key interface{}, uid imap.SeqSet) (storeRecent bool, err error) {
+	if m.isClosed() {
+		return true, ErrManagerClosed
+	}
+
+	upd := Update{
+		Type:   UpdNewMessage,
+		Key:    key,
+		SeqSet: uid.String(),
 	}
+	traceID := m.traceUpdate(&upd, false)
+	m.emit(upd)
 
-	return m.newMessages(key, uid)
+	return m.newMessages(key, uid, traceID), nil
 }
 
-func (m *Manager) newMessages(key interface{}, uid imap.SeqSet) (storeRecent bool) {
-	m.handlesLock.RLock()
-	defer m.handlesLock.RUnlock()
+func (m *Manager) newMessages(key interface{}, uid imap.SeqSet, traceID uint64) (storeRecent bool) {
+	storeRecent, _ = m.dispatchNew(key, &uid, traceID)
+	return storeRecent
+}
 
-	handle := m.handles[key]
-	if handle == nil {
-		return false
+// NewMessage is similar to NewMessages but storeRecent is also set if there
+// are no sessions for the key.
+func (m *Manager) NewMessage(key interface{}, uid uint32) (storeRecent bool, err error) {
+	if m.isClosed() {
+		return true, ErrManagerClosed
 	}
 
-	handle.handlesLock.RLock()
-	defer handle.handlesLock.RUnlock()
-
-	addedRecent := false
-	for hndl := range handle.handles {
-		hndl.lock.Lock()
-		hndl.pendingCreated.AddSet(&uid)
-		if !addedRecent {
-			hndl.recent.AddSet(&uid)
-			for _, set := range uid.Set {
-				for i := set.Start; i <= set.Stop; i++ {
-					hndl.recentCount++
-				}
-			}
-			hndl.hasNewRecent = true
-			addedRecent = true
-		}
-		hndl.idleUpdate()
-		hndl.lock.Unlock()
+	upd := Update{
+		Type:   UpdNewMessage,
+		Key:    key,
+		SeqSet: strconv.FormatUint(uint64(uid), 10),
 	}
+	traceID := m.traceUpdate(&upd, false)
+	m.emit(upd)
 
-	return !addedRecent
+	storeRecent, ok := m.dispatchNew(key, &imap.SeqSet{Set: []imap.Seq{{Start: uid, Stop: uid}}}, traceID)
+	if !ok {
+		return !m.DisableRecent, nil
+	}
+	return storeRecent, nil
 }
 
-func (m *Manager) NewMessage(key interface{}, uid uint32) (storeRecent bool) {
-	if m.sink != nil {
-		m.sink <- Update{
-			Type:   UpdNewMessage,
-			Key:    key,
-			SeqSet: strconv.FormatUint(uint64(uid), 10),
-		}
+// dispatchNew queues new messages for all sessions of the key and assigns
+// \Recent to one of them. ok is false if there are no sessions.
+func (m *Manager) dispatchNew(key interface{}, uid *imap.SeqSet, traceID uint64) (storeRecent, ok bool) {
+	var recent *imap.SeqSet
+	if !m.DisableRecent {
+		recent = uid
 	}
-
-	m.handlesLock.RLock()
-	defer m.handlesLock.RUnlock()
-
-	handle := m.handles[key]
-	if handle == nil {
-		return true
+	if recent != nil && m.RecentArbiter != nil {
+		// Claim may be slow, so it is called without locks held and only if
+		// there is a session to assign \Recent to. If all sessions are gone
+		// before the messages are queued, claimed \Recent flags are lost.
+		if !m.hasSessions(key) {
+			return false, false
+		}
+		recent = m.claimRecent(key, uid)
 	}
 
-	handle.handlesLock.RLock()
-	defer handle.handlesLock.RUnlock()
-
-	addedRecent := false
-	for hndl := range handle.handles {
-		hndl.lock.Lock()
-		hndl.pendingCreated.AddNum(uid)
-		if !addedRecent {
-			hndl.recent.AddNum(uid)
-			hndl.hasNewRecent = true
-			hndl.recentCount++
-			addedRecent = true
-		}
-		hndl.idleUpdate()
-		hndl.lock.Unlock()
+	m.withShared(key, func(shared *sharedHandle) {
+		ok = shared.newMessages(uid, recent, traceID)
+	})
+	if !ok || recent == nil {
+		return false, ok
 	}
+	return seqSetCount(recent) != seqSetCount(uid), true
+}
 
-	return !addedRecent
+// hasSessions reports whether any session has the mailbox selected.
+func (m *Manager) hasSessions(key interface{}) (ok bool) {
+	m.withShared(key, func(shared *sharedHandle) {
+		shared.handlesLock.RLock()
+		ok = len(shared.handles) != 0
+		shared.handlesLock.RUnlock()
+	})
+	return ok
 }
 
 // MailboxDestroyed should be called when the specified key is no longer
@@ -191,70 +300,73 @@ func (m *Manager) NewMessage(key interface{}, uid uint32) (storeRecent bool) {
 //
 // In all cases it is better to call MailboxDestroyed _after_
 // physically deleting the mailbox.
-func (m *Manager) MailboxDestroyed(key interface{}) {
-	if m.sink != nil {
-		m.sink <- Update{
-			Type: UpdMboxDestroyed,
-			Key:  key,
-		}
+func (m *Manager) MailboxDestroyed(key interface{}) error {
+	if m.isClosed() {
+		return ErrManagerClosed
+	}
+
+	upd := Update{
+		Type: UpdMboxDestroyed,
+		Key:  key,
 	}
+	m.traceUpdate(&upd, false)
+	m.emit(upd)
 
 	m.mailboxDestroyed(key)
+	return nil
 }
 
 func (m *Manager) mailboxDestroyed(key interface{}) {
-	m.handlesLock.RLock()
-	defer m.handlesLock.RUnlock()
+	m.forgetRecent(key)
+
+	shard := m.shard(key)
+	shard.lock.Lock()
+	defer shard.lock.Unlock()
 
-	handle := m.handles[key]
+	handle := shard.handles[key]
 	if handle == nil {
 		return
 	}
 
 	handle.handlesLock.Lock()
-	handle.handles = nil
+	handle.clearHandles()
 	handle.handlesLock.Unlock()
 
-	delete(m.handles, key)
+	delete(shard.handles, key)
+	m.unsubscribe(key)
+}
 
+// unsubscribe should be called when the last handle for the key is
+// removed.
+func (m *Manager) unsubscribe(key interface{}) {
+	m.trace(TraceEvent{Kind: TraceUnsubscribe, Key: key})
 	if m.ExternalUnsubscribe != nil {
 		m.ExternalUnsubscribe(key)
 	}
 }
 
-func (m *Manager) removedSet(key interface{}, seq imap.SeqSet) {
-	m.handlesLock.RLock()
-	defer m.handlesLock.RUnlock()
+// withShared calls f for the sharedHandle of the key, if there is any.
+func (m *Manager) withShared(key interface{}, f func(shared *sharedHandle)) {
+	shard := m.shard(key)
+	shard.lock.RLock()
+	defer shard.lock.RUnlock()
 
-	handle := m.handles[key]
-	if handle == nil {
+	shared := shard.handles[key]
+	if shared == nil {
 		return
 	}
-
-	handle.handlesLock.RLock()
-	defer handle.handlesLock.RUnlock()
-
-	for hndl := range handle.handles {
-		hndl.lock.Lock()
-		hndl.pendingExpunge.AddSet(&seq)
-		hndl.idleUpdate()
-		hndl.lock.Unlock()
-	}
+	f(shared)
 }
 
-func (m *Manager) flagsChanged(key interface{}, uid uint32, newFlags []string) {
-	m.handlesLock.RLock()
-	defer m.handlesLock.RUnlock()
-
-	handle := m.handles[key]
-	if handle == nil {
-		return
-	}
-
-	handle.handlesLock.RLock()
-	defer handle.handlesLock.RUnlock()
+func (m *Manager) removedSet(key interface{}, seq imap.SeqSet, traceID uint64) {
+	m.withShared(key, func(shared *sharedHandle) {
+		shared.removed(&seq, traceID)
+	})
+}
 
-	for hndl := range handle.handles {
-		hndl.enqueueFlagsUpdate(uid, newFlags)
-	}
+func (m *Manager) flagsChanged(key interface{}, uid uint32, newFlags []string, traceID uint64) {
+	m.withShared(key, func(shared *sharedHandle) {
+		shared.addKeywords(newFlags)
+		shared.flagsChanged(uid, newFlags, nil, traceID)
+	})
 }
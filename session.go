@@ -0,0 +1,118 @@
+package mess
+
+import (
+	"net"
+	"time"
+
+	"github.com/emersion/go-imap"
+)
+
+// SessionInfo contains the session metadata provided by the backend for
+// administrative purposes.
+type SessionInfo struct {
+	Username   string
+	RemoteAddr net.Addr
+	// ClientID contains parameters sent by the client using the ID
+	// command (RFC 2971), if any.
+	ClientID   map[string]string
+	ReadOnly   bool
+	SelectedAt time.Time
+}
+
+// SessionMailbox can be implemented by the Mailbox passed to Manager.Mailbox
+// to provide the session metadata returned by Manager.Sessions.
+type SessionMailbox interface {
+	Mailbox
+	SessionInfo() SessionInfo
+}
+
+// Session describes a live MailboxHandle.
+type Session struct {
+	SessionInfo
+	Key interface{}
+
+	// PendingUpdates is the amount of updates queued for the session
+	// that were not sent yet.
+	PendingUpdates int
+}
+
+func sessionInfo(mbox Mailbox) SessionInfo {
+	var info SessionInfo
+	if sessMbox, ok := mbox.(SessionMailbox); ok {
+		info = sessMbox.SessionInfo()
+	}
+
+	if info.RemoteAddr == nil {
+		// go-imap server connections provide the address.
+		if c, ok := mbox.Conn().(interface{ Info() *imap.ConnInfo }); ok {
+			if connInfo := c.Info(); connInfo != nil {
+				info.RemoteAddr = connInfo.RemoteAddr
+			}
+		}
+	}
+	if info.SelectedAt.IsZero() {
+		info.SelectedAt = time.Now()
+	}
+
+	return info
+}
+
+// seqSetCount returns the amount of numbers in the set. Ranges ending with *
+// are counted as a single number since the value of * is not known.
+func seqSetCount(set *imap.SeqSet) int {
+	var count int64
+	for _, seq := range set.Set {
+		if seq.Stop == 0 {
+			count++
+			continue
+		}
+		count += int64(seq.Stop) - int64(seq.Start) + 1
+	}
+	return int(count)
+}
+
+// seqSetIntersect returns the numbers present in both sets. Sets should not
+// contain *.
+func seqSetIntersect(a, b *imap.SeqSet) imap.SeqSet {
+	var res imap.SeqSet
+	for _, x := range a.Set {
+		for _, y := range b.Set {
+			start, stop := x.Start, x.Stop
+			if y.Start > start {
+				start = y.Start
+			}
+			if y.Stop < stop {
+				stop = y.Stop
+			}
+			if start <= stop {
+				res.AddRange(start, stop)
+			}
+		}
+	}
+	return res
+}
+
+// Sessions returns the information about all sessions that have a mailbox
+// selected.
+func (m *Manager) Sessions() []Session {
+	var sessions []Session
+	m.forEachShard(func(shard *handlesShard) {
+		for key, shared := range shard.handles {
+			shared.handlesLock.RLock()
+			for hndl := range shared.handles {
+				hndl.lock.RLock()
+				sessions = append(sessions, Session{
+					SessionInfo: hndl.info,
+					Key:         key,
+					PendingUpdates: len(hndl.pendingFlags) +
+						seqSetCount(&hndl.pendingExpunge) +
+						seqSetCount(&hndl.pendingCreated),
+				})
+				hndl.lock.RUnlock()
+			}
+			shared.handlesLock.RUnlock()
+		}
+	})
+
+	return sessions
+}
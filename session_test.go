@@ -0,0 +1,77 @@
+package mess
+
+import (
+	"testing"
+	"time"
+
+	"github.com/emersion/go-imap"
+)
+
+type testSessionMailbox struct {
+	testMailbox
+	info SessionInfo
+}
+
+func (mbox testSessionMailbox) SessionInfo() SessionInfo {
+	return mbox.info
+}
+
+func TestSessions(t *testing.T) {
+	m := NewManager()
+
+	selectedAt := time.Now().Add(-time.Minute)
+	mbox := testSessionMailbox{
+		testMailbox: testMailbox{conn: &testConn{}},
+		info: SessionInfo{
+			Username:   "foxcpp",
+			ClientID:   map[string]string{"name": "imaptest"},
+			ReadOnly:   true,
+			SelectedAt: selectedAt,
+		},
+	}
+	if _, err := m.Mailbox("INBOX", mbox, []uint32{1}, &imap.SeqSet{}); err != nil {
+		t.Fatal(err)
+	}
+	openTestHandle(m, "INBOX", 1)
+
+	m.NewMessage("INBOX", 2)
+	m.NewMessage("INBOX", 3)
+	m.ExternalUpdate(Update{Type: UpdFlags, Key: "INBOX", SeqSet: "1", NewFlags: []string{imap.SeenFlag}})
+
+	sessions := m.Sessions()
+	if len(sessions) != 2 {
+		t.Fatal("Expected 2 sessions, got", sessions)
+	}
+	found := false
+	for _, sess := range sessions {
+		if sess.Key != "INBOX" || sess.PendingUpdates != 3 {
+			t.Fatal("Unexpected session:", sess)
+		}
+		if sess.SelectedAt.IsZero() {
+			t.Fatal("SelectedAt is not set")
+		}
+		if sess.Username == "foxcpp" {
+			found = true
+			if !sess.ReadOnly || sess.ClientID["name"] != "imaptest" || !sess.SelectedAt.Equal(selectedAt) {
+				t.Fatal("Session metadata is not preserved:", sess)
+			}
+		}
+	}
+	if !found {
+		t.Fatal("Session with metadata not found")
+	}
+}
+
+func TestSessionsPendingStar(t *testing.T) {
+	m := NewManager()
+	openTestHandle(m, "INBOX", 1, 2, 3)
+
+	if err := m.ExternalUpdate(Update{Type: UpdRemoved, Key: "INBOX", SeqSet: "2:*"}); err != nil {
+		t.Fatal(err)
+	}
+
+	sessions := m.Sessions()
+	if len(sessions) != 1 || sessions[0].PendingUpdates != 1 {
+		t.Fatal("Unexpected sessions:", sessions)
+	}
+}
@@ -0,0 +1,61 @@
+package mess
+
+import (
+	"encoding/binary"
+	"hash/maphash"
+	"sync"
+)
+
+// shardCount is the amount of independently locked parts the handles map is
+// split into. Should be a power of two.
+const shardCount = 64
+
+type handlesShard struct {
+	lock    sync.RWMutex
+	handles map[interface{}]*sharedHandle
+}
+
+func (m *Manager) shard(key interface{}) *handlesShard {
+	var h maphash.Hash
+	h.SetSeed(m.seed)
+
+	switch key := key.(type) {
+	case string:
+		h.WriteString(key)
+	case MailboxKey:
+		h.WriteString(key.Account)
+		h.WriteByte(0)
+		h.WriteString(key.MailboxID)
+	case int:
+		writeUint64(&h, uint64(key))
+	case int64:
+		writeUint64(&h, uint64(key))
+	case uint32:
+		writeUint64(&h, uint64(key))
+	case uint64:
+		writeUint64(&h, key)
+	default:
+		// Other key types are rare. There is no generic way to hash a value
+		// consistently with ==, e.g. formatting a pointer key prints the
+		// value it points to, so they are all kept in the same shard.
+		return &m.shards[0]
+	}
+
+	return &m.shards[h.Sum64()&m.shardMask]
+}
+
+func writeUint64(h *maphash.Hash, v uint64) {
+	var buf [8]byte
+	binary.LittleEndian.PutUint64(buf[:], v)
+	h.Write(buf[:])
+}
+
+// forEachShard calls f for all shards with the shard lock held for reading.
+func (m *Manager) forEachShard(f func(shard *handlesShard)) {
+	for i := range m.shards {
+		shard := &m.shards[i]
+		shard.lock.RLock()
+		f(shard)
+		shard.lock.RUnlock()
+	}
+}
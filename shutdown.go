@@ -0,0 +1,149 @@
+package mess
+
+import (
+	"context"
+	"errors"
+	"sync"
+)
+
+var ErrManagerClosed = errors.New("Manager is shut down")
+
+// shutdownReason is the text of BYE sent to sessions by Shutdown.
+const shutdownReason = "Server is shutting down"
+
+// Shutdown stops the Manager. It is meant to be called on process shutdown
+// before the IMAP server closes client connections, so pending updates
+// can still be delivered.
+//
+// It performs the following steps in order:
+// 1. Stops accepting updates. Later calls to Mailbox, Shutdown and methods
+// generating updates return ErrManagerClosed.
+// 2. Marks all sessions as closed, similarly to CloseSessions. Each session
+// sends pending updates followed by BYE on its next Sync or EndCommand call,
+// EXPUNGE responses are sent only if allowed for the call. Sessions in IDLE
+// are woken up to do that immediately and Shutdown waits for them.
+// 3. Waits for updates being written to the channel set using
+// SetExternalSink and closes it.
+// 4. Calls ExternalUnsubscribe for all keys.
+// 5. Calls ExternalFlush, if set, so the transport can deliver serialized
+// updates before process exits.
+//
+// If ctx is done before all steps are complete, remaining steps except for
+// sink closure are skipped and ctx.Err() is returned. Sessions in IDLE that
+// did not accept updates in time are abandoned, their sends may stay blocked
+// until the connection is closed.
+func (m *Manager) Shutdown(ctx context.Context) error {
+	m.closeLock.Lock()
+	if m.closed {
+		m.closeLock.Unlock()
+		return ErrManagerClosed
+	}
+	m.closed = true
+	m.closeLock.Unlock()
+
+	var handles []*MailboxHandle
+	m.forEachShard(func(shard *handlesShard) {
+		for _, shared := range shard.handles {
+			shared.handlesLock.RLock()
+			for hndl := range shared.handles {
+				handles = append(handles, hndl)
+			}
+			shared.handlesLock.RUnlock()
+		}
+	})
+
+	// backend.Conn should not be used outside of the connection goroutine,
+	// so sessions are only asked to flush updates and terminate.
+	var idling []chan struct{}
+	for _, hndl := range handles {
+		hndl.lock.Lock()
+		if !hndl.closed {
+			hndl.markClosed(shutdownReason)
+			hndl.byeFlush = true
+			if hndl.idleerNotify != nil {
+				hndl.byeSent = make(chan struct{})
+				idling = append(idling, hndl.byeSent)
+				hndl.idleUpdate()
+			}
+		}
+		hndl.lock.Unlock()
+	}
+
+	err := ctx.Err()
+	for _, sent := range idling {
+		if err != nil {
+			break
+		}
+		select {
+		case <-sent:
+		case <-ctx.Done():
+			err = ctx.Err()
+		}
+	}
+
+	// Updates emitted before the shutdown may still be blocked on the full
+	// sink.
+	if emitErr := waitGroup(ctx, &m.emitting); emitErr != nil {
+		close(m.abortEmit)
+		m.emitting.Wait()
+		if err == nil {
+			err = emitErr
+		}
+	}
+
+	m.closeLock.Lock()
+	if m.sink != nil {
+		close(m.sink)
+		m.sink = nil
+	}
+	m.closeLock.Unlock()
+
+	if err != nil {
+		return err
+	}
+
+	for i := range m.shards {
+		shard := &m.shards[i]
+		shard.lock.Lock()
+		for key, shared := range shard.handles {
+			shared.handlesLock.Lock()
+			shared.clearHandles()
+			shared.handlesLock.Unlock()
+
+			delete(shard.handles, key)
+			m.unsubscribe(key)
+		}
+		shard.lock.Unlock()
+	}
+
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	if m.ExternalFlush != nil {
+		return m.ExternalFlush(ctx)
+	}
+	return nil
+}
+
+// waitGroup waits for wg or ctx, whichever is done first.
+func waitGroup(ctx context.Context, wg *sync.WaitGroup) error {
+	done := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (m *Manager) isClosed() bool {
+	m.closeLock.RLock()
+	defer m.closeLock.RUnlock()
+	return m.closed
+}
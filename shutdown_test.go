@@ -0,0 +1,165 @@
+package mess
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/emersion/go-imap"
+	"github.com/emersion/go-imap/backend"
+)
+
+func TestShutdown(t *testing.T) {
+	m := NewManager()
+
+	upds := make(chan Update, 10)
+	m.SetExternalSink(upds)
+
+	var steps []string
+	m.ExternalUnsubscribe = func(key interface{}) {
+		steps = append(steps, "unsubscribe "+key.(string))
+	}
+	m.ExternalFlush = func(ctx context.Context) error {
+		steps = append(steps, "flush")
+		return nil
+	}
+
+	hndl, conn := openTestHandle(m, "INBOX", 1)
+	m.NewMessage("INBOX", 2)
+	<-upds
+
+	if err := m.Shutdown(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	// Updates are sent from the session goroutine.
+	if upds := conn.take(); len(upds) != 0 {
+		t.Fatal("Updates sent outside of the session:", upds)
+	}
+	hndl.Sync(false)
+	upds2 := conn.take()
+	if len(upds2) != 3 {
+		t.Fatal("Expected pending EXISTS, RECENT and BYE, got", upds2)
+	}
+	if status, ok := upds2[2].(*backend.StatusUpdate); !ok || status.Type != imap.StatusRespBye {
+		t.Fatal("Expected BYE, got", upds2[2])
+	}
+	if _, ok := <-upds; ok {
+		t.Fatal("Sink is not closed")
+	}
+	if len(steps) != 2 || steps[0] != "unsubscribe INBOX" || steps[1] != "flush" {
+		t.Fatal("Unexpected steps:", steps)
+	}
+
+	if _, err := m.Mailbox("INBOX", testMailbox{conn: &testConn{}}, nil, nil); err != ErrManagerClosed {
+		t.Fatal("Expected ErrManagerClosed, got", err)
+	}
+	if err := m.Shutdown(context.Background()); err != ErrManagerClosed {
+		t.Fatal("Expected ErrManagerClosed, got", err)
+	}
+
+	// Must not panic on closed sink.
+	if storeRecent, err := m.NewMessage("INBOX", 3); !storeRecent || err != ErrManagerClosed {
+		t.Fatal("Expected storeRecent and ErrManagerClosed after shutdown, got", storeRecent, err)
+	}
+	if err := hndl.FlagsChanged(1, nil, false); err != ErrManagerClosed {
+		t.Fatal("Expected ErrManagerClosed, got", err)
+	}
+	if err := hndl.Removed(1); err != ErrManagerClosed {
+		t.Fatal("Expected ErrManagerClosed, got", err)
+	}
+	hndl.Sync(true)
+	if upds := conn.take(); len(upds) != 0 {
+		t.Fatal("Unexpected updates after shutdown:", upds)
+	}
+	if err := hndl.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestShutdownIdle(t *testing.T) {
+	m := NewManager()
+	hndl, conn := openTestHandle(m, "INBOX", 1, 2)
+	defer hndl.Close()
+	other, _ := openTestHandle(m, "INBOX", 1, 2)
+	defer other.Close()
+
+	done := make(chan struct{})
+	idleDone := make(chan struct{})
+	go func() {
+		hndl.Idle(done)
+		close(idleDone)
+	}()
+	for hndl.Command() != CmdIdle {
+		time.Sleep(time.Millisecond)
+	}
+	other.Removed(1)
+
+	// The session that is not in IDLE is not waited for.
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := m.Shutdown(ctx); err != nil {
+		t.Fatal(err)
+	}
+	close(done)
+	<-idleDone
+
+	upds := conn.take()
+	if len(upds) != 2 || upds[0].(*backend.ExpungeUpdate).SeqNum != 1 {
+		t.Fatal("Expected EXPUNGE and BYE, got", upds)
+	}
+	if status, ok := upds[1].(*backend.StatusUpdate); !ok || status.Type != imap.StatusRespBye {
+		t.Fatal("Expected BYE, got", upds[1])
+	}
+}
+
+type blockingConn struct {
+	unblock chan struct{}
+}
+
+func (c blockingConn) SendUpdate(upd backend.Update) error {
+	<-c.unblock
+	return nil
+}
+
+type blockingMailbox struct {
+	backend.Mailbox
+	conn blockingConn
+}
+
+func (mbox blockingMailbox) Conn() backend.Conn {
+	return mbox.conn
+}
+
+func TestShutdownStuck(t *testing.T) {
+	m := NewManager()
+	upds := make(chan Update)
+	m.SetExternalSink(upds)
+
+	conn := blockingConn{unblock: make(chan struct{})}
+	defer close(conn.unblock)
+	if _, err := m.Mailbox("INBOX", blockingMailbox{conn: conn}, []uint32{1}, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	// Nobody reads the sink.
+	emitted := make(chan struct{})
+	go func() {
+		m.NewMessage("INBOX", 2)
+		close(emitted)
+	}()
+	time.Sleep(10 * time.Millisecond)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if err := m.Shutdown(ctx); err != context.DeadlineExceeded {
+		t.Fatal("Expected context.DeadlineExceeded, got", err)
+	}
+	<-emitted
+	if _, ok := <-upds; ok {
+		t.Fatal("Sink is not closed")
+	}
+	if !m.isClosed() {
+		t.Fatal("Manager is not closed")
+	}
+}
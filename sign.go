@@ -0,0 +1,215 @@
+package mess
+
+import (
+	"bufio"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+	"time"
+)
+
+// signedVersion is the first byte of signed frames. It does not clash with
+// codecVersion so unsigned frames can be recognized.
+const signedVersion = 0x81
+
+var (
+	ErrUnsigned     = errors.New("Update is not signed")
+	ErrUnknownKey   = errors.New("Update is signed with unknown key")
+	ErrBadSignature = errors.New("Update signature mismatch")
+	ErrStaleUpdate  = errors.New("Update timestamp is out of the allowed range")
+	ErrCurrentKey   = errors.New("Current signing key cannot be removed")
+	ErrNoSuchKey    = errors.New("No such key")
+)
+
+// Keyring is the set of HMAC keys used for signing and verification of
+// updates. It is safe for concurrent use.
+//
+// To rotate keys without losing updates, Add the new key on all nodes, then
+// make it current using SetCurrent and Remove the old key once updates signed
+// with it are no longer accepted (see NewVerifyingDecoder).
+//
+// The zero value has no keys, SetCurrent should be called after adding the
+// first key. Until then, signing fails with ErrNoSuchKey.
+type Keyring struct {
+	lock    sync.RWMutex
+	current string
+	keys    map[string][]byte
+}
+
+// NewKeyring creates the Keyring with a single key used for signing.
+func NewKeyring(id string, key []byte) *Keyring {
+	return &Keyring{
+		current: id,
+		keys:    map[string][]byte{id: key},
+	}
+}
+
+// Add adds the key that is accepted for verification.
+func (k *Keyring) Add(id string, key []byte) {
+	k.lock.Lock()
+	defer k.lock.Unlock()
+	if k.keys == nil {
+		k.keys = make(map[string][]byte)
+	}
+	k.keys[id] = key
+}
+
+// SetCurrent sets the key used for signing.
+func (k *Keyring) SetCurrent(id string) error {
+	k.lock.Lock()
+	defer k.lock.Unlock()
+	if _, ok := k.keys[id]; !ok {
+		return ErrNoSuchKey
+	}
+	k.current = id
+	return nil
+}
+
+func (k *Keyring) Remove(id string) error {
+	k.lock.Lock()
+	defer k.lock.Unlock()
+	if id == k.current {
+		return ErrCurrentKey
+	}
+	delete(k.keys, id)
+	return nil
+}
+
+func (k *Keyring) currentKey() (string, []byte, bool) {
+	k.lock.RLock()
+	defer k.lock.RUnlock()
+	key, ok := k.keys[k.current]
+	return k.current, key, ok
+}
+
+func (k *Keyring) key(id string) ([]byte, bool) {
+	k.lock.RLock()
+	defer k.lock.RUnlock()
+	key, ok := k.keys[id]
+	return key, ok
+}
+
+type signingEncoder struct {
+	fw   frameWriter
+	keys *Keyring
+	now  func() time.Time
+}
+
+// NewSigningEncoder returns the Encoder that writes updates in the binary
+// format (see NewEncoder) signed using HMAC-SHA256 with the current key from
+// keys.
+//
+// The signature covers the key ID, timestamp and the encoded update.
+func NewSigningEncoder(w io.Writer, keys *Keyring) Encoder {
+	return &signingEncoder{
+		fw:   frameWriter{w: w},
+		keys: keys,
+		now:  time.Now,
+	}
+}
+
+func (e *signingEncoder) Encode(upd Update) error {
+	id, key, ok := e.keys.currentKey()
+	if !ok {
+		return ErrNoSuchKey
+	}
+
+	frame := e.fw.begin()
+	start := len(frame)
+	frame = append(frame, signedVersion)
+	frame = appendUvarint(frame, uint64(len(id)))
+	frame = append(frame, id...)
+	var ts [8]byte
+	binary.BigEndian.PutUint64(ts[:], uint64(e.now().UnixNano()))
+	frame = append(frame, ts[:]...)
+
+	frame, err := appendFrame(frame, upd)
+	if err != nil {
+		return err
+	}
+
+	mac := hmac.New(sha256.New, key)
+	mac.Write(frame[start:])
+	frame = mac.Sum(frame)
+
+	return e.fw.write(frame)
+}
+
+type verifyingDecoder struct {
+	fr     frameReader
+	keys   *Keyring
+	maxAge time.Duration
+	now    func() time.Time
+}
+
+// NewVerifyingDecoder returns the Decoder for updates written by
+// NewSigningEncoder.
+//
+// Updates that are unsigned, signed with a key not in keys, have a wrong
+// signature or timestamp that differs from the local time by more than maxAge
+// are rejected with ErrUnsigned, ErrUnknownKey, ErrBadSignature or
+// ErrStaleUpdate respectively. Zero maxAge disables the timestamp check.
+//
+// Note that updates can still be replayed within maxAge.
+func NewVerifyingDecoder(r io.Reader, keys *Keyring, maxAge time.Duration) Decoder {
+	return &verifyingDecoder{
+		fr:     frameReader{r: bufio.NewReader(r)},
+		keys:   keys,
+		maxAge: maxAge,
+		now:    time.Now,
+	}
+}
+
+func (d *verifyingDecoder) Decode(upd *Update) error {
+	frame, err := d.fr.read()
+	if err != nil {
+		return err
+	}
+
+	if len(frame) == 0 {
+		return ErrMalformedUpdate
+	}
+	switch frame[0] {
+	case signedVersion:
+	case codecVersion:
+		return ErrUnsigned
+	default:
+		return fmt.Errorf("%w: %d", ErrCodecVersion, frame[0])
+	}
+
+	idLen, rest, err := readUvarint(frame[1:])
+	if err != nil {
+		return err
+	}
+	if idLen > uint64(len(rest)) || len(rest)-int(idLen) < 8+sha256.Size {
+		return ErrMalformedUpdate
+	}
+	id := string(rest[:idLen])
+	rest = rest[idLen:]
+	ts := time.Unix(0, int64(binary.BigEndian.Uint64(rest[:8])))
+	payload := rest[8 : len(rest)-sha256.Size]
+	sig := rest[len(rest)-sha256.Size:]
+
+	key, ok := d.keys.key(id)
+	if !ok {
+		return fmt.Errorf("%w: %q", ErrUnknownKey, id)
+	}
+	mac := hmac.New(sha256.New, key)
+	mac.Write(frame[:len(frame)-sha256.Size])
+	if !hmac.Equal(mac.Sum(nil), sig) {
+		return ErrBadSignature
+	}
+
+	if d.maxAge != 0 {
+		age := d.now().Sub(ts)
+		if age > d.maxAge || age < -d.maxAge {
+			return fmt.Errorf("%w: %v", ErrStaleUpdate, ts)
+		}
+	}
+
+	return decodeFrame(payload, upd)
+}
@@ -0,0 +1,138 @@
+package mess
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"errors"
+	"io"
+	"testing"
+	"time"
+)
+
+func TestSignedRoundtrip(t *testing.T) {
+	var buf bytes.Buffer
+	keys := NewKeyring("k1", []byte("secret"))
+	testCodecRoundtrip(t, NewSigningEncoder(&buf, keys), NewVerifyingDecoder(&buf, keys, time.Minute))
+}
+
+func TestSignedReject(t *testing.T) {
+	upd := Update{Type: UpdRemoved, Key: "INBOX", SeqSet: "1"}
+	keys := NewKeyring("k1", []byte("secret"))
+
+	decode := func(buf *bytes.Buffer, keys *Keyring) error {
+		var upd Update
+		return NewVerifyingDecoder(buf, keys, time.Minute).Decode(&upd)
+	}
+
+	var buf bytes.Buffer
+	NewEncoder(&buf).Encode(upd)
+	if err := decode(&buf, keys); err != ErrUnsigned {
+		t.Error("Expected ErrUnsigned, got", err)
+	}
+
+	NewSigningEncoder(&buf, NewKeyring("k2", []byte("secret"))).Encode(upd)
+	if err := decode(&buf, keys); !errors.Is(err, ErrUnknownKey) {
+		t.Error("Expected ErrUnknownKey, got", err)
+	}
+
+	NewSigningEncoder(&buf, NewKeyring("k1", []byte("other secret"))).Encode(upd)
+	if err := decode(&buf, keys); err != ErrBadSignature {
+		t.Error("Expected ErrBadSignature, got", err)
+	}
+
+	NewSigningEncoder(&buf, keys).Encode(upd)
+	tampered := buf.Bytes()
+	tampered[len(tampered)-sha256.Size-2] ^= 1
+	if err := decode(&buf, keys); err != ErrBadSignature {
+		t.Error("Expected ErrBadSignature for tampered frame, got", err)
+	}
+
+	enc := NewSigningEncoder(&buf, keys).(*signingEncoder)
+	enc.now = func() time.Time { return time.Now().Add(-time.Hour) }
+	enc.Encode(upd)
+	if err := decode(&buf, keys); !errors.Is(err, ErrStaleUpdate) {
+		t.Error("Expected ErrStaleUpdate, got", err)
+	}
+}
+
+func TestKeyringRotation(t *testing.T) {
+	var buf bytes.Buffer
+	keys := NewKeyring("k1", []byte("secret1"))
+	peerKeys := NewKeyring("k1", []byte("secret1"))
+	enc := NewSigningEncoder(&buf, keys)
+	dec := NewVerifyingDecoder(&buf, peerKeys, 0)
+
+	keys.Add("k2", []byte("secret2"))
+	peerKeys.Add("k2", []byte("secret2"))
+	if err := keys.SetCurrent("k3"); err != ErrNoSuchKey {
+		t.Error("Expected ErrNoSuchKey, got", err)
+	}
+	if err := keys.SetCurrent("k2"); err != nil {
+		t.Fatal(err)
+	}
+
+	var upd Update
+	enc.Encode(Update{Type: UpdMboxDestroyed, Key: "INBOX"})
+	if err := dec.Decode(&upd); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := keys.Remove("k2"); err != ErrCurrentKey {
+		t.Error("Expected ErrCurrentKey, got", err)
+	}
+	keys.Remove("k1")
+	peerKeys.Remove("k1")
+	enc.Encode(Update{Type: UpdMboxDestroyed, Key: "INBOX"})
+	if err := dec.Decode(&upd); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestKeyringZero(t *testing.T) {
+	var buf bytes.Buffer
+	var keys Keyring
+	keys.Add("k1", []byte("secret"))
+
+	enc := NewSigningEncoder(&buf, &keys)
+	if err := enc.Encode(Update{Type: UpdMboxDestroyed, Key: "INBOX"}); err != ErrNoSuchKey {
+		t.Fatal("Expected ErrNoSuchKey without the current key, got", err)
+	}
+	if buf.Len() != 0 {
+		t.Fatal("Frame written without the current key")
+	}
+
+	if err := keys.SetCurrent("k1"); err != nil {
+		t.Fatal(err)
+	}
+	testCodecRoundtrip(t, NewSigningEncoder(&buf, &keys), NewVerifyingDecoder(&buf, &keys, time.Minute))
+}
+
+func TestExternalStream(t *testing.T) {
+	var buf bytes.Buffer
+	keys := NewKeyring("k1", []byte("secret"))
+	NewSigningEncoder(&buf, NewKeyring("k1", []byte("attacker"))).Encode(Update{Type: UpdRemoved, Key: "INBOX", SeqSet: "1"})
+	NewSigningEncoder(&buf, keys).Encode(Update{Type: UpdRemoved, Key: "INBOX", SeqSet: "2"})
+
+	m := NewManager()
+	var reported []error
+	m.ErrorHook = func(err error) {
+		reported = append(reported, err)
+	}
+	hndl, _ := openTestHandle(m, "INBOX", 1, 2)
+
+	if err := m.ExternalStream(NewVerifyingDecoder(&buf, keys, time.Minute)); err != nil {
+		t.Fatal(err)
+	}
+	if len(reported) != 1 || !errors.Is(reported[0], ErrBadSignature) {
+		t.Fatal("Expected a single ErrBadSignature to be reported, got", reported)
+	}
+	hndl.Sync(true)
+	if uids := hndl.View().Uids(); len(uids) != 1 || uids[0] != 1 {
+		t.Error("Wrong messages after stream processing:", uids)
+	}
+
+	buf.Write([]byte{10, 1})
+	if err := m.ExternalStream(NewDecoder(&buf)); err != io.ErrUnexpectedEOF {
+		t.Error("Expected io.ErrUnexpectedEOF, got", err)
+	}
+}
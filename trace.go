@@ -0,0 +1,184 @@
+package mess
+
+import (
+	"sync/atomic"
+
+	"github.com/emersion/go-imap"
+)
+
+type TraceKind int
+
+const (
+	// TraceUpdate is recorded for each update generated locally or
+	// received via ExternalUpdate. Update and External are set. For
+	// updates generated by a handle, Handle is set to its ID and Silent
+	// indicates whether the handle itself was excluded from dispatch.
+	TraceUpdate TraceKind = iota
+	// TraceSubscribe is recorded when the first handle for the key is
+	// created.
+	TraceSubscribe
+	// TraceUnsubscribe is recorded when the last handle for the key is
+	// closed or the key is dropped.
+	TraceUnsubscribe
+	// TraceOpen is recorded when a handle is created. UIDs and Recent are
+	// set to values passed to Manager.Mailbox. If the mailbox implements
+	// KeywordsMailbox, Keywords is set to non-nil slice and AllowNewKeywords
+	// is set.
+	TraceOpen
+	// TraceClose is recorded when a handle is closed.
+	TraceClose
+	// TraceEnqueue is recorded when an update is queued for a handle. UIDs
+	// contains the affected messages.
+	TraceEnqueue
+	// TraceFlush is recorded when pending updates are sent by Sync. TraceIDs
+	// contains IDs of all updates queued since the previous flush, Expunge
+	// is set to the Sync argument.
+	TraceFlush
+	// TraceExpunge is recorded when EXPUNGE responses are sent. SeqNums
+	// contains sent sequence numbers in the order they were sent.
+	TraceExpunge
+	// TraceFlagsSeen is recorded for MailboxHandle.FlagsSeen calls. UIDs
+	// contains the message, Flags contains the flags without \Recent.
+	TraceFlagsSeen
+)
+
+func (k TraceKind) String() string {
+	switch k {
+	case TraceUpdate:
+		return "update"
+	case TraceSubscribe:
+		return "subscribe"
+	case TraceUnsubscribe:
+		return "unsubscribe"
+	case TraceOpen:
+		return "open"
+	case TraceClose:
+		return "close"
+	case TraceEnqueue:
+		return "enqueue"
+	case TraceFlush:
+		return "flush"
+	case TraceExpunge:
+		return "expunge"
+	case TraceFlagsSeen:
+		return "flags-seen"
+	}
+	return "unknown"
+}
+
+// TraceEvent describes a single lifecycle event, see TraceKind values for
+// the meaning of fields.
+type TraceEvent struct {
+	Kind TraceKind
+	Key  interface{}
+
+	// Handle is the ID of the handle the event relates to, zero for
+	// per-key events.
+	Handle uint64
+
+	// TraceID is the correlation ID of the update that caused the event.
+	// It is propagated to other nodes via Update.TraceID.
+	TraceID  uint64
+	TraceIDs []uint64
+
+	Update   *Update
+	External bool
+	Silent   bool
+
+	UIDs    []uint32
+	SeqNums []uint32
+	Recent  *imap.SeqSet
+	Expunge bool
+	Flags   []string
+
+	Keywords         []string
+	AllowNewKeywords bool
+}
+
+// Tracer receives lifecycle events from the Manager for debugging purposes.
+//
+// Trace is called synchronously, often with internal locks held, so it
+// should not block and should not call Manager or MailboxHandle methods.
+type Tracer interface {
+	Trace(ev TraceEvent)
+}
+
+func (m *Manager) tracing() bool {
+	return m.Tracer != nil
+}
+
+func (m *Manager) trace(ev TraceEvent) {
+	if m.Tracer != nil {
+		m.Tracer.Trace(ev)
+	}
+}
+
+// traceUpdate assigns a correlation ID to the update and records it.
+//
+// Updates received from other nodes keep the original ID. Zero ID is
+// returned if tracing is disabled.
+func (m *Manager) traceUpdate(upd *Update, external bool) uint64 {
+	return m.recordUpdate(upd, TraceEvent{External: external})
+}
+
+// traceUpdate is similar to Manager.traceUpdate but records the update as
+// generated by the handle.
+func (handle *MailboxHandle) traceUpdate(upd *Update, silent bool) uint64 {
+	return handle.m.recordUpdate(upd, TraceEvent{
+		Handle: handle.id,
+		Silent: silent,
+	})
+}
+
+func (m *Manager) recordUpdate(upd *Update, ev TraceEvent) uint64 {
+	if !m.tracing() {
+		return 0
+	}
+
+	if upd.TraceID == 0 {
+		upd.TraceID = atomic.AddUint64(&m.lastTraceID, 1)
+	}
+	updCopy := *upd
+	ev.Kind = TraceUpdate
+	ev.Key = upd.Key
+	ev.TraceID = upd.TraceID
+	ev.Update = &updCopy
+	m.trace(ev)
+	return upd.TraceID
+}
+
+// traceEnqueue records the update for messages from set queued for the
+// handle.
+//
+// handle.lock should be held.
+func (handle *MailboxHandle) traceEnqueue(traceID uint64, set *imap.SeqSet) {
+	if !handle.m.tracing() {
+		return
+	}
+	handle.traceEnqueueUids(traceID, seqSetUids(set))
+}
+
+func (handle *MailboxHandle) traceEnqueueUids(traceID uint64, uids []uint32) {
+	if !handle.m.tracing() {
+		return
+	}
+
+	handle.pendingTraceIDs = append(handle.pendingTraceIDs, traceID)
+	handle.m.trace(TraceEvent{
+		Kind:    TraceEnqueue,
+		Key:     handle.key,
+		Handle:  handle.id,
+		TraceID: traceID,
+		UIDs:    uids,
+	})
+}
+
+func seqSetUids(set *imap.SeqSet) []uint32 {
+	var uids []uint32
+	for _, seq := range set.Set {
+		for uid := seq.Start; uid <= seq.Stop && uid != 0; uid++ {
+			uids = append(uids, uid)
+		}
+	}
+	return uids
+}
@@ -0,0 +1,104 @@
+package mess
+
+import (
+	"sync"
+	"testing"
+)
+
+type testTracer struct {
+	lock   sync.Mutex
+	events []TraceEvent
+}
+
+func (t *testTracer) Trace(ev TraceEvent) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	t.events = append(t.events, ev)
+}
+
+func (t *testTracer) kinds() []TraceKind {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	kinds := make([]TraceKind, 0, len(t.events))
+	for _, ev := range t.events {
+		kinds = append(kinds, ev.Kind)
+	}
+	return kinds
+}
+
+func TestTracer(t *testing.T) {
+	m := NewManager()
+	tracer := &testTracer{}
+	m.Tracer = tracer
+
+	upds := make(chan Update, 10)
+	m.SetExternalSink(upds)
+
+	hndl, _ := openTestHandle(m, "INBOX", 1)
+	m.NewMessage("INBOX", 2)
+	hndl.Removed(1)
+	hndl.Sync(true)
+	hndl.Close()
+
+	expected := []TraceKind{
+		TraceOpen, TraceSubscribe,
+		TraceUpdate, TraceEnqueue,
+		TraceUpdate, TraceEnqueue,
+		TraceFlush, TraceExpunge,
+		TraceClose, TraceUnsubscribe,
+	}
+	kinds := tracer.kinds()
+	if len(kinds) != len(expected) {
+		t.Fatalf("Expected %v, got %v", expected, kinds)
+	}
+	for i := range kinds {
+		if kinds[i] != expected[i] {
+			t.Fatalf("Expected %v, got %v", expected, kinds)
+		}
+	}
+
+	newMsg := tracer.events[2]
+	if newMsg.TraceID == 0 || newMsg.Update == nil || newMsg.Update.TraceID != newMsg.TraceID {
+		t.Fatal("Update event has no correlation ID:", newMsg)
+	}
+	if upd := <-upds; upd.TraceID != newMsg.TraceID {
+		t.Fatal("Correlation ID is not propagated to the sink:", upd)
+	}
+	flush := tracer.events[6]
+	if len(flush.TraceIDs) != 2 || flush.TraceIDs[0] != newMsg.TraceID || flush.Handle != tracer.events[0].Handle {
+		t.Fatal("Wrong flush event:", flush)
+	}
+	if expunge := tracer.events[7]; len(expunge.SeqNums) != 1 || expunge.SeqNums[0] != 1 {
+		t.Fatal("Wrong expunge event:", expunge)
+	}
+
+	// External updates keep the original ID.
+	tracer.events = nil
+	openTestHandle(m, "INBOX", 1)
+	m.ExternalUpdate(Update{Type: UpdRemoved, Key: "INBOX", SeqSet: "1", TraceID: 42})
+	if ev := tracer.events[2]; ev.Kind != TraceUpdate || !ev.External || ev.TraceID != 42 {
+		t.Fatal("Wrong external update event:", ev)
+	}
+	if ev := tracer.events[3]; ev.Kind != TraceEnqueue || ev.TraceID != 42 {
+		t.Fatal("Wrong enqueue event:", ev)
+	}
+}
+
+func TestTracerRemovedStar(t *testing.T) {
+	m := NewManager()
+	tracer := &testTracer{}
+	m.Tracer = tracer
+
+	openTestHandle(m, "INBOX", 1, 2, 3)
+	if err := m.ExternalUpdate(Update{Type: UpdRemoved, Key: "INBOX", SeqSet: "2:*"}); err != nil {
+		t.Fatal(err)
+	}
+
+	tracer.lock.Lock()
+	defer tracer.lock.Unlock()
+	for _, ev := range tracer.events {
+		if ev.Kind == TraceEnqueue && len(ev.UIDs) != 0 {
+			t.Fatal("Unexpected UIDs for 2:*:", ev.UIDs)
+		}
+	}
+}
@@ -1,6 +1,9 @@
 package mess
 
 import (
+	"errors"
+	"fmt"
+	"io"
 	"strconv"
 
 	"github.com/emersion/go-imap"
@@ -13,6 +16,8 @@ const (
 	UpdFlags
 	UpdRemoved
 	UpdMboxDestroyed
+	UpdCloseSessions
+	UpdKeywords
 )
 
 type Update struct {
@@ -20,17 +25,68 @@ type Update struct {
 	Key      interface{}
 	SeqSet   string   `json:",omitempty"`
 	NewFlags []string `json:",omitempty"`
+	Reason   string   `json:",omitempty"`
+
+	// TraceID is the correlation ID assigned to the update if tracing is
+	// enabled, see Tracer.
+	TraceID uint64 `json:",omitempty"`
+
+	// decoded is SeqSet as read by the binary Decoder.
+	decoded *decodedSeqSet
+}
+
+type decodedSeqSet struct {
+	str string
+	set imap.SeqSet
+}
+
+// seqSet returns the parsed SeqSet. The set read by the Decoder is used
+// unless SeqSet was changed after decoding.
+func (upd *Update) seqSet() (*imap.SeqSet, error) {
+	if upd.decoded != nil && upd.decoded.str == upd.SeqSet {
+		return &upd.decoded.set, nil
+	}
+	return imap.ParseSeqSet(upd.SeqSet)
+}
+
+// uid returns the UID from SeqSet containing a single message.
+func (upd *Update) uid() (uint32, error) {
+	if upd.decoded != nil && upd.decoded.str == upd.SeqSet {
+		if set := upd.decoded.set.Set; len(set) == 1 && set[0].Start == set[0].Stop && set[0].Start != 0 {
+			return set[0].Start, nil
+		}
+	}
+	uid, err := strconv.ParseUint(upd.SeqSet, 10, 32)
+	return uint32(uid), err
 }
 
 // ExternalUpdate deserializes externally received update and dispatches
 // it internal.
-func (m *Manager) ExternalUpdate(upd Update) {
+//
+// If the update cannot be dispatched, the error is returned and also passed
+// to ErrorHook. Malformed updates are reported using *UpdateError.
+func (m *Manager) ExternalUpdate(upd Update) error {
+	err := m.externalUpdate(upd)
+	if err != nil {
+		m.reportError(err)
+	}
+	return err
+}
+
+func (m *Manager) externalUpdate(upd Update) error {
+	if m.isClosed() {
+		return &UpdateError{Update: upd, Err: ErrManagerClosed}
+	}
+
+	traceID := m.traceUpdate(&upd, true)
+
 	switch upd.Type {
 	case UpdNewMessage:
-		seq, err := imap.ParseSeqSet(upd.SeqSet)
+		seq, err := upd.seqSet()
 		if err != nil {
-			return
+			return &UpdateError{Update: upd, Err: err}
 		}
+		m.notifyAccount(upd)
 
 		// We push back the responsibility of storing \Recent flag
 		// to the Manager object that generated the update in the first
@@ -39,24 +95,78 @@ func (m *Manager) ExternalUpdate(upd Update) {
 		// Such Manager will either assign \Recent to one of its local
 		// connections or return storeRecent so backend object using this
 		// Manager will save the flag.
-		m.newMessages(upd.Key, *seq)
+		//
+		// If RecentArbiter is used, only the node that claimed the
+		// message first assigns \Recent.
+		m.newMessages(upd.Key, *seq, traceID)
 	case UpdFlags:
-		uid, err := strconv.ParseUint(upd.SeqSet, 10, 32)
+		uid, err := upd.uid()
 		if err != nil {
-			return
+			return &UpdateError{Update: upd, Err: err}
 		}
+		m.notifyAccount(upd)
 
-		m.flagsChanged(upd.Key, uint32(uid), upd.NewFlags)
+		m.flagsChanged(upd.Key, uid, upd.NewFlags, traceID)
 	case UpdRemoved:
-		seq, err := imap.ParseSeqSet(upd.SeqSet)
+		seq, err := upd.seqSet()
 		if err != nil {
-			return
+			return &UpdateError{Update: upd, Err: err}
 		}
+		m.notifyAccount(upd)
 
-		m.removedSet(upd.Key, *seq)
+		m.removedSet(upd.Key, *seq, traceID)
 	case UpdMboxDestroyed:
+		m.notifyAccount(upd)
 		m.mailboxDestroyed(upd.Key)
+	case UpdCloseSessions:
+		m.notifyAccount(upd)
+		m.closeSessions(upd.Key, upd.Reason)
+	case UpdKeywords:
+		m.notifyAccount(upd)
+		m.keywordsAdded(upd.Key, upd.NewFlags)
+	default:
+		return &UpdateError{Update: upd, Err: ErrUnknownUpdateType}
 	}
+
+	return nil
+}
+
+// ExternalStream reads updates from dec and passes them to ExternalUpdate
+// until dec returns io.EOF.
+//
+// Updates rejected by the decoder (e.g. because of a bad signature) are
+// reported using ErrorHook and skipped, other decoding errors stop the
+// processing and are returned.
+func (m *Manager) ExternalStream(dec Decoder) error {
+	for {
+		var upd Update
+		err := dec.Decode(&upd)
+		switch {
+		case err == nil:
+			// Errors are reported by ExternalUpdate.
+			m.ExternalUpdate(upd)
+		case err == io.EOF:
+			return nil
+		case isRejected(err):
+			m.reportError(fmt.Errorf("Update rejected: %w", err))
+		default:
+			return err
+		}
+	}
+}
+
+// isRejected reports whether the decoding error is specific to one frame so
+// the stream can be processed further.
+func isRejected(err error) bool {
+	for _, rejected := range []error{
+		ErrUnsigned, ErrUnknownKey, ErrBadSignature, ErrStaleUpdate,
+		ErrMalformedUpdate, ErrCodecVersion,
+	} {
+		if errors.Is(err, rejected) {
+			return true
+		}
+	}
+	return false
 }
 
 // SetExternalSink sets the channel where all updates
@@ -67,6 +177,8 @@ func (m *Manager) ExternalUpdate(upd Update) {
 //
 // It is not safe to call SetExternalSink concurrently
 // with other operations.
+//
+// The channel is closed by Shutdown.
 func (m *Manager) SetExternalSink(upds chan<- Update) {
 	m.sink = upds
 }
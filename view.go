@@ -0,0 +1,164 @@
+package mess
+
+import (
+	"errors"
+
+	"github.com/emersion/go-imap"
+)
+
+var ErrNoMessages = errors.New("No messages matched")
+
+// View is an immutable snapshot of the sequence numbers, UIDs and \Recent flags
+// as seen by the connection at some point in time.
+//
+// It is meant to be obtained once per command so that sequence numbers can be
+// resolved without taking the handle lock for each message. The view is not
+// affected by further updates, including ones sent by Sync.
+type View struct {
+	closed bool
+	uidMap []uint32
+	recent *imap.SeqSet
+}
+
+// View returns the current snapshot of the connection state.
+//
+// Views of a closed session (see Manager.CloseSessions) contain no messages and
+// ResolveSeq returns ErrSessionClosed for them.
+func (handle *MailboxHandle) View() *View {
+	handle.touch()
+
+	handle.lock.RLock()
+	defer handle.lock.RUnlock()
+
+	// uidMap and recent are never modified in place, see syncUnlocked and
+	// addRecent.
+	return &View{
+		closed: handle.closed,
+		uidMap: handle.uidMap,
+		recent: handle.recent,
+	}
+}
+
+// addRecent adds UIDs to the recent set, copying it to keep existing views
+// intact.
+//
+// handle.lock should be held.
+func (handle *MailboxHandle) addRecent(uid *imap.SeqSet) {
+	recent := &imap.SeqSet{}
+	if handle.recent != nil {
+		recent.Set = make([]imap.Seq, len(handle.recent.Set), len(handle.recent.Set)+len(uid.Set))
+		copy(recent.Set, handle.recent.Set)
+	}
+	recent.AddSet(uid)
+	handle.recent = recent
+	handle.recentCount += uint32(seqSetCount(uid))
+}
+
+// ResolveSeq converts the passed UIDs or sequence numbers set into UIDs set
+// that is appropriate for mailbox operations in this connection.
+//
+// If resolution algorithm results in an empty set, ErrNoMessages is
+// returned.
+// Resulting set *may* include UIDs that were expunged in other
+// connections, backend should ignore these as specified in RFC 3501.
+func (v *View) ResolveSeq(uid bool, set *imap.SeqSet) (*imap.SeqSet, error) {
+	if v.closed {
+		return &imap.SeqSet{}, ErrSessionClosed
+	}
+
+	if len(v.uidMap) == 0 {
+		return &imap.SeqSet{}, ErrNoMessages
+	}
+
+	if uid {
+		for i, seq := range set.Set {
+			if seq.Start == 0 {
+				seq.Start = v.uidMap[len(v.uidMap)-1]
+			}
+			if seq.Stop == 0 {
+				seq.Stop = v.uidMap[len(v.uidMap)-1]
+			}
+
+			// Resolving certain UID sets may yield cases in which
+			// start value is bigger than stop. However, as opposed to
+			// seqnum sets, this is a valid and meaningful set
+			// that may be passed to backend as go-imap cannot sort it
+			// meaningfully.
+			//
+			// E.g. UIDNEXT:*  should be basically equivalent to *
+			// and refer to the last message.
+			if seq.Start > seq.Stop {
+				seq.Start, seq.Stop = seq.Stop, seq.Start
+			}
+
+			set.Set[i] = seq
+		}
+
+		return set, nil
+	}
+
+	result := &imap.SeqSet{}
+	for _, seq := range set.Set {
+		seq, ok := seqToUid(v.uidMap, seq)
+		if !ok {
+			continue
+		}
+		result.AddRange(seq.Start, seq.Stop)
+	}
+
+	if len(result.Set) == 0 {
+		return &imap.SeqSet{}, ErrNoMessages
+	}
+
+	return result, nil
+}
+
+// ResolveCriteria converts all SeqNum rules into corresponding Uid
+// rules. Argument is modified directly.
+func (v *View) ResolveCriteria(criteria *imap.SearchCriteria) {
+	if criteria.Uid != nil {
+		seq, _ := v.ResolveSeq(true, criteria.Uid)
+		criteria.Uid = seq
+	}
+	if criteria.SeqNum != nil {
+		if criteria.Uid == nil {
+			criteria.Uid = new(imap.SeqSet)
+		}
+		seq, _ := v.ResolveSeq(false, criteria.SeqNum)
+		criteria.Uid.AddSet(seq)
+		criteria.SeqNum = nil
+	}
+
+	for _, not := range criteria.Not {
+		v.ResolveCriteria(not)
+	}
+	for _, or := range criteria.Or {
+		v.ResolveCriteria(or[0])
+		v.ResolveCriteria(or[1])
+	}
+}
+
+func (v *View) UidAsSeq(uid uint32) (uint32, bool) {
+	seq, ok := uidToSeq(v.uidMap, imap.Seq{Start: uid, Stop: uid})
+	return seq.Start, ok
+}
+
+// IsRecent indicates whether the message should be considered
+// to have \Recent flag for this connection.
+func (v *View) IsRecent(uid uint32) bool {
+	if v.recent == nil {
+		return false
+	}
+	return v.recent.Contains(uid)
+}
+
+func (v *View) MsgsCount() int {
+	return len(v.uidMap)
+}
+
+// Uids returns the list of UIDs in the order of sequence numbers.
+//
+// Returned slice should not be modified.
+func (v *View) Uids() []uint32 {
+	return v.uidMap
+}
@@ -0,0 +1,49 @@
+package mess
+
+import (
+	"testing"
+
+	"github.com/emersion/go-imap"
+)
+
+func TestViewIsImmutable(t *testing.T) {
+	m := NewManager()
+	hndl, _ := openTestHandle(m, "INBOX", 1, 2, 3)
+	other, _ := openTestHandle(m, "INBOX", 1, 2, 3)
+
+	view := hndl.View()
+
+	hndl.Removed(2)
+	m.NewMessage("INBOX", 4)
+	hndl.Sync(true)
+	other.Sync(true)
+
+	if uids := view.Uids(); len(uids) != 3 || uids[0] != 1 || uids[1] != 2 || uids[2] != 3 {
+		t.Fatal("View modified by Sync:", uids)
+	}
+	if view.IsRecent(4) {
+		t.Fatal("View modified by NewMessage")
+	}
+	if seq, ok := view.UidAsSeq(3); !ok || seq != 3 {
+		t.Fatal("Wrong seq for UID 3 in old view:", seq, ok)
+	}
+
+	newView := hndl.View()
+	if newView.MsgsCount() != 3 {
+		t.Fatal("Wrong message count in new view:", newView.MsgsCount())
+	}
+	if seq, ok := newView.UidAsSeq(3); !ok || seq != 2 {
+		t.Fatal("Wrong seq for UID 3 in new view:", seq, ok)
+	}
+	if !newView.IsRecent(4) && !other.IsRecent(4) {
+		t.Fatal("UID 4 is not recent for any session")
+	}
+
+	set, err := newView.ResolveSeq(false, &imap.SeqSet{Set: []imap.Seq{{Start: 2, Stop: 0}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if set.String() != "3:4" {
+		t.Fatal("Wrong resolution result:", set)
+	}
+}
@@ -0,0 +1,328 @@
+package wrap
+
+import (
+	"bytes"
+	"errors"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/emersion/go-imap"
+	"github.com/emersion/go-imap/backend"
+	"github.com/emersion/go-imap/backend/backendutil"
+	"github.com/emersion/go-message"
+)
+
+var errSeqNums = errors.New("Wrapped mailbox called with sequence numbers")
+
+// testBackend is a minimal backend that knows nothing about sessions and
+// accepts only UIDs.
+type testBackend struct {
+	user *testUser
+}
+
+func newTestBackend() *testBackend {
+	return &testBackend{user: &testUser{
+		mailboxes: map[string]*testMailboxData{
+			"INBOX":   {},
+			"Archive": {},
+		},
+	}}
+}
+
+func (be *testBackend) Login(_ *imap.ConnInfo, username, password string) (backend.User, error) {
+	if username != "user" || password != "pass" {
+		return nil, backend.ErrInvalidCredentials
+	}
+	return be.user, nil
+}
+
+type testMessage struct {
+	uid   uint32
+	flags []string
+}
+
+type testMailboxData struct {
+	lastUid  uint32
+	messages []*testMessage
+	recent   imap.SeqSet
+}
+
+type testUser struct {
+	backend.User
+	lock      sync.Mutex
+	mailboxes map[string]*testMailboxData
+}
+
+func (u *testUser) Username() string {
+	return "user"
+}
+
+func (u *testUser) Logout() error {
+	return nil
+}
+
+func (u *testUser) ListMailboxes(bool) ([]imap.MailboxInfo, error) {
+	u.lock.Lock()
+	defer u.lock.Unlock()
+
+	var infos []imap.MailboxInfo
+	for name := range u.mailboxes {
+		infos = append(infos, imap.MailboxInfo{Name: name, Delimiter: "/"})
+	}
+	sort.Slice(infos, func(i, j int) bool { return infos[i].Name < infos[j].Name })
+	return infos, nil
+}
+
+func (u *testUser) CreateMessage(mbox string, flags []string, _ time.Time, _ imap.Literal, selected backend.Mailbox) error {
+	if _, ok := selected.(*testMailbox); selected != nil && !ok {
+		return errors.New("Selected mailbox is not unwrapped")
+	}
+
+	u.lock.Lock()
+	defer u.lock.Unlock()
+
+	data, ok := u.mailboxes[mbox]
+	if !ok {
+		return backend.ErrNoSuchMailbox
+	}
+	data.lastUid++
+	data.messages = append(data.messages, &testMessage{uid: data.lastUid, flags: flags})
+	return nil
+}
+
+func (u *testUser) RenameMailbox(existingName, newName string) error {
+	u.lock.Lock()
+	defer u.lock.Unlock()
+
+	data, ok := u.mailboxes[existingName]
+	if !ok {
+		return backend.ErrNoSuchMailbox
+	}
+	delete(u.mailboxes, existingName)
+	u.mailboxes[newName] = data
+	return nil
+}
+
+func (u *testUser) DeleteMailbox(name string) error {
+	u.lock.Lock()
+	defer u.lock.Unlock()
+
+	if _, ok := u.mailboxes[name]; !ok {
+		return backend.ErrNoSuchMailbox
+	}
+	delete(u.mailboxes, name)
+	return nil
+}
+
+func (u *testUser) GetMailbox(name string, readOnly bool, _ backend.Conn) (*imap.MailboxStatus, backend.Mailbox, error) {
+	u.lock.Lock()
+	defer u.lock.Unlock()
+
+	data, ok := u.mailboxes[name]
+	if !ok {
+		return nil, nil, backend.ErrNoSuchMailbox
+	}
+	status := imap.NewMailboxStatus(name, []imap.StatusItem{imap.StatusMessages, imap.StatusRecent})
+	status.Messages = uint32(len(data.messages))
+	return status, &testMailbox{user: u, name: name}, nil
+}
+
+func (u *testUser) UIDs(mbox string) ([]uint32, error) {
+	u.lock.Lock()
+	defer u.lock.Unlock()
+
+	data, ok := u.mailboxes[mbox]
+	if !ok {
+		return nil, backend.ErrNoSuchMailbox
+	}
+	uids := make([]uint32, 0, len(data.messages))
+	for _, msg := range data.messages {
+		uids = append(uids, msg.uid)
+	}
+	return uids, nil
+}
+
+func (u *testUser) Flags(mbox string, uids *imap.SeqSet) (map[uint32][]string, error) {
+	u.lock.Lock()
+	defer u.lock.Unlock()
+
+	flags := make(map[uint32][]string)
+	for _, msg := range u.mailboxes[mbox].messages {
+		if uids.Contains(msg.uid) {
+			flags[msg.uid] = append([]string(nil), msg.flags...)
+		}
+	}
+	return flags, nil
+}
+
+func (u *testUser) SetRecent(mbox string, uids *imap.SeqSet) error {
+	u.lock.Lock()
+	defer u.lock.Unlock()
+	u.mailboxes[mbox].recent.AddSet(uids)
+	return nil
+}
+
+func (u *testUser) TakeRecent(mbox string) (*imap.SeqSet, error) {
+	u.lock.Lock()
+	defer u.lock.Unlock()
+	data := u.mailboxes[mbox]
+	recent := data.recent
+	data.recent = imap.SeqSet{}
+	return &recent, nil
+}
+
+type testMailbox struct {
+	backend.Mailbox
+	user *testUser
+	name string
+}
+
+func (mbox *testMailbox) data() *testMailboxData {
+	return mbox.user.mailboxes[mbox.name]
+}
+
+func (mbox *testMailbox) Close() error {
+	return nil
+}
+
+func (mbox *testMailbox) ListMessages(uid bool, seqset *imap.SeqSet, items []imap.FetchItem, ch chan<- *imap.Message) error {
+	defer close(ch)
+	if !uid {
+		return errSeqNums
+	}
+
+	mbox.user.lock.Lock()
+	defer mbox.user.lock.Unlock()
+
+	for i, msg := range mbox.data().messages {
+		if !seqset.Contains(msg.uid) {
+			continue
+		}
+		fetched := imap.NewMessage(uint32(i+1), items)
+		for _, item := range items {
+			switch item {
+			case imap.FetchUid:
+				fetched.Uid = msg.uid
+			case imap.FetchFlags:
+				fetched.Flags = append([]string(nil), msg.flags...)
+			default:
+				sect, err := imap.ParseBodySectionName(item)
+				if err != nil {
+					continue
+				}
+				if !sect.Peek {
+					msg.flags = backendutil.UpdateFlags(msg.flags, imap.AddFlags, []string{imap.SeenFlag})
+				}
+			}
+		}
+		ch <- fetched
+	}
+	return nil
+}
+
+func (mbox *testMailbox) SearchMessages(uid bool, criteria *imap.SearchCriteria) ([]uint32, error) {
+	if !uid {
+		return nil, errSeqNums
+	}
+
+	mbox.user.lock.Lock()
+	defer mbox.user.lock.Unlock()
+
+	entity, err := message.New(message.Header{}, bytes.NewReader(nil))
+	if err != nil {
+		return nil, err
+	}
+
+	var uids []uint32
+	for i, msg := range mbox.data().messages {
+		ok, err := backendutil.Match(entity, uint32(i+1), msg.uid, time.Time{}, msg.flags, criteria)
+		if err != nil {
+			return nil, err
+		}
+		if ok {
+			uids = append(uids, msg.uid)
+		}
+	}
+	return uids, nil
+}
+
+func (mbox *testMailbox) UpdateMessagesFlags(uid bool, seqset *imap.SeqSet, op imap.FlagsOp, _ bool, flags []string) error {
+	if !uid {
+		return errSeqNums
+	}
+
+	mbox.user.lock.Lock()
+	defer mbox.user.lock.Unlock()
+
+	for _, msg := range mbox.data().messages {
+		if seqset.Contains(msg.uid) {
+			msg.flags = backendutil.UpdateFlags(msg.flags, op, flags)
+		}
+	}
+	return nil
+}
+
+func (mbox *testMailbox) CopyMessages(uid bool, seqset *imap.SeqSet, dest string) error {
+	if !uid {
+		return errSeqNums
+	}
+
+	mbox.user.lock.Lock()
+	defer mbox.user.lock.Unlock()
+
+	destData, ok := mbox.user.mailboxes[dest]
+	if !ok {
+		return backend.ErrNoSuchMailbox
+	}
+	for _, msg := range mbox.data().messages {
+		if seqset.Contains(msg.uid) {
+			destData.lastUid++
+			destData.messages = append(destData.messages, &testMessage{
+				uid:   destData.lastUid,
+				flags: append([]string(nil), msg.flags...),
+			})
+		}
+	}
+	return nil
+}
+
+func (mbox *testMailbox) MoveMessages(uid bool, seqset *imap.SeqSet, dest string) error {
+	if err := mbox.CopyMessages(uid, seqset, dest); err != nil {
+		return err
+	}
+
+	mbox.user.lock.Lock()
+	defer mbox.user.lock.Unlock()
+
+	data := mbox.data()
+	kept := data.messages[:0]
+	for _, msg := range data.messages {
+		if !seqset.Contains(msg.uid) {
+			kept = append(kept, msg)
+		}
+	}
+	data.messages = kept
+	return nil
+}
+
+func (mbox *testMailbox) Expunge() error {
+	mbox.user.lock.Lock()
+	defer mbox.user.lock.Unlock()
+
+	data := mbox.data()
+	kept := data.messages[:0]
+	for _, msg := range data.messages {
+		deleted := false
+		for _, f := range msg.flags {
+			if f == imap.DeletedFlag {
+				deleted = true
+			}
+		}
+		if !deleted {
+			kept = append(kept, msg)
+		}
+	}
+	data.messages = kept
+	return nil
+}
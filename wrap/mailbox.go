@@ -0,0 +1,347 @@
+package wrap
+
+import (
+	"time"
+
+	"github.com/emersion/go-imap"
+	"github.com/emersion/go-imap/backend"
+	mess "github.com/foxcpp/go-imap-mess"
+)
+
+// mailboxOps is backend.Mailbox without methods implemented by
+// mess.Selected.
+type mailboxOps interface {
+	Name() string
+	Info() (*imap.MailboxInfo, error)
+	ListMessages(uid bool, seqset *imap.SeqSet, items []imap.FetchItem, ch chan<- *imap.Message) error
+	SearchMessages(uid bool, criteria *imap.SearchCriteria) ([]uint32, error)
+	UpdateMessagesFlags(uid bool, seqset *imap.SeqSet, operation imap.FlagsOp, silent bool, flags []string) error
+	CopyMessages(uid bool, seqset *imap.SeqSet, dest string) error
+	Expunge() error
+}
+
+// Mailbox is the selected mailbox of the wrapped backend.
+//
+// Sequence numbers are resolved using the session view before calling the
+// wrapped mailbox, so it is always called with uid = true.
+type Mailbox struct {
+	mailboxOps
+	mess.Selected
+
+	inner      backend.Mailbox
+	user       *User
+	name       string
+	readOnly   bool
+	selectedAt time.Time
+}
+
+func (mbox *Mailbox) SessionInfo() mess.SessionInfo {
+	return mess.SessionInfo{
+		Username:   mbox.user.Username(),
+		ReadOnly:   mbox.readOnly,
+		SelectedAt: mbox.selectedAt,
+	}
+}
+
+func (mbox *Mailbox) key() mess.MailboxKey {
+	return mbox.user.key(mbox.name)
+}
+
+func (mbox *Mailbox) Close() error {
+	err := mbox.Selected.Close()
+	if innerErr := mbox.inner.Close(); err == nil {
+		err = innerErr
+	}
+	return err
+}
+
+// resolve converts the set to UIDs, nil set is returned if no messages
+// matched the UID set.
+func resolve(view *mess.View, uid bool, seqset *imap.SeqSet) (*imap.SeqSet, error) {
+	// ResolveSeq modifies UID sets in place.
+	seqset = &imap.SeqSet{Set: append([]imap.Seq(nil), seqset.Set...)}
+	set, err := view.ResolveSeq(uid, seqset)
+	if err != nil {
+		// UID commands with no matching messages are not an error
+		// (RFC 3501, section 6.4.8).
+		if uid && err == mess.ErrNoMessages {
+			return nil, nil
+		}
+		return nil, err
+	}
+	return set, nil
+}
+
+func withoutRecent(flags []string) []string {
+	res := make([]string, 0, len(flags))
+	for _, f := range flags {
+		if f != imap.RecentFlag {
+			res = append(res, f)
+		}
+	}
+	return res
+}
+
+// sameFlags reports whether a and b contain the same flags.
+func sameFlags(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	counts := make(map[string]int, len(a))
+	for _, f := range a {
+		counts[f]++
+	}
+	for _, f := range b {
+		if counts[f] == 0 {
+			return false
+		}
+		counts[f]--
+	}
+	return true
+}
+
+// flagsChanged reads the current flags of the messages from the storage and
+// dispatches them. If before is not nil, only flags that differ from it are
+// dispatched.
+func (mbox *Mailbox) flagsChanged(uids *imap.SeqSet, before map[uint32][]string, silent bool) error {
+	flags, err := mbox.user.storage.Flags(mbox.name, uids)
+	if err != nil {
+		return err
+	}
+	for uid, msgFlags := range flags {
+		msgFlags = withoutRecent(msgFlags)
+		if before != nil && sameFlags(withoutRecent(before[uid]), msgFlags) {
+			continue
+		}
+		mbox.Handle.FlagsChanged(uid, msgFlags, silent)
+	}
+	return nil
+}
+
+func (mbox *Mailbox) ListMessages(uid bool, seqset *imap.SeqSet, items []imap.FetchItem, ch chan<- *imap.Message) error {
+	defer mbox.Command(mess.CommandFor(uid))()
+
+	view := mbox.Handle.View()
+	set, err := resolve(view, uid, seqset)
+	if err != nil || set == nil {
+		close(ch)
+		return err
+	}
+
+	hasUid, hasFlags, setsSeen := false, false, false
+	for _, item := range items {
+		switch item {
+		case imap.FetchUid:
+			hasUid = true
+		case imap.FetchFlags:
+			hasFlags = true
+		default:
+			sect, err := imap.ParseBodySectionName(item)
+			if err == nil && !sect.Peek {
+				setsSeen = true
+			}
+		}
+	}
+	setsSeen = setsSeen && !mbox.readOnly
+
+	// Only messages that were not \Seen before are reported.
+	var before map[uint32][]string
+	if setsSeen {
+		before, err = mbox.user.storage.Flags(mbox.name, set)
+		if err != nil {
+			close(ch)
+			return err
+		}
+	}
+
+	innerItems := items
+	if !hasUid {
+		innerItems = append([]imap.FetchItem{imap.FetchUid}, items...)
+	}
+
+	innerCh := make(chan *imap.Message)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		defer close(ch)
+		for msg := range innerCh {
+			seq, ok := view.UidAsSeq(msg.Uid)
+			if !ok {
+				continue
+			}
+			msg.SeqNum = seq
+			if hasFlags {
+				msg.Flags = withoutRecent(msg.Flags)
+				if view.IsRecent(msg.Uid) {
+					msg.Flags = append(msg.Flags, imap.RecentFlag)
+				}
+				mbox.Handle.FlagsSeen(msg.Uid, msg.Flags)
+			}
+			ch <- msg
+		}
+	}()
+
+	err = mbox.inner.ListMessages(true, set, innerItems, innerCh)
+	<-done
+	if err != nil {
+		return err
+	}
+
+	if setsSeen {
+		return mbox.flagsChanged(set, before, false)
+	}
+	return nil
+}
+
+// resolveRecent replaces \Recent in flag criteria with UID sets since the
+// wrapped backend does not know which messages are recent for the session.
+func resolveRecent(view *mess.View, criteria *imap.SearchCriteria) {
+	recent := func() *imap.SeqSet {
+		set := &imap.SeqSet{}
+		for _, uid := range view.Uids() {
+			if view.IsRecent(uid) {
+				set.AddNum(uid)
+			}
+		}
+		return set
+	}
+
+	if flags := withoutRecent(criteria.WithFlags); len(flags) != len(criteria.WithFlags) {
+		criteria.WithFlags = flags
+		// NOT NOT UID recent, SearchCriteria has no AND list.
+		criteria.Not = append(criteria.Not, &imap.SearchCriteria{
+			Not: []*imap.SearchCriteria{{Uid: recent()}},
+		})
+	}
+	if flags := withoutRecent(criteria.WithoutFlags); len(flags) != len(criteria.WithoutFlags) {
+		criteria.WithoutFlags = flags
+		criteria.Not = append(criteria.Not, &imap.SearchCriteria{Uid: recent()})
+	}
+
+	for _, not := range criteria.Not {
+		resolveRecent(view, not)
+	}
+	for _, or := range criteria.Or {
+		resolveRecent(view, or[0])
+		resolveRecent(view, or[1])
+	}
+}
+
+func (mbox *Mailbox) SearchMessages(uid bool, criteria *imap.SearchCriteria) ([]uint32, error) {
+	defer mbox.Command(mess.CommandFor(uid))()
+
+	view := mbox.Handle.View()
+	view.ResolveCriteria(criteria)
+	resolveRecent(view, criteria)
+
+	uids, err := mbox.inner.SearchMessages(true, criteria)
+	if err != nil {
+		return nil, err
+	}
+
+	ids := uids[:0]
+	for _, msgUid := range uids {
+		seq, ok := view.UidAsSeq(msgUid)
+		if !ok {
+			continue
+		}
+		if uid {
+			ids = append(ids, msgUid)
+		} else {
+			ids = append(ids, seq)
+		}
+	}
+	return ids, nil
+}
+
+func (mbox *Mailbox) UpdateMessagesFlags(uid bool, seqset *imap.SeqSet, op imap.FlagsOp, silent bool, flags []string) error {
+	defer mbox.Command(mess.CommandFor(uid))()
+
+	set, err := resolve(mbox.Handle.View(), uid, seqset)
+	if err != nil || set == nil {
+		return err
+	}
+
+	if err := mbox.inner.UpdateMessagesFlags(true, set, op, silent, withoutRecent(flags)); err != nil {
+		return err
+	}
+	return mbox.flagsChanged(set, nil, silent)
+}
+
+func (mbox *Mailbox) CopyMessages(uid bool, seqset *imap.SeqSet, dest string) error {
+	defer mbox.Command(mess.CmdUid)()
+
+	set, err := resolve(mbox.Handle.View(), uid, seqset)
+	if err != nil || set == nil {
+		return err
+	}
+
+	defer mbox.user.be.lock(mbox.user.key(dest))()
+
+	before, err := mbox.user.storage.UIDs(dest)
+	if err != nil {
+		return err
+	}
+	if err := mbox.inner.CopyMessages(true, set, dest); err != nil {
+		return err
+	}
+	return mbox.user.newMessages(dest, before)
+}
+
+func (mbox *Mailbox) Expunge() error {
+	defer mbox.Command(mess.CmdUid)()
+	defer mbox.user.be.lock(mbox.key())()
+
+	return mbox.removed(mbox.inner.Expunge)
+}
+
+// removed calls f and reports messages removed from the mailbox by it.
+//
+// The mailbox lock should be held.
+func (mbox *Mailbox) removed(f func() error) error {
+	before, err := mbox.user.storage.UIDs(mbox.name)
+	if err != nil {
+		return err
+	}
+	if err := f(); err != nil {
+		return err
+	}
+	after, err := mbox.user.storage.UIDs(mbox.name)
+	if err != nil {
+		return err
+	}
+
+	if _, removed := diffUids(before, after); !removed.Empty() {
+		mbox.Handle.RemovedSet(removed)
+	}
+	return nil
+}
+
+// MoveMailbox is the Mailbox returned if the wrapped mailbox implements
+// backend.MoveMailbox.
+type MoveMailbox struct {
+	*Mailbox
+}
+
+func (mbox *MoveMailbox) MoveMessages(uid bool, seqset *imap.SeqSet, dest string) error {
+	defer mbox.Command(mess.CmdUid)()
+
+	set, err := resolve(mbox.Handle.View(), uid, seqset)
+	if err != nil || set == nil {
+		return err
+	}
+
+	defer mbox.user.be.lockPair(mbox.key(), mbox.user.key(dest))()
+
+	before, err := mbox.user.storage.UIDs(dest)
+	if err != nil {
+		return err
+	}
+	err = mbox.removed(func() error {
+		return mbox.inner.(backend.MoveMailbox).MoveMessages(true, set, dest)
+	})
+	if err != nil {
+		return err
+	}
+	return mbox.user.newMessages(dest, before)
+}
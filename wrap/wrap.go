@@ -0,0 +1,319 @@
+// Package wrap adds update dispatching using go-imap-mess to an existing
+// go-imap backend.
+//
+// The wrapped backend does not need to know about the Manager. Instead,
+// changes are detected by comparing the mailbox contents reported by the
+// Storage interface before and after each operation, and sequence numbers
+// are translated using the session view so the backend only needs to
+// handle UIDs.
+//
+// Only changes made through the wrapper are detected. Backends that share
+// storage with other processes should pass changes made there to the Manager
+// directly (e.g. using SetExternalSink and ExternalUpdate).
+package wrap
+
+import (
+	"errors"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/emersion/go-imap"
+	"github.com/emersion/go-imap/backend"
+	mess "github.com/foxcpp/go-imap-mess"
+)
+
+var ErrNoStorage = errors.New("Backend user does not implement wrap.Storage")
+
+// Storage should be implemented by the backend.User returned by the wrapped
+// backend.
+type Storage interface {
+	// UIDs returns the UIDs of all messages in the mailbox in ascending
+	// order. backend.ErrNoSuchMailbox should be returned if the mailbox does
+	// not exist.
+	UIDs(mbox string) ([]uint32, error)
+
+	// Flags returns the current flags of the specified messages. Messages
+	// that do not exist should be omitted.
+	Flags(mbox string, uids *imap.SeqSet) (map[uint32][]string, error)
+}
+
+// RecentStorage can be implemented by the backend.User to store \Recent flag
+// for messages added while the mailbox was not selected by any session.
+// Otherwise, such messages are never reported as \Recent.
+type RecentStorage interface {
+	// SetRecent sets persistent \Recent flag on the messages.
+	SetRecent(mbox string, uids *imap.SeqSet) error
+
+	// TakeRecent returns messages with persistent \Recent flag and clears it.
+	TakeRecent(mbox string) (*imap.SeqSet, error)
+}
+
+type Backend struct {
+	backend.Backend
+	mngr *mess.Manager
+
+	// locks serializes operations changing the same mailbox so changes
+	// made by concurrent sessions are not reported twice. Entries are
+	// removed once no goroutine holds or waits for the lock.
+	locksLock sync.Mutex
+	locks     map[mess.MailboxKey]*mailboxLock
+}
+
+type mailboxLock struct {
+	sync.Mutex
+	// refs is the amount of goroutines holding or waiting for the lock,
+	// protected by Backend.locksLock.
+	refs int
+}
+
+// New wraps the backend so all mailbox changes are dispatched using mngr.
+func New(be backend.Backend, mngr *mess.Manager) *Backend {
+	return &Backend{
+		Backend: be,
+		mngr:    mngr,
+		locks:   make(map[mess.MailboxKey]*mailboxLock),
+	}
+}
+
+// Manager returns the update manager used by the backend.
+func (be *Backend) Manager() *mess.Manager {
+	return be.mngr
+}
+
+func (be *Backend) lock(key mess.MailboxKey) (unlock func()) {
+	be.locksLock.Lock()
+	l := be.locks[key]
+	if l == nil {
+		l = &mailboxLock{}
+		be.locks[key] = l
+	}
+	l.refs++
+	be.locksLock.Unlock()
+
+	l.Lock()
+	return func() {
+		l.Unlock()
+
+		be.locksLock.Lock()
+		l.refs--
+		if l.refs == 0 {
+			delete(be.locks, key)
+		}
+		be.locksLock.Unlock()
+	}
+}
+
+// lockPair locks two mailboxes in a consistent order.
+func (be *Backend) lockPair(a, b mess.MailboxKey) (unlock func()) {
+	if a == b {
+		return be.lock(a)
+	}
+	if b.MailboxID < a.MailboxID {
+		a, b = b, a
+	}
+	unlockA := be.lock(a)
+	unlockB := be.lock(b)
+	return func() {
+		unlockB()
+		unlockA()
+	}
+}
+
+func (be *Backend) Login(connInfo *imap.ConnInfo, username, password string) (backend.User, error) {
+	u, err := be.Backend.Login(connInfo, username, password)
+	if err != nil {
+		return nil, err
+	}
+	storage, ok := u.(Storage)
+	if !ok {
+		u.Logout()
+		return nil, ErrNoStorage
+	}
+	return &User{User: u, be: be, storage: storage}, nil
+}
+
+type User struct {
+	backend.User
+	be      *Backend
+	storage Storage
+}
+
+func (u *User) key(mbox string) mess.MailboxKey {
+	return mess.MailboxKey{Account: u.Username(), MailboxID: mbox}
+}
+
+// diffUids returns UIDs present only in before or only in after. Both slices
+// should be sorted.
+func diffUids(before, after []uint32) (added, removed imap.SeqSet) {
+	i, j := 0, 0
+	for i < len(before) && j < len(after) {
+		switch {
+		case before[i] == after[j]:
+			i++
+			j++
+		case before[i] < after[j]:
+			removed.AddNum(before[i])
+			i++
+		default:
+			added.AddNum(after[j])
+			j++
+		}
+	}
+	for ; i < len(before); i++ {
+		removed.AddNum(before[i])
+	}
+	for ; j < len(after); j++ {
+		added.AddNum(after[j])
+	}
+	return added, removed
+}
+
+// newMessages reports messages added to mbox since before was read.
+//
+// The mailbox lock should be held.
+func (u *User) newMessages(mbox string, before []uint32) error {
+	after, err := u.storage.UIDs(mbox)
+	if err != nil {
+		return err
+	}
+	added, _ := diffUids(before, after)
+	if added.Empty() {
+		return nil
+	}
+
+	// NewMessage, as opposed to NewMessages, reports storeRecent if there
+	// are no sessions.
+	recent := imap.SeqSet{}
+	for _, seq := range added.Set {
+		for uid := seq.Start; uid <= seq.Stop && uid != 0; uid++ {
+			if storeRecent, _ := u.be.mngr.NewMessage(u.key(mbox), uid); storeRecent {
+				recent.AddNum(uid)
+			}
+		}
+	}
+
+	if rs, ok := u.User.(RecentStorage); ok && !recent.Empty() {
+		return rs.SetRecent(mbox, &recent)
+	}
+	return nil
+}
+
+func (u *User) CreateMessage(mbox string, flags []string, date time.Time, body imap.Literal, selMbox backend.Mailbox) error {
+	if wrapped, ok := selMbox.(*Mailbox); ok {
+		selMbox = wrapped.inner
+	}
+	if wrapped, ok := selMbox.(*MoveMailbox); ok {
+		selMbox = wrapped.inner
+	}
+
+	defer u.be.lock(u.key(mbox))()
+
+	before, err := u.storage.UIDs(mbox)
+	if err != nil {
+		return err
+	}
+	if err := u.User.CreateMessage(mbox, flags, date, body, selMbox); err != nil {
+		return err
+	}
+	return u.newMessages(mbox, before)
+}
+
+func (u *User) GetMailbox(name string, readOnly bool, conn backend.Conn) (*imap.MailboxStatus, backend.Mailbox, error) {
+	key := u.key(name)
+	defer u.be.lock(key)()
+
+	status, inner, err := u.User.GetMailbox(name, readOnly, conn)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	uids, err := u.storage.UIDs(name)
+	if err != nil {
+		inner.Close()
+		return nil, nil, err
+	}
+	// EXAMINE must not clear \Recent (RFC 3501, section 6.3.2).
+	var recent *imap.SeqSet
+	rs, ok := u.User.(RecentStorage)
+	if ok && !readOnly {
+		recent, err = rs.TakeRecent(name)
+		if err != nil {
+			inner.Close()
+			return nil, nil, err
+		}
+	}
+
+	mbox := &Mailbox{
+		mailboxOps: inner,
+		inner:      inner,
+		user:       u,
+		name:       name,
+		readOnly:   readOnly,
+		selectedAt: time.Now(),
+	}
+	if err := mbox.Open(u.be.mngr, key, conn, mbox, uids, recent); err != nil {
+		inner.Close()
+		if recent != nil && !recent.Empty() {
+			// Put the flag back so it is not lost.
+			rs.SetRecent(name, recent)
+		}
+		return nil, nil, err
+	}
+
+	// Make sure the initial state matches the session view.
+	view := mbox.Handle.View()
+	if _, ok := status.Items[imap.StatusMessages]; ok {
+		status.Messages = uint32(view.MsgsCount())
+	}
+	if _, ok := status.Items[imap.StatusRecent]; ok {
+		status.Recent = 0
+		for _, uid := range view.Uids() {
+			if view.IsRecent(uid) {
+				status.Recent++
+			}
+		}
+	}
+
+	if _, ok := inner.(backend.MoveMailbox); ok {
+		return status, &MoveMailbox{Mailbox: mbox}, nil
+	}
+	return status, mbox, nil
+}
+
+func (u *User) DeleteMailbox(name string) error {
+	key := u.key(name)
+	defer u.be.lock(key)()
+
+	if err := u.User.DeleteMailbox(name); err != nil {
+		return err
+	}
+	u.be.mngr.MailboxDestroyed(key)
+	return nil
+}
+
+// RenameMailbox renames the mailbox and stops dispatching updates for
+// sessions that have the source or target mailbox, or any of their
+// children, selected.
+func (u *User) RenameMailbox(existingName, newName string) error {
+	defer u.be.lockPair(u.key(existingName), u.key(newName))()
+
+	if err := u.User.RenameMailbox(existingName, newName); err != nil {
+		return err
+	}
+
+	u.be.mngr.MailboxDestroyed(u.key(existingName))
+	u.be.mngr.MailboxDestroyed(u.key(newName))
+
+	infos, err := u.User.ListMailboxes(false)
+	if err != nil || len(infos) == 0 || infos[0].Delimiter == "" {
+		return nil
+	}
+	delim := infos[0].Delimiter
+	for _, key := range u.be.mngr.AccountMailboxes(u.Username()) {
+		if strings.HasPrefix(key.MailboxID, existingName+delim) || strings.HasPrefix(key.MailboxID, newName+delim) {
+			u.be.mngr.MailboxDestroyed(key)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,427 @@
+package wrap
+
+import (
+	"bytes"
+	"context"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/emersion/go-imap"
+	"github.com/emersion/go-imap/backend"
+	mess "github.com/foxcpp/go-imap-mess"
+	"github.com/foxcpp/go-imap-mess/messtest"
+)
+
+type testSession struct {
+	*messtest.Session
+	user backend.User
+	mbox backend.Mailbox
+}
+
+func login(t *testing.T, be *Backend) backend.User {
+	t.Helper()
+	u, err := be.Login(nil, "user", "pass")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return u
+}
+
+func selectMbox(t *testing.T, be *Backend, name string) *testSession {
+	t.Helper()
+
+	u := login(t, be)
+	conn := &messtest.FakeConn{}
+	_, mbox, err := u.GetMailbox(name, false, conn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &testSession{
+		Session: &messtest.Session{T: t, Conn: conn},
+		user:    u,
+		mbox:    mbox,
+	}
+}
+
+func appendMsg(t *testing.T, u backend.User, mbox string, flags ...string) {
+	t.Helper()
+	if err := u.CreateMessage(mbox, flags, time.Time{}, bytes.NewReader(nil), nil); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func fetch(t *testing.T, mbox backend.Mailbox, uid bool, seq string, items ...imap.FetchItem) []*imap.Message {
+	t.Helper()
+
+	set, _ := imap.ParseSeqSet(seq)
+	ch := make(chan *imap.Message, 10)
+	if err := mbox.ListMessages(uid, set, items, ch); err != nil {
+		t.Fatal(err)
+	}
+	var msgs []*imap.Message
+	for msg := range ch {
+		msgs = append(msgs, msg)
+	}
+	return msgs
+}
+
+func store(t *testing.T, mbox backend.Mailbox, uid bool, seq string, op imap.FlagsOp, flags ...string) {
+	t.Helper()
+
+	set, _ := imap.ParseSeqSet(seq)
+	if err := mbox.UpdateMessagesFlags(uid, set, op, false, flags); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestDiffUids(t *testing.T) {
+	added, removed := diffUids([]uint32{1, 2, 4, 5}, []uint32{2, 3, 5, 6, 7})
+	if added.String() != "3,6:7" || removed.String() != "1,4" {
+		t.Fatalf("Unexpected diff: added %v, removed %v", added.String(), removed.String())
+	}
+}
+
+func TestLoginNoStorage(t *testing.T) {
+	be := New(noStorageBackend{}, mess.NewManager())
+	if _, err := be.Login(nil, "user", "pass"); err != ErrNoStorage {
+		t.Fatal("Expected ErrNoStorage, got", err)
+	}
+}
+
+type noStorageBackend struct{}
+
+func (noStorageBackend) Login(*imap.ConnInfo, string, string) (backend.User, error) {
+	return struct{ backend.User }{&testUser{}}, nil
+}
+
+func TestAppend(t *testing.T) {
+	be := New(newTestBackend(), mess.NewManager())
+
+	s1 := selectMbox(t, be, "INBOX")
+	s2 := selectMbox(t, be, "INBOX")
+	defer s1.mbox.Close()
+	defer s2.mbox.Close()
+
+	appendMsg(t, s1.user, "INBOX")
+	appendMsg(t, login(t, be), "INBOX")
+
+	s1.mbox.Poll(true)
+	s1.ExpectExists(2)
+	s1.ExpectRecent(2)
+	s1.ExpectNone()
+
+	s2.mbox.Poll(true)
+	s2.ExpectExists(2)
+	s2.ExpectNone()
+
+	msgs := fetch(t, s1.mbox, false, "1:*", imap.FetchFlags)
+	if len(msgs) != 2 || !reflect.DeepEqual(msgs[1].Flags, []string{imap.RecentFlag}) {
+		t.Fatalf("Unexpected FETCH result: %+v", msgs)
+	}
+}
+
+func TestAppendRecentStorage(t *testing.T) {
+	be := New(newTestBackend(), mess.NewManager())
+
+	appendMsg(t, login(t, be), "INBOX")
+
+	u := login(t, be)
+	status, mbox, err := u.GetMailbox("INBOX", false, &messtest.FakeConn{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer mbox.Close()
+	if status.Messages != 1 || status.Recent != 1 {
+		t.Fatalf("Expected 1 EXISTS, 1 RECENT, got %d, %d", status.Messages, status.Recent)
+	}
+
+	// Flag is taken by the first session.
+	status, mbox2, err := u.GetMailbox("INBOX", false, &messtest.FakeConn{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer mbox2.Close()
+	if status.Recent != 0 {
+		t.Fatalf("Expected 0 RECENT, got %d", status.Recent)
+	}
+}
+
+func TestExamineKeepsRecent(t *testing.T) {
+	be := New(newTestBackend(), mess.NewManager())
+
+	appendMsg(t, login(t, be), "INBOX")
+
+	u := login(t, be)
+	_, mbox, err := u.GetMailbox("INBOX", true, &messtest.FakeConn{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	mbox.Close()
+
+	status, mbox, err := u.GetMailbox("INBOX", false, &messtest.FakeConn{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer mbox.Close()
+	if status.Recent != 1 {
+		t.Fatalf("\\Recent cleared by EXAMINE, got %d RECENT", status.Recent)
+	}
+}
+
+func TestSelectFailKeepsRecent(t *testing.T) {
+	be := New(newTestBackend(), mess.NewManager())
+
+	appendMsg(t, login(t, be), "INBOX")
+	if err := be.Manager().Shutdown(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, _, err := login(t, be).GetMailbox("INBOX", false, &messtest.FakeConn{}); err != mess.ErrManagerClosed {
+		t.Fatal("Expected ErrManagerClosed, got", err)
+	}
+	if recent := be.Backend.(*testBackend).user.mailboxes["INBOX"].recent; !recent.Contains(1) {
+		t.Fatal("Persistent \\Recent lost:", recent.String())
+	}
+}
+
+func TestStoreExpungeSeqNums(t *testing.T) {
+	be := New(newTestBackend(), mess.NewManager())
+	u := login(t, be)
+	for i := 0; i < 3; i++ {
+		appendMsg(t, u, "INBOX")
+	}
+
+	s1 := selectMbox(t, be, "INBOX")
+	s2 := selectMbox(t, be, "INBOX")
+	defer s1.mbox.Close()
+	defer s2.mbox.Close()
+
+	store(t, s1.mbox, false, "2", imap.AddFlags, imap.DeletedFlag)
+	s1.ExpectFetchFlags(2, imap.DeletedFlag, imap.RecentFlag)
+	if err := s1.mbox.Expunge(); err != nil {
+		t.Fatal(err)
+	}
+	s1.ExpectExpunge(2)
+	s1.ExpectNone()
+
+	// s2 did not see the EXPUNGE yet so sequence number 3 is still UID 3.
+	store(t, s2.mbox, false, "3", imap.AddFlags, imap.FlaggedFlag)
+	s2.ExpectFetchFlags(2, imap.DeletedFlag)
+	s2.ExpectFetchFlags(3, imap.FlaggedFlag)
+	s2.ExpectNone()
+
+	msgs := fetch(t, s2.mbox, false, "3", imap.FetchUid)
+	if len(msgs) != 1 || msgs[0].Uid != 3 || msgs[0].SeqNum != 3 {
+		t.Fatalf("Unexpected FETCH result: %+v", msgs)
+	}
+
+	s2.mbox.Poll(true)
+	s2.ExpectExpunge(2)
+	s2.ExpectNone()
+
+	s1.mbox.Poll(true)
+	s1.ExpectFetchFlags(2, imap.FlaggedFlag, imap.RecentFlag)
+	s1.ExpectNone()
+}
+
+func TestFetchSetsSeen(t *testing.T) {
+	be := New(newTestBackend(), mess.NewManager())
+	appendMsg(t, login(t, be), "INBOX")
+
+	s1 := selectMbox(t, be, "INBOX")
+	s2 := selectMbox(t, be, "INBOX")
+	defer s1.mbox.Close()
+	defer s2.mbox.Close()
+
+	fetch(t, s1.mbox, true, "1", "BODY[]")
+	s1.ExpectFetchFlags(1, imap.SeenFlag, imap.RecentFlag)
+	s1.ExpectNone()
+
+	s2.mbox.Poll(false)
+	s2.ExpectFetchFlags(1, imap.SeenFlag)
+	s2.ExpectNone()
+}
+
+func TestFetchAlreadySeen(t *testing.T) {
+	mngr := mess.NewManager()
+	upds := make(chan mess.Update, 10)
+	mngr.SetExternalSink(upds)
+	be := New(newTestBackend(), mngr)
+	appendMsg(t, login(t, be), "INBOX", imap.SeenFlag)
+	<-upds
+
+	s1 := selectMbox(t, be, "INBOX")
+	s2 := selectMbox(t, be, "INBOX")
+	defer s1.mbox.Close()
+	defer s2.mbox.Close()
+
+	fetch(t, s1.mbox, true, "1", "BODY[]")
+	s1.ExpectNone()
+	s2.mbox.Poll(false)
+	s2.ExpectNone()
+	if len(upds) != 0 {
+		t.Fatal("Unexpected update dispatched:", <-upds)
+	}
+}
+
+func TestSearchRecent(t *testing.T) {
+	be := New(newTestBackend(), mess.NewManager())
+	u := login(t, be)
+	appendMsg(t, u, "INBOX", imap.SeenFlag)
+
+	s := selectMbox(t, be, "INBOX")
+	defer s.mbox.Close()
+
+	appendMsg(t, u, "INBOX")
+	appendMsg(t, u, "INBOX", imap.SeenFlag)
+	s.mbox.Poll(true)
+	s.ExpectExists(3)
+	s.ExpectRecent(3)
+
+	search := func(criteria *imap.SearchCriteria) []uint32 {
+		t.Helper()
+		res, err := s.mbox.SearchMessages(false, criteria)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return res
+	}
+
+	// First message was recent before the session started, persistent \Recent
+	// is taken by it.
+	if res := search(&imap.SearchCriteria{WithoutFlags: []string{imap.RecentFlag}}); len(res) != 0 {
+		t.Fatal("Unexpected OLD result:", res)
+	}
+	res := search(&imap.SearchCriteria{WithFlags: []string{imap.RecentFlag}, WithoutFlags: []string{imap.SeenFlag}})
+	if !reflect.DeepEqual(res, []uint32{2}) {
+		t.Fatal("Unexpected NEW result:", res)
+	}
+	res = search(&imap.SearchCriteria{Not: []*imap.SearchCriteria{{WithFlags: []string{imap.SeenFlag}}}})
+	if !reflect.DeepEqual(res, []uint32{2}) {
+		t.Fatal("Unexpected UNSEEN result:", res)
+	}
+}
+
+func TestCopyMove(t *testing.T) {
+	be := New(newTestBackend(), mess.NewManager())
+	u := login(t, be)
+	appendMsg(t, u, "INBOX")
+	appendMsg(t, u, "INBOX")
+
+	src := selectMbox(t, be, "INBOX")
+	dst := selectMbox(t, be, "Archive")
+	defer src.mbox.Close()
+	defer dst.mbox.Close()
+
+	set, _ := imap.ParseSeqSet("1")
+	if err := src.mbox.CopyMessages(false, set, "Archive"); err != nil {
+		t.Fatal(err)
+	}
+	mover, ok := src.mbox.(backend.MoveMailbox)
+	if !ok {
+		t.Fatal("Mailbox does not implement MoveMailbox")
+	}
+	if err := mover.MoveMessages(false, set, "Archive"); err != nil {
+		t.Fatal(err)
+	}
+	src.ExpectExpunge(1)
+	src.ExpectNone()
+
+	dst.mbox.Poll(true)
+	dst.ExpectExists(2)
+	dst.ExpectRecent(2)
+	dst.ExpectNone()
+}
+
+func TestRenameDelete(t *testing.T) {
+	be := New(newTestBackend(), mess.NewManager())
+	be.Backend.(*testBackend).user.mailboxes["Archive/2020"] = &testMailboxData{}
+
+	s := selectMbox(t, be, "Archive/2020")
+	defer s.mbox.Close()
+
+	if err := s.user.RenameMailbox("Archive", "Old"); err != nil {
+		t.Fatal(err)
+	}
+	if keys := be.Manager().AccountMailboxes("user"); len(keys) != 0 {
+		t.Fatal("Child mailbox is still tracked:", keys)
+	}
+
+	s = selectMbox(t, be, "INBOX")
+	defer s.mbox.Close()
+	if err := s.user.DeleteMailbox("INBOX"); err != nil {
+		t.Fatal(err)
+	}
+	if keys := be.Manager().AccountMailboxes("user"); len(keys) != 0 {
+		t.Fatal("Deleted mailbox is still tracked:", keys)
+	}
+}
+
+func TestNoMatchSeqNums(t *testing.T) {
+	be := New(newTestBackend(), mess.NewManager())
+	s := selectMbox(t, be, "INBOX")
+	defer s.mbox.Close()
+
+	set, _ := imap.ParseSeqSet("1:*")
+	if err := s.mbox.UpdateMessagesFlags(false, set, imap.AddFlags, false, []string{imap.SeenFlag}); err == nil {
+		t.Fatal("Expected error for sequence numbers in an empty mailbox")
+	}
+	if err := s.mbox.UpdateMessagesFlags(true, set, imap.AddFlags, false, []string{imap.SeenFlag}); err != nil {
+		t.Fatal("Unexpected error for UIDs:", err)
+	}
+}
+
+func TestLocksPruned(t *testing.T) {
+	be := New(newTestBackend(), mess.NewManager())
+	be.Backend.(*testBackend).user.mailboxes["Archive/2020"] = &testMailboxData{}
+	u := login(t, be)
+
+	appendMsg(t, u, "INBOX")
+	appendMsg(t, u, "Archive/2020")
+	if err := u.DeleteMailbox("INBOX"); err != nil {
+		t.Fatal(err)
+	}
+	if err := u.RenameMailbox("Archive", "Old"); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(be.locks) != 0 {
+		t.Fatal("Locks are not pruned:", be.locks)
+	}
+}
+
+func TestLockRefs(t *testing.T) {
+	be := New(newTestBackend(), mess.NewManager())
+	key := mess.MailboxKey{Account: "user", MailboxID: "INBOX"}
+
+	refs := func() int {
+		be.locksLock.Lock()
+		defer be.locksLock.Unlock()
+		if l := be.locks[key]; l != nil {
+			return l.refs
+		}
+		return 0
+	}
+
+	unlock := be.lock(key)
+	locked := make(chan func())
+	go func() {
+		locked <- be.lock(key)
+	}()
+	for refs() != 2 {
+		time.Sleep(time.Millisecond)
+	}
+	unlock()
+
+	// The entry is kept while the waiter holds the lock so new callers
+	// wait for the same mutex.
+	unlockWaiter := <-locked
+	if refs() != 1 {
+		t.Fatal("Lock entry removed while held")
+	}
+	unlockWaiter()
+	if len(be.locks) != 0 {
+		t.Fatal("Lock entry is not removed:", be.locks)
+	}
+}